@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"syncdir/engine"
+)
+
+// stdin is where --conflict=prompt reads answers; tests swap it.
+var stdin io.Reader = os.Stdin
+
+func bisyncUsage() string {
+	return fmt.Sprintf(`%s bisync - two-way sync with conflict detection
+
+Usage:
+  %s bisync [--conflict keep-both|newer|prompt] [--state FILE] [--dry-run] [--checksum] [--bwlimit RATE]
+                [--checksum-algo ALGO] [--checksum-cache DIR] [--no-checksum-cache]
+                [--include PATTERN ...] [--exclude PATTERN ...] [--exclude-from FILE ...]
+                [--verbose] [--output text|json] A B
+
+Propagates creations, modifications and deletions in either direction.
+Each run records every file's size and mtime on both sides; the next run
+compares against that record. A file changed on both sides is a conflict:
+  keep-both   (default) keep A's version under the name and B's as
+              NAME.conflict-B-YYYYMMDD-HHMMSS.EXT on both sides
+  newer       the version with the later mtime wins (a tie keeps both)
+  prompt      ask for each conflict on the terminal
+The first run merges A and B and never deletes anything.
+
+Options:
+  --conflict P   Conflict policy: keep-both, newer or prompt
+  --state FILE   State file (default: per A/B pair under the user config directory)
+  --dry-run      Show actions without changing anything (state is not updated)
+  --checksum     Compare hashes to decide whether two files are equal (hashes are
+                 cached; see 'help cp')
+  --checksum-algo A  sha1 (default), sha256, crc32c or xxh64
+  --checksum-cache D  Directory of the hash caches
+  --no-checksum-cache Hash every file on every --checksum run
+  --bwlimit R    Limit copy throughput, e.g. 10M (see 'help cp')
+  --include X    Include pattern (can repeat; see 'help cp')
+  --exclude X    Exclude pattern (can repeat; see 'help cp')
+  --exclude-from F  Read exclude patterns from a .gitignore-style file
+  --verbose      Verbose logging
+  --output F     Output format: text (default) or json
+  --help         Show this help for 'bisync'
+
+Examples:
+  %s bisync "C:\Users\me\work" "\\nas\share\work"
+  %s bisync --conflict newer --exclude ".git" "C:\work" "E:\work"
+`, appName, appName, appName, appName)
+}
+
+/* =========================
+      SUBCOMMAND: bisync
+========================= */
+
+func runBisync(args []string) {
+	fs := flag.NewFlagSet("bisync", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var opt engine.Options
+	var rules []engine.Rule
+	var verbose, wantHelp, noSumCache bool
+	var output, conflict, state, sumCache string
+	fs.StringVar(&conflict, "conflict", string(engine.ConflictKeepBoth), "conflict policy: keep-both, newer or prompt")
+	fs.StringVar(&state, "state", "", "state file")
+	fs.BoolVar(&opt.DryRun, "dry-run", false, "show actions without changing anything")
+	fs.BoolVar(&opt.Checksum, "checksum", false, "compare file hashes")
+	fs.StringVar(&opt.ChecksumAlgo, "checksum-algo", engine.DefaultChecksumAlgo, "hash algorithm for --checksum")
+	fs.StringVar(&sumCache, "checksum-cache", "", "directory of the --checksum hash caches")
+	fs.BoolVar(&noSumCache, "no-checksum-cache", false, "hash every file on every --checksum run")
+	fs.Var(bwLimitFlag{&opt.BwLimit}, "bwlimit", "byte-rate limit, e.g. 10M")
+	fs.Var(ruleFlag{rules: &rules}, "exclude", "exclude pattern (repeatable)")
+	fs.Var(ruleFlag{rules: &rules, include: true}, "include", "include pattern (repeatable)")
+	fs.Var(ruleFlag{rules: &rules, file: true}, "exclude-from", "read exclude patterns from FILE (repeatable)")
+	fs.BoolVar(&verbose, "verbose", false, "verbose logging")
+	fs.StringVar(&output, "output", outputText, "output format: text or json")
+	fs.BoolVar(&wantHelp, "help", false, "show help")
+
+	if err := fs.Parse(args); err != nil {
+		dieUsage(bisyncUsage, "Argument error: %v\n", err)
+	}
+	if wantHelp {
+		printErr(bisyncUsage())
+		exitFn(exitUsage)
+	}
+	if output != outputText && output != outputJSON {
+		dieUsage(bisyncUsage, "error: --output must be %q or %q (got %q)\n", outputText, outputJSON, output)
+	}
+	switch engine.ConflictPolicy(conflict) {
+	case engine.ConflictKeepBoth, engine.ConflictNewer:
+	case engine.ConflictPrompt:
+		opt.Resolve = conflictPrompt(bufio.NewReader(stdin))
+	default:
+		dieUsage(bisyncUsage, "error: --conflict must be keep-both, newer or prompt (got %q)\n", conflict)
+	}
+	opt.Conflict = engine.ConflictPolicy(conflict)
+	if _, err := engine.NewFilter(rules); err != nil {
+		dieUsage(bisyncUsage, "error: %v\n", err)
+	}
+	opt.Rules = rules
+	if fs.NArg() != 2 {
+		dieUsage(bisyncUsage, "error: need A and B\n")
+	}
+	a, b := filepath.Clean(fs.Arg(0)), filepath.Clean(fs.Arg(1))
+
+	if state == "" {
+		var err error
+		if state, err = engine.DefaultBisyncState(a, b); err != nil {
+			dieRuntime(fmt.Errorf("no default state location (%v); use --state FILE", err))
+		}
+	}
+	opt.ChecksumCache = checksumCacheDir(sumCache, noSumCache)
+	opt.Reporter = newReporter(output, verbose)
+	if _, err := engine.New(opt).Bisync(a, b, state); err != nil {
+		switch {
+		case errors.Is(err, engine.ErrBisyncEmptySide):
+			dieRuntime(fmt.Errorf("%w; is a drive missing? (state: %s)", err, state))
+		case errors.Is(err, engine.ErrSrcNotExist):
+			dieUsage(bisyncUsage, "error: directory does not exist: %v\n", err)
+		case errors.Is(err, engine.ErrSamePath), errors.Is(err, engine.ErrDstInsideSrc), errors.Is(err, engine.ErrInvalidOption):
+			dieUsage(bisyncUsage, "error: %v\n", err)
+		}
+		dieRuntime(err)
+	}
+}
+
+// conflictPrompt asks on stderr how to settle each conflict and reads the
+// answer from in. At EOF the file is skipped.
+func conflictPrompt(in *bufio.Reader) func(engine.Conflict) engine.Resolution {
+	return func(c engine.Conflict) engine.Resolution {
+		for {
+			printErr(fmt.Sprintf("conflict: %s\n  A: %d bytes, %s\n  B: %d bytes, %s\n[a] keep A  [b] keep B  [k] keep both  [s] skip? ",
+				c.Path, c.A.Size, c.A.ModTime.Format("2006-01-02 15:04:05"), c.B.Size, c.B.ModTime.Format("2006-01-02 15:04:05")))
+			line, err := in.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "a":
+				return engine.ResolveA
+			case "b":
+				return engine.ResolveB
+			case "k":
+				return engine.ResolveBoth
+			case "s":
+				return engine.ResolveSkip
+			}
+			if err != nil {
+				printErr("\n")
+				return engine.ResolveSkip
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* =========================
+           BACKUPS
+========================= */
+
+// With Options.Backup, the previous version of a DST file is kept before a
+// copy overwrites it or the mirror pass deletes it. Without BackupDir it is
+// renamed to "<name><suffix>" next to the original (suffix "~" by default).
+// With BackupDir it goes to BackupDir/<YYYYMMDD-HHMMSS>/<path>, one
+// timestamped directory per run that mirrors the tree layout ("-2", "-3",
+// ... are appended when a run of the same second has one already); a
+// relative BackupDir is taken relative to the DST root. Backup directories
+// inside SRC or DST are excluded from the sync (see reservedRules).
+//
+// Suffixed backups are never mirrored away, so every DST entry ending in the
+// suffix counts as one. A SRC entry ending in it would be clobbered by the
+// backup of its neighbor, so Sync refuses it (ErrInvalidOption): pick
+// another suffix, a BackupDir or exclude the entry.
+//
+// Overwritten files are hard-linked into place when possible, so DST keeps
+// its atomic replacement; otherwise, and for in-place --delta updates, they
+// are copied. Deleted entries are renamed (copied across filesystems).
+
+// EventBackup is reported when an entry is saved; Backup holds its new path.
+const EventBackup = "backup"
+
+const (
+	defaultBackupSuffix = "~"
+	backupStampFormat   = "20060102-150405"
+)
+
+// backupSuffix is the suffix in effect for o.
+func (o options) backupSuffix() string {
+	if o.BackupSuffix == "" && o.BackupDir == "" {
+		return defaultBackupSuffix
+	}
+	return o.BackupSuffix
+}
+
+// isBackupName matches suffixed backups, which the mirror pass keeps and
+// copyTree refuses in SRC.
+func isBackupName(name string, o options) bool {
+	return o.Backup && o.BackupDir == "" && strings.HasSuffix(name, o.backupSuffix())
+}
+
+// backupBase is the directory BackupDir stands for, before the run stamp.
+func backupBase(dst string, o Options) string {
+	if filepath.IsAbs(o.BackupDir) {
+		return filepath.Clean(o.BackupDir)
+	}
+	return filepath.Join(dst, o.BackupDir)
+}
+
+// reservedRules excludes backup and trash directories that lie inside src
+// or dst. They come first, so no include rule can bring them back.
+func reservedRules(src, dst string, o Options) []Rule {
+	if dst == "" {
+		return nil
+	}
+	var dirs []string
+	if o.Backup && o.BackupDir != "" {
+		dirs = append(dirs, backupBase(dst, o))
+	}
+	if o.Trash {
+		dirs = append(dirs, trashBase(dst, o))
+	}
+	var rules []Rule
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		for _, root := range []string{src, dst} {
+			absRoot, err := filepath.Abs(root)
+			if err != nil || !isSubpath(abs, absRoot) {
+				continue
+			}
+			if rel, err := filepath.Rel(absRoot, abs); err == nil {
+				rules = append(rules, Rule{Patterns: []string{"/" + filepath.ToSlash(rel) + "/"}})
+			}
+		}
+	}
+	return rules
+}
+
+// withBackupRoot fixes the timestamped backup directory of this run, one
+// no earlier run has used.
+func (o options) withBackupRoot(start time.Time) options {
+	if o.Backup && o.BackupDir != "" && o.dstRoot != "" {
+		stamp := start.Format(backupStampFormat)
+		root := filepath.Join(backupBase(o.dstRoot, o.Options), stamp)
+		for i := 2; ; i++ {
+			if _, err := os.Lstat(root); os.IsNotExist(err) {
+				break
+			}
+			root = filepath.Join(backupBase(o.dstRoot, o.Options), fmt.Sprintf("%s-%d", stamp, i))
+		}
+		o.backupRoot = root
+	}
+	return o
+}
+
+// backupPath is where the current version of dstPath is saved.
+func (o options) backupPath(dstPath string) string {
+	if o.BackupDir == "" {
+		return dstPath + o.backupSuffix()
+	}
+	root := o.backupRoot
+	if root == "" {
+		root = backupBase(o.dstRoot, o.Options)
+	}
+	return filepath.Join(root, o.relPath(dstPath)) + o.BackupSuffix
+}
+
+// backupFile saves the file at dstPath before it is overwritten. inPlace
+// means the file itself is about to be modified, so it must be copied.
+func backupFile(dstPath string, inPlace bool, opt options) error {
+	bp := opt.backupPath(dstPath)
+	if !opt.DryRun {
+		if err := prepareBackup(bp); err != nil {
+			return err
+		}
+		if inPlace || os.Link(dstPath, bp) != nil {
+			if err := copyOneFile(dstPath, bp, options{}); err != nil {
+				return err
+			}
+		}
+	}
+	opt.emit(Event{Type: EventBackup, Dst: dstPath, Backup: bp, Reason: "overwrite"})
+	return nil
+}
+
+// backupRemoved moves an entry the mirror pass is about to delete.
+func backupRemoved(path string, isDir bool, opt options) error {
+	bp := opt.backupPath(path)
+	if !opt.DryRun {
+		if err := prepareBackup(bp); err != nil {
+			return err
+		}
+		if err := moveAside(path, bp, isDir); err != nil {
+			return err
+		}
+	}
+	opt.emit(Event{Type: EventBackup, Dst: path, Dir: isDir, Backup: bp, Reason: "delete"})
+	return nil
+}
+
+// prepareBackup creates the parent of bp and clears an older backup there.
+func prepareBackup(bp string) error {
+	if err := os.MkdirAll(filepath.Dir(bp), 0o755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(bp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func copyAside(path, bp string, isDir bool) error {
+	if !isDir {
+		return copyOneFile(path, bp, options{})
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(path, p)
+		target := filepath.Join(bp, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case d.Type().IsRegular():
+			return copyOneFile(p, target, options{})
+		}
+		return nil // links and special files are not kept
+	})
+}
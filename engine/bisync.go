@@ -0,0 +1,563 @@
+package engine
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* =========================
+       BIDIRECTIONAL SYNC
+========================= */
+
+// Bisync keeps two trees, A and B, in step. After each run it records the
+// size and mtime of every file on both sides; the next run compares each
+// side with its own record to tell creations, modifications and deletions
+// apart, and propagates them. A file changed on both sides is a conflict,
+// settled by Options.Conflict.
+
+const bisyncStateVersion = 1
+
+// EventConflict is reported for a file changed on both sides. Reason says
+// what differed and how it was settled.
+const EventConflict = "conflict"
+
+// ErrBisyncEmptySide is returned when one side has no files although the
+// state lists some. That usually means an unmounted drive, and propagating
+// it would delete everything on the other side.
+var ErrBisyncEmptySide = errors.New("one side is empty but the bisync state lists files")
+
+// ConflictPolicy decides a conflict.
+type ConflictPolicy string
+
+const (
+	ConflictKeepBoth ConflictPolicy = "keep-both" // default: keep B's version under a conflict name
+	ConflictNewer    ConflictPolicy = "newer"     // the later mtime wins; a tie keeps both
+	ConflictPrompt   ConflictPolicy = "prompt"    // ask Options.Resolve
+)
+
+func (p ConflictPolicy) valid() bool {
+	switch p {
+	case "", ConflictKeepBoth, ConflictNewer, ConflictPrompt:
+		return true
+	}
+	return false
+}
+
+// Resolution is the outcome of one conflict.
+type Resolution int
+
+const (
+	ResolveSkip Resolution = iota // leave both files alone; asked again next run
+	ResolveA                      // A's version goes to both sides
+	ResolveB                      // B's version goes to both sides
+	ResolveBoth                   // keep both, B's under a conflict name
+)
+
+// Conflict describes a file changed on both sides, for Options.Resolve.
+type Conflict struct {
+	Path string // slash-separated, relative to the roots
+	A, B FileState
+}
+
+type bisyncState struct {
+	Version int                    `json:"version"`
+	A       string                 `json:"a"`
+	B       string                 `json:"b"`
+	Files   map[string]bisyncEntry `json:"files"`
+	Dirs    []string               `json:"dirs,omitempty"`
+}
+
+type bisyncEntry struct {
+	A FileState `json:"a"`
+	B FileState `json:"b"`
+}
+
+// DefaultBisyncState is where the CLI keeps the state for a pair of roots:
+// a file under the user config directory named after both absolute paths.
+func DefaultBisyncState(a, b string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	absA, _ := filepath.Abs(a)
+	absB, _ := filepath.Abs(b)
+	sum := sha1.Sum([]byte(absA + "\n" + absB))
+	return filepath.Join(dir, "syncdir", "bisync", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// Bisync syncs a and b in both directions, using and then updating the
+// state in stateFile. The first run (no state file) merges the trees and
+// never deletes. Uses Rules/Excludes, Checksum, ChecksumCache,
+// ChecksumAlgo, DryRun, Conflict, Resolve, BwLimit and Reporter; under
+// DryRun the state file is not written.
+func (s *Syncer) Bisync(a, b, stateFile string) (Result, error) {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if err := s.validateBisync(a, b); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+	filter, err := compileFilter(s.opt)
+	if err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+
+	t := newTally(s.reporter())
+	opt := options{Options: s.opt, rep: t, stats: &t.data, filter: filter, limit: newLimiter(s.opt.BwLimit)}
+	if opt, err = opt.withHashCaches(a, b); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+	err = runBisync(a, b, stateFile, opt)
+	if serr := opt.saveHashCaches(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		opt.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	}
+	sum := t.summary(opt.DryRun)
+	t.next.Report(sum)
+	return Result{Counts: sum.Counts, Bytes: sum.Size, Elapsed: time.Since(t.start), DryRun: opt.DryRun, Stats: *sum.Stats}, err
+}
+
+func (s *Syncer) validateBisync(a, b string) error {
+	if !s.opt.Conflict.valid() {
+		return wrapf(ErrInvalidOption, "unknown conflict policy %q", s.opt.Conflict)
+	}
+	if s.opt.Conflict == ConflictPrompt && s.opt.Resolve == nil {
+		return wrapf(ErrInvalidOption, "conflict policy %q needs a Resolve function", ConflictPrompt)
+	}
+	if _, err := LookupHasher(s.opt.ChecksumAlgo); err != nil {
+		return err
+	}
+	for _, root := range []string{a, b} {
+		fi, err := os.Stat(root)
+		if err != nil {
+			return wrapf(ErrSrcNotExist, "%s", root)
+		}
+		if !fi.IsDir() {
+			return wrapf(ErrInvalidOption, "bisync needs two directories: %s", root)
+		}
+	}
+	absA, _ := filepath.Abs(a)
+	absB, _ := filepath.Abs(b)
+	if samePath(absA, absB) {
+		return wrapf(ErrSamePath, "%s", absA)
+	}
+	if isSubpath(absA, absB) || isSubpath(absB, absA) {
+		return wrapf(ErrDstInsideSrc, "%s and %s are nested", absA, absB)
+	}
+	return nil
+}
+
+// bisyncSide is one scanned tree.
+type bisyncSide struct {
+	name  string // "A" or "B"
+	root  string
+	files map[string]fs.FileInfo
+	dirs  map[string]bool
+}
+
+func (sd *bisyncSide) path(rel string) string { return filepath.Join(sd.root, filepath.FromSlash(rel)) }
+
+func scanSide(name, root string, opt options) (*bisyncSide, error) {
+	sd := &bisyncSide{name: name, root: root, files: map[string]fs.FileInfo{}, dirs: map[string]bool{}}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." {
+			return nil
+		}
+		if isPartialDir(d, opt) {
+			return fs.SkipDir
+		}
+		if !d.IsDir() && (isTempName(d.Name()) || isPartialName(d.Name())) {
+			return nil
+		}
+		if opt.filter.Excluded(rel, d.IsDir()) {
+			if d.IsDir() && !opt.filter.Descend(rel) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		slash := filepath.ToSlash(rel)
+		switch {
+		case d.IsDir():
+			sd.dirs[slash] = true
+		case d.Type().IsRegular():
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			sd.files[slash] = fi
+		default:
+			opt.emit(Event{Type: EventSkip, Path: rel, Src: p, Reason: "not a regular file"})
+		}
+		return nil
+	})
+	return sd, err
+}
+
+// bisync is one run's working state.
+type bisync struct {
+	opt     options
+	a, b    *bisyncSide
+	old     bisyncState
+	oldDirs map[string]bool
+	next    map[string]bisyncEntry
+	alive   map[string]bool // dirs that still hold files after this run
+}
+
+func runBisync(a, b, stateFile string, opt options) error {
+	bs := &bisync{opt: opt, oldDirs: map[string]bool{}, next: map[string]bisyncEntry{}, alive: map[string]bool{}}
+	if err := bs.loadState(stateFile); err != nil {
+		return err
+	}
+	var err error
+	if bs.a, err = scanSide("A", a, opt); err != nil {
+		return err
+	}
+	if bs.b, err = scanSide("B", b, opt); err != nil {
+		return err
+	}
+	if len(bs.old.Files) > 0 && (len(bs.a.files) == 0) != (len(bs.b.files) == 0) {
+		return ErrBisyncEmptySide
+	}
+
+	// new directories, parents first
+	for _, rel := range sortedKeys(union(bs.a.dirs, bs.b.dirs)) {
+		if err := bs.dir(rel); err != nil {
+			return err
+		}
+	}
+	// files
+	oldFiles := map[string]bool{}
+	for rel := range bs.old.Files {
+		oldFiles[rel] = true
+	}
+	for _, rel := range sortedKeys(union(union(keys(bs.a.files), keys(bs.b.files)), oldFiles)) {
+		if err := bs.file(rel); err != nil {
+			return err
+		}
+	}
+	// directories deleted on one side, deepest first
+	dirs := bs.removeDirs()
+	if opt.DryRun {
+		return nil
+	}
+	absA, _ := filepath.Abs(a)
+	absB, _ := filepath.Abs(b)
+	return saveBisyncState(stateFile, bisyncState{Version: bisyncStateVersion, A: absA, B: absB, Files: bs.next, Dirs: dirs})
+}
+
+func (bs *bisync) loadState(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &bs.old); err != nil {
+		return fmt.Errorf("bisync state %s: %w", stateFile, err)
+	}
+	if bs.old.Version != bisyncStateVersion {
+		return wrapf(ErrInvalidOption, "unsupported bisync state version %d in %s", bs.old.Version, stateFile)
+	}
+	for _, d := range bs.old.Dirs {
+		bs.oldDirs[d] = true
+	}
+	return nil
+}
+
+func saveBisyncState(stateFile string, st bisyncState) error {
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile)
+}
+
+// dir creates a directory that exists on one side only and was not there
+// last time. Directories deleted on one side are handled by removeDirs.
+func (bs *bisync) dir(rel string) error {
+	inA, inB := bs.a.dirs[rel], bs.b.dirs[rel]
+	if inA == inB || bs.oldDirs[rel] {
+		return nil
+	}
+	to := bs.b
+	if inB {
+		to = bs.a
+	}
+	return ensureDir(to.path(rel), bs.sideOpt(to))
+}
+
+// change classifies a side's file against its recorded state.
+type change int
+
+const (
+	unchanged change = iota
+	created
+	modified
+	deleted
+)
+
+func changeOf(fi fs.FileInfo, rec FileState, known bool) change {
+	switch {
+	case fi == nil && !known:
+		return unchanged
+	case fi == nil:
+		return deleted
+	case !known:
+		return created
+	case !rec.matches(fi):
+		return modified
+	}
+	return unchanged
+}
+
+func (bs *bisync) file(rel string) error {
+	fa, fb := bs.a.files[rel], bs.b.files[rel]
+	rec, known := bs.old.Files[rel]
+	ca, cb := changeOf(fa, rec.A, known), changeOf(fb, rec.B, known)
+
+	switch {
+	case fa == nil && fb == nil:
+		return nil // gone on both sides
+	case ca == unchanged && cb == unchanged:
+		return bs.record(rel)
+	case cb == unchanged:
+		return bs.propagate(rel, bs.a, bs.b, "changed in A")
+	case ca == unchanged:
+		return bs.propagate(rel, bs.b, bs.a, "changed in B")
+	case fa == nil || fb == nil:
+		// modified on one side, deleted on the other: keep the modification
+		from, to, why := bs.a, bs.b, "modified in A, deleted in B"
+		if fa == nil {
+			from, to, why = bs.b, bs.a, "modified in B, deleted in A"
+		}
+		bs.opt.emit(Event{Type: EventConflict, Path: filepath.FromSlash(rel), Reason: why + "; kept the modification"})
+		return bs.copy(rel, from, to, "restored")
+	}
+
+	changes, err := sameFile(bs.a.path(rel), bs.b.path(rel), fa, fb, bs.opt)
+	if err != nil {
+		return err
+	}
+	if changes == 0 {
+		return bs.record(rel)
+	}
+	return bs.conflict(rel, fa, fb)
+}
+
+// propagate mirrors a one-sided change (copy or delete) to the other side.
+func (bs *bisync) propagate(rel string, from, to *bisyncSide, why string) error {
+	if from.files[rel] == nil {
+		if to.files[rel] == nil {
+			return nil
+		}
+		return bs.remove(rel, to, "deleted in "+from.name)
+	}
+	return bs.copy(rel, from, to, why)
+}
+
+func (bs *bisync) conflict(rel string, fa, fb fs.FileInfo) error {
+	res := ResolveBoth
+	switch bs.opt.Conflict {
+	case ConflictNewer:
+		switch {
+		case fa.ModTime().After(fb.ModTime()):
+			res = ResolveA
+		case fb.ModTime().After(fa.ModTime()):
+			res = ResolveB
+		}
+	case ConflictPrompt:
+		res = bs.opt.Resolve(Conflict{Path: rel, A: *stateOf(fa), B: *stateOf(fb)})
+	}
+
+	ev := Event{Type: EventConflict, Path: filepath.FromSlash(rel)}
+	switch res {
+	case ResolveA:
+		ev.Reason = "changed on both sides; kept A"
+		bs.opt.emit(ev)
+		return bs.copy(rel, bs.a, bs.b, "conflict")
+	case ResolveB:
+		ev.Reason = "changed on both sides; kept B"
+		bs.opt.emit(ev)
+		return bs.copy(rel, bs.b, bs.a, "conflict")
+	case ResolveBoth:
+		alt := conflictName(rel, "B", fb.ModTime())
+		ev.Reason = "changed on both sides; kept both, B's as " + alt
+		bs.opt.emit(ev)
+		if err := bs.rename(rel, alt, bs.b); err != nil {
+			return err
+		}
+		bs.b.files[alt] = fb
+		if err := bs.copy(alt, bs.b, bs.a, "conflict copy"); err != nil {
+			return err
+		}
+		return bs.copy(rel, bs.a, bs.b, "conflict")
+	}
+	ev.Reason = "changed on both sides; skipped"
+	bs.opt.emit(ev)
+	return nil // no state: asked again next run
+}
+
+// conflictName turns "dir/report.txt" into
+// "dir/report.conflict-B-20060102-150405.txt".
+func conflictName(rel, side string, mt time.Time) string {
+	ext := path.Ext(rel)
+	return strings.TrimSuffix(rel, ext) + ".conflict-" + side + "-" + mt.Format("20060102-150405") + ext
+}
+
+func (bs *bisync) copy(rel string, from, to *bisyncSide, why string) error {
+	fi := from.files[rel]
+	src, dst := from.path(rel), to.path(rel)
+	o := bs.sideOpt(to)
+	if err := copyAndReport(src, dst, fi, why, 0, o); err != nil {
+		return err
+	}
+	to.files[rel] = fi
+	return bs.record(rel)
+}
+
+func (bs *bisync) remove(rel string, on *bisyncSide, why string) error {
+	p := on.path(rel)
+	if !bs.opt.DryRun {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	bs.sideOpt(on).emit(Event{Type: EventDelete, Dst: p, Reason: why})
+	delete(on.files, rel)
+	return nil
+}
+
+func (bs *bisync) rename(rel, alt string, on *bisyncSide) error {
+	if bs.opt.DryRun {
+		return nil
+	}
+	return os.Rename(on.path(rel), on.path(alt))
+}
+
+// record stores rel's current state on both sides for the next run.
+func (bs *bisync) record(rel string) error {
+	for d := path.Dir(rel); d != "."; d = path.Dir(d) {
+		bs.alive[d] = true
+	}
+	if bs.opt.DryRun {
+		return nil
+	}
+	ai, err := os.Stat(bs.a.path(rel))
+	if err != nil {
+		return err
+	}
+	bi, err := os.Stat(bs.b.path(rel))
+	if err != nil {
+		return err
+	}
+	bs.next[rel] = bisyncEntry{A: *stateOf(ai), B: *stateOf(bi)}
+	return nil
+}
+
+// removeDirs deletes, deepest first, directories that were synced last time,
+// are gone from one side and no longer hold any file on the other. It
+// returns the directories to record for the next run.
+func (bs *bisync) removeDirs() []string {
+	all := union(bs.a.dirs, bs.b.dirs)
+	rels := sortedKeys(all)
+	gone := map[string]bool{}
+	for i := len(rels) - 1; i >= 0; i-- {
+		rel := rels[i]
+		inA, inB := bs.a.dirs[rel], bs.b.dirs[rel]
+		if inA == inB || !bs.oldDirs[rel] || bs.alive[rel] || hasLiveChild(rel, all, gone) {
+			continue
+		}
+		on := bs.a
+		if inB {
+			on = bs.b
+		}
+		p := on.path(rel)
+		if !bs.opt.DryRun {
+			if err := os.Remove(p); err != nil {
+				continue // not empty (e.g. excluded entries): leave it
+			}
+		}
+		bs.sideOpt(on).emit(Event{Type: EventDelete, Dst: p, Dir: true, Reason: "deleted in " + other(on.name)})
+		gone[rel] = true
+	}
+	var keep []string
+	for _, rel := range rels {
+		if !gone[rel] {
+			keep = append(keep, rel)
+		}
+	}
+	return keep
+}
+
+func hasLiveChild(rel string, dirs, gone map[string]bool) bool {
+	for d := range dirs {
+		if strings.HasPrefix(d, rel+"/") && !gone[d] {
+			return true
+		}
+	}
+	return false
+}
+
+func other(name string) string {
+	if name == "A" {
+		return "B"
+	}
+	return "A"
+}
+
+// sideOpt reports paths relative to the side being written.
+func (bs *bisync) sideOpt(to *bisyncSide) options {
+	o := bs.opt
+	o.dstRoot = to.root
+	return o
+}
+
+func keys(m map[string]fs.FileInfo) map[string]bool {
+	out := make(map[string]bool, len(m))
+	for k := range m {
+		out[k] = true
+	}
+	return out
+}
+
+func union(a, b map[string]bool) map[string]bool {
+	out := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		out[k] = true
+	}
+	for k := range b {
+		out[k] = true
+	}
+	return out
+}
+
+func sortedKeys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* =========================
+        RATE LIMITING
+========================= */
+
+// Options.BwLimit caps the bytes per second a run reads and writes for
+// file data: copies, delta blocks and --checksum hashing. The limit is
+// shared by all parallel workers and may change with the time of day; it is
+// looked up again for every chunk, so a long copy picks up the new rate when
+// a slot begins.
+
+// BwLimit is a byte-rate schedule. Each slot applies from its Start until
+// the next slot starts; before the first slot of the day the last one still
+// applies. A Rate of 0 means unlimited. A nil BwLimit is unlimited.
+type BwLimit []BwSlot
+
+// BwSlot is one entry of a BwLimit.
+type BwSlot struct {
+	Start time.Duration // time of day, since midnight local time
+	Rate  int64         // bytes per second; 0 means unlimited
+}
+
+// ParseBwLimit parses "10M" (all day) or a space separated timetable of
+// "HH:MM,RATE" entries such as "08:00,2M 18:00,off". Rates take the
+// suffixes of ParseSize and mean bytes per second; "off" or "0" lifts the
+// limit.
+func ParseBwLimit(s string) (BwLimit, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) == 1 && !strings.Contains(fields[0], ",") {
+		rate, err := parseRate(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if rate == 0 {
+			return nil, nil
+		}
+		return BwLimit{{Rate: rate}}, nil
+	}
+	var b BwLimit
+	for _, f := range fields {
+		at, r, ok := strings.Cut(f, ",")
+		if !ok {
+			return nil, wrapf(ErrInvalidOption, "bandwidth slot %q is not HH:MM,RATE", f)
+		}
+		start, err := parseClock(at)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := parseRate(r)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, BwSlot{Start: start, Rate: rate})
+	}
+	sort.SliceStable(b, func(i, j int) bool { return b[i].Start < b[j].Start })
+	for i := 1; i < len(b); i++ {
+		if b[i].Start == b[i-1].Start {
+			return nil, wrapf(ErrInvalidOption, "bandwidth timetable lists %02d:%02d twice", b[i].Start/time.Hour, b[i].Start%time.Hour/time.Minute)
+		}
+	}
+	return b, nil
+}
+
+// At returns the rate in effect at t, 0 meaning unlimited.
+func (b BwLimit) At(t time.Time) int64 {
+	if len(b) == 0 {
+		return 0
+	}
+	h, m, s := t.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	rate := b[len(b)-1].Rate // still yesterday's last slot
+	for _, slot := range b {
+		if slot.Start > tod {
+			break
+		}
+		rate = slot.Rate
+	}
+	return rate
+}
+
+func parseRate(s string) (int64, error) {
+	if strings.EqualFold(s, "off") {
+		return 0, nil
+	}
+	n, err := ParseSize(s)
+	if err != nil {
+		return 0, wrapf(ErrInvalidOption, "invalid rate %q", s)
+	}
+	return n, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, herr := strconv.Atoi(hh)
+	m, merr := strconv.Atoi(mm)
+	if !ok || herr != nil || merr != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, wrapf(ErrInvalidOption, "invalid time of day %q (want HH:MM)", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// limiter paces one run's data. Every chunk reserves its share of time on
+// a virtual clock and sleeps until that time has come, so concurrent
+// workers split the rate between them.
+type limiter struct {
+	sched BwLimit
+	mu    sync.Mutex
+	next  time.Time // when everything reserved so far has been sent
+}
+
+// newLimiter returns nil (no limit) for an empty schedule.
+func newLimiter(b BwLimit) *limiter {
+	if len(b) == 0 {
+		return nil
+	}
+	return &limiter{sched: b}
+}
+
+func (l *limiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+	now := time.Now()
+	rate := l.sched.At(now)
+	if rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.next.Before(now) {
+		l.next = now // idle time is not saved up for a burst
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// writer returns w paced by l, or w itself when l is nil.
+func (l *limiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return limitedWriter{w: w, l: l}
+}
+
+// reader returns r paced by l, or r itself when l is nil.
+func (l *limiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return limitedReader{r: r, l: l}
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *limiter
+}
+
+func (lw limitedWriter) Write(b []byte) (int, error) {
+	lw.l.wait(int64(len(b)))
+	return lw.w.Write(b)
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *limiter
+}
+
+func (lr limitedReader) Read(b []byte) (int, error) {
+	n, err := lr.r.Read(b)
+	lr.l.wait(int64(n))
+	return n, err
+}
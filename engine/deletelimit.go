@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+/* =========================
+       DELETION LIMITS
+========================= */
+
+// The mirror pass collects everything it is about to delete before it
+// removes anything. With Options.MaxDelete or MaxDeletePercent set and the
+// pending deletions over either limit, it stops with a *DeleteLimitError
+// and DST is left untouched by the mirror pass. Options.ForceDelete lifts
+// both limits for one run. Entries are counted recursively: a directory
+// with 99 files in it is 100 entries. The limits also hold under DryRun, so
+// a dry run shows the refusal a real run would hit. Watch checks each batch
+// against both limits (see checkBatchDeletes).
+
+// ErrDeleteLimit is wrapped by *DeleteLimitError.
+var ErrDeleteLimit = errors.New("mirror deletion limit exceeded")
+
+// DeleteLimitError reports a mirror pass that would have deleted too much.
+type DeleteLimitError struct {
+	Entries    int      // entries that would be deleted, directories' contents included
+	Bytes      int64    // their total size
+	Total      int      // entries the mirror pass saw in DST, deleted ones included
+	MaxDelete  int      // Options.MaxDelete in force (0: not set)
+	MaxPercent float64  // Options.MaxDeletePercent in force (0: not set)
+	Sample     []string // the first top-level deletions, relative to DST
+	More       int      // top-level deletions left out of Sample
+}
+
+// Percent is Entries as a share of Total.
+func (e *DeleteLimitError) Percent() float64 {
+	if e.Total == 0 {
+		return 0
+	}
+	return float64(e.Entries) * 100 / float64(e.Total)
+}
+
+func (e *DeleteLimitError) Error() string {
+	var limits []string
+	if e.MaxDelete > 0 {
+		limits = append(limits, fmt.Sprintf("max %d", e.MaxDelete))
+	}
+	if e.MaxPercent > 0 {
+		limits = append(limits, fmt.Sprintf("max %g%%", e.MaxPercent))
+	}
+	return fmt.Sprintf("%v: would delete %d of %d entries (%.1f%%, %d bytes; %s); nothing was deleted",
+		ErrDeleteLimit, e.Entries, e.Total, e.Percent(), e.Bytes, strings.Join(limits, ", "))
+}
+
+func (e *DeleteLimitError) Unwrap() error { return ErrDeleteLimit }
+
+const deleteSampleSize = 10
+
+type pendingDelete struct {
+	path string
+	dir  bool
+}
+
+type deleteCount struct {
+	entries int   // pending deletions
+	bytes   int64 // their size
+	total   int   // everything the mirror pass saw
+}
+
+// treeSize counts path (and, for a directory, everything below it).
+func treeSize(path string, d fs.DirEntry) (int, int64, error) {
+	if !d.IsDir() {
+		info, err := d.Info()
+		if err != nil {
+			return 0, 0, err
+		}
+		return 1, info.Size(), nil
+	}
+	n, size := 0, int64(0)
+	err := filepath.WalkDir(path, func(_ string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		n++
+		if !e.IsDir() {
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return n, size, err
+}
+
+// checkDeleteLimit returns a *DeleteLimitError when dels exceed a limit.
+func checkDeleteLimit(dels []pendingDelete, c deleteCount, opt options) error {
+	if opt.ForceDelete || c.entries == 0 || (opt.MaxDelete <= 0 && opt.MaxDeletePercent <= 0) {
+		return nil
+	}
+	e := &DeleteLimitError{Entries: c.entries, Bytes: c.bytes, Total: c.total, MaxDelete: opt.MaxDelete, MaxPercent: opt.MaxDeletePercent}
+	over := (opt.MaxDelete > 0 && c.entries > opt.MaxDelete) ||
+		(opt.MaxDeletePercent > 0 && e.Percent() > opt.MaxDeletePercent)
+	if !over {
+		return nil
+	}
+	for i, del := range dels {
+		if i == deleteSampleSize {
+			e.More = len(dels) - i
+			break
+		}
+		e.Sample = append(e.Sample, opt.relPath(del.path))
+	}
+	return e
+}
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* =========================
+        DELTA UPDATE
+========================= */
+
+// With Options.Delta, a changed file that already exists in DST is updated
+// in place: both files are read in fixed-size blocks and only the blocks
+// that differ are rewritten. The result is verified against a hash of the
+// source taken during the same pass; on mismatch the file is recopied in
+// full, as it is when the DST file cannot be opened for writing (a
+// read-only file, say). In-place updates are not atomic, unlike regular
+// copies.
+
+const defaultDeltaBlock = 1 << 20
+
+// errDeltaVerify means the in-place result did not match the source.
+var errDeltaVerify = errors.New("delta verification failed")
+
+// errDeltaOpen means the DST file could not be opened for an in-place update.
+var errDeltaOpen = errors.New("delta update not possible")
+
+// deltaCopy rewrites the differing blocks of dstPath and returns how many
+// bytes it wrote.
+func deltaCopy(srcPath, dstPath string, si fs.FileInfo, opt options) (int64, error) {
+	bs := opt.DeltaBlock
+	if bs <= 0 {
+		bs = defaultDeltaBlock
+	}
+
+	sf, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dstPath, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", errDeltaOpen, err)
+	}
+	defer df.Close()
+
+	sbuf := make([]byte, bs)
+	dbuf := make([]byte, bs)
+	hasher := opt.hasher()
+	h := hasher.New()
+	var off, written int64
+	for {
+		n, rerr := io.ReadFull(sf, sbuf)
+		opt.limit.wait(int64(n))
+		if n > 0 {
+			h.Write(sbuf[:n])
+			m, _ := df.ReadAt(dbuf[:n], off)
+			opt.stats.addRead(int64(n + m))
+			opt.stats.addHashed(int64(n))
+			if m != n || !bytes.Equal(sbuf[:n], dbuf[:n]) {
+				if _, err := df.WriteAt(sbuf[:n], off); err != nil {
+					return written, err
+				}
+				written += int64(n)
+				opt.stats.addWritten(int64(n))
+			}
+			off += int64(n)
+			opt.meter.add(int64(n))
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+	if err := df.Truncate(off); err != nil {
+		return written, err
+	}
+	if err := df.Sync(); err != nil {
+		return written, err
+	}
+
+	// whole-file verification
+	if _, err := df.Seek(0, io.SeekStart); err != nil {
+		return written, err
+	}
+	dh := hasher.New()
+	vn, err := io.Copy(dh, df)
+	opt.stats.addHashed(vn)
+	if err != nil {
+		return written, err
+	}
+	if !bytes.Equal(h.Sum(nil), dh.Sum(nil)) {
+		return written, fmt.Errorf("%w: %s", errDeltaVerify, dstPath)
+	}
+	if err := df.Close(); err != nil {
+		return written, err
+	}
+
+	if err := preserveOnTemp(srcPath, dstPath, dstPath, si, opt); err != nil {
+		return written, err
+	}
+	mode := si.Mode().Perm()
+	if opt.Preserve&PreserveMode != 0 {
+		mode = si.Mode() & modeMask
+	}
+	if err := os.Chmod(dstPath, mode); err != nil {
+		return written, err
+	}
+	mt := si.ModTime()
+	return written, os.Chtimes(dstPath, mt, mt)
+}
+
+// ParseSize parses a byte count with an optional binary suffix:
+// "4096", "64K", "10M", "2G" (K = 1024). Fractions of a byte are dropped,
+// but a positive size must come to at least one byte.
+func ParseSize(s string) (int64, error) {
+	t := strings.TrimSpace(strings.ToUpper(s))
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "B"), "I")
+	mult := int64(1)
+	if t != "" {
+		switch t[len(t)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	v := n * float64(mult)
+	// NaN fails every comparison, so it is caught by !(n >= 0)
+	if err != nil || !(n >= 0) || v >= 1<<63 || (n > 0 && v < 1) {
+		return 0, wrapf(ErrInvalidOption, "invalid size %q", s)
+	}
+	return int64(v), nil
+}
@@ -0,0 +1,296 @@
+// Package engine is the copy/sync engine behind the syncdir CLI.
+//
+// A Syncer copies a file or directory tree from SRC to DST, skipping files
+// that are already up to date, and optionally mirrors deletions. Progress is
+// reported to a Reporter as Events; failures are returned as errors.
+//
+//	s := engine.New(engine.Options{Recursive: true, Mirror: true})
+//	res, err := s.Sync(`E:\src`, `E:\dst`)
+package engine
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Options configures a Syncer. The zero value copies a single file.
+type Options struct {
+	Recursive bool     // required when SRC is a directory
+	Mirror    bool     // delete DST entries that are not in SRC
+	DryRun    bool     // report actions without changing anything
+	Rules     []Rule   // ordered include/exclude rules, first match wins (see Filter)
+	Excludes  []string // .gitignore-style patterns, applied as one exclude Rule after Rules
+	Checksum  bool     // compare hashes (ChecksumAlgo) when deciding whether to copy
+	Parallel  int      // concurrent file copies; < 1 means 1
+
+	Links           LinkMode // symlinks inside SRC; "" means LinksCopy
+	RewriteAbsLinks bool     // LinksPreserve: retarget absolute links into SRC to DST
+
+	Preserve Preserve // metadata to carry over, also for unchanged entries
+
+	Delta      bool  // update changed files in place, rewriting only differing blocks
+	DeltaBlock int64 // block size for Delta; 0 means 1 MiB
+
+	Partial    bool   // keep interrupted large copies and resume them next run
+	PartialDir string // with Partial: directory name (inside each DST dir) for partial files
+
+	Debounce time.Duration // Watch: quiet time before a batch is synced; 0 means 500ms
+	Rescan   time.Duration // Watch: interval of full rescans; 0 disables them
+
+	Conflict ConflictPolicy            // Bisync: how to settle conflicts; "" means ConflictKeepBoth
+	Resolve  func(Conflict) Resolution // Bisync with ConflictPrompt: asked for each conflict
+
+	Backup       bool   // keep the previous version of overwritten and mirror-deleted entries
+	BackupDir    string // with Backup: keep them under BackupDir/<run time>/ (relative to DST) instead of next to the file
+	BackupSuffix string // with Backup: appended to backup names; "" means "~" without BackupDir
+
+	Trash    bool   // mirror deletions move entries to a per-run trash with a manifest (see Restore)
+	TrashDir string // with Trash: trash location, relative to DST; "" means ".syncdir-trash"
+
+	MaxDelete        int     // Mirror: refuse to delete more than this many entries; 0 means no limit
+	MaxDeletePercent float64 // Mirror: refuse to delete more than this share (0-100) of DST's entries; 0 means no limit
+	ForceDelete      bool    // Mirror: ignore MaxDelete and MaxDeletePercent
+
+	BwLimit BwLimit // bytes per second for file data, shared by all workers; nil is unlimited
+
+	Progress         func(Progress) // called with running totals during Sync; nil disables the count
+	ProgressInterval time.Duration  // how often Progress is called; 0 means 250ms
+
+	ChecksumCache string // with Checksum: directory of per-tree hash caches (see DefaultChecksumCache); "" hashes every time
+	ChecksumAlgo  string // algorithm for Checksum, the cache and Delta verification (see LookupHasher); "" means "sha1"
+
+	Repair bool // Verify: copy missing and differing entries again
+
+	KeepGoing bool // Sync: report failing entries and carry on; the error is then a *PartialError
+
+	Reporter Reporter // receives every action; nil discards them
+}
+
+// Validation errors returned by Sync before anything is touched.
+var (
+	ErrSrcNotExist   = errors.New("SRC does not exist")
+	ErrNotRecursive  = errors.New("SRC is a directory and Recursive is not set")
+	ErrSamePath      = errors.New("SRC and DST are the same path")
+	ErrDstInsideSrc  = errors.New("DST is inside SRC")
+	ErrSrcInsideDst  = errors.New("SRC is inside DST")
+	ErrInvalidOption = errors.New("invalid option")
+)
+
+// Result summarizes a finished (or failed) Sync.
+type Result struct {
+	Counts  map[string]int // events by type, e.g. Counts[EventCopy]
+	Bytes   int64          // bytes copied (or that would be, under DryRun)
+	Elapsed time.Duration
+	DryRun  bool
+	Stats   Stats // totals for --stats, see Stats
+}
+
+// Syncer runs syncs with a fixed set of Options. It is safe to reuse, but
+// not to call Sync concurrently for overlapping trees.
+type Syncer struct {
+	opt Options
+}
+
+// New returns a Syncer for opt.
+func New(opt Options) *Syncer {
+	return &Syncer{opt: opt}
+}
+
+// Sync copies src to dst. Paths are validated first (existence, Recursive,
+// same path, nesting); those errors wrap the Err* values above. Otherwise
+// the returned Result covers whatever was done before any error.
+func (s *Syncer) Sync(src, dst string) (Result, error) {
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	srcInfo, err := s.validate(src, dst)
+	if err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+
+	t := newTally(s.reporter())
+	opt := options{Options: s.opt, rep: t, stats: &t.data, limit: newLimiter(s.opt.BwLimit)}
+	if opt.KeepGoing {
+		opt.failed = &failureLog{}
+	}
+	srcTree, dstTree := src, dst
+	if !srcInfo.IsDir() {
+		srcTree, dstTree = filepath.Dir(src), filepath.Dir(dst)
+	}
+	if opt, err = opt.withHashCaches(srcTree, dstTree); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+	stopProgress := func() {}
+	if opt.Progress != nil {
+		opt.prog, stopProgress = startProgress(src, dst, srcInfo, opt)
+	}
+	if srcInfo.IsDir() {
+		err = syncDir(src, dst, opt)
+	} else {
+		opt.dstRoot = filepath.Dir(dst)
+		opt = opt.withBackupRoot(t.start)
+		cleanupStaleTemps(dst, opt)
+		opt.stats.scan()
+		fopt, done := opt.track(dst, srcInfo.Size())
+		reason, changes := "new", Change(0)
+		if dstInfo, derr := os.Lstat(dst); derr == nil && dstInfo.Mode().IsRegular() {
+			// always copied, as by cp; "changed" gets it backed up first
+			copt := fopt
+			copt.Checksum = false
+			reason = "changed"
+			changes, _ = sameFile(src, dst, srcInfo, dstInfo, copt)
+		}
+		err = copyAndReport(src, dst, srcInfo, reason, changes, fopt)
+		done()
+	}
+	stopProgress()
+	if serr := opt.saveHashCaches(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		opt.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	} else {
+		err = opt.failed.err() // each failure was reported as it happened
+	}
+	sum := t.summary(opt.DryRun)
+	t.next.Report(sum)
+	return Result{
+		Counts:  sum.Counts,
+		Bytes:   sum.Size,
+		Elapsed: time.Since(t.start),
+		DryRun:  opt.DryRun,
+		Stats:   *sum.Stats,
+	}, err
+}
+
+func (s *Syncer) validate(src, dst string) (fs.FileInfo, error) {
+	if s.opt.Parallel < 0 {
+		return nil, wrapf(ErrInvalidOption, "Parallel must not be negative (got %d)", s.opt.Parallel)
+	}
+	if !s.opt.Links.valid() {
+		return nil, wrapf(ErrInvalidOption, "unknown link mode %q", s.opt.Links)
+	}
+	if s.opt.DeltaBlock < 0 {
+		return nil, wrapf(ErrInvalidOption, "DeltaBlock must not be negative (got %d)", s.opt.DeltaBlock)
+	}
+	if _, err := LookupHasher(s.opt.ChecksumAlgo); err != nil {
+		return nil, err
+	}
+	if s.opt.MaxDelete < 0 {
+		return nil, wrapf(ErrInvalidOption, "MaxDelete must not be negative (got %d)", s.opt.MaxDelete)
+	}
+	if s.opt.MaxDeletePercent < 0 || s.opt.MaxDeletePercent > 100 {
+		return nil, wrapf(ErrInvalidOption, "MaxDeletePercent must be between 0 and 100 (got %g)", s.opt.MaxDeletePercent)
+	}
+	if strings.ContainsAny(s.opt.BackupSuffix, `/\`) {
+		return nil, wrapf(ErrInvalidOption, "BackupSuffix must not contain a path separator (got %q)", s.opt.BackupSuffix)
+	}
+	if !validPartialDir(s.opt.PartialDir) {
+		return nil, wrapf(ErrInvalidOption, "PartialDir must be a plain directory name (got %q)", s.opt.PartialDir)
+	}
+	if _, err := compileFilter(s.opt); err != nil {
+		return nil, err
+	}
+	if err := s.opt.Preserve.validate(); err != nil {
+		return nil, err
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, wrapf(ErrSrcNotExist, "%s", src)
+		}
+		return nil, err
+	}
+	if srcInfo.IsDir() && !s.opt.Recursive {
+		return nil, ErrNotRecursive
+	}
+
+	absSrc, _ := filepath.Abs(src)
+	absDst, _ := filepath.Abs(dst)
+	if samePath(absSrc, absDst) {
+		return nil, wrapf(ErrSamePath, "%s", absSrc)
+	}
+	if isSubpath(absDst, absSrc) {
+		return nil, wrapf(ErrDstInsideSrc, "DST=%s inside SRC=%s", absDst, absSrc)
+	}
+	if isSubpath(absSrc, absDst) {
+		return nil, wrapf(ErrSrcInsideDst, "SRC=%s inside DST=%s", absSrc, absDst)
+	}
+	return srcInfo, nil
+}
+
+func (s *Syncer) reporter() Reporter {
+	if s.opt.Reporter != nil {
+		return s.opt.Reporter
+	}
+	return discard{}
+}
+
+// options is Options plus per-run state threaded through the engine.
+type options struct {
+	Options
+	rep     Reporter    // per-entry buffer or the run's tally
+	filter  *Filter     // compiled Rules and Excludes
+	srcRoot string      // SRC root, for rewriting absolute link targets
+	dstRoot string      // DST root, for relative paths in events
+	prog    *progress   // run counters when Options.Progress is set
+	meter   *meter      // the current file's share of prog
+	limit   *limiter    // Options.BwLimit for this run
+	stats   *runStats   // byte and scan counters of the run's tally
+	failed  *failureLog // Options.KeepGoing: failures so far
+
+	srcSums *hashCache // Options.ChecksumCache of SRC (or bisync's A)
+	dstSums *hashCache // ... and of DST (or B)
+
+	backupRoot string    // BackupDir/<run time> of this run
+	trash      *trashRun // Options.Trash: where this run's mirror deletions go
+}
+
+// emit stamps an event with the time, dry-run flag and relative path, then
+// hands it to the reporter.
+func (o options) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.DryRun = o.DryRun
+	if ev.Path == "" && ev.Dst != "" {
+		ev.Path = o.relPath(ev.Dst)
+	}
+	o.reporter().Report(ev)
+}
+
+func (o options) reporter() Reporter {
+	if o.rep != nil {
+		return o.rep
+	}
+	if o.Reporter != nil {
+		return o.Reporter
+	}
+	return discard{}
+}
+
+func (o options) relPath(dstPath string) string {
+	if o.dstRoot == "" {
+		return dstPath
+	}
+	rel, err := filepath.Rel(o.dstRoot, dstPath)
+	if err != nil {
+		return dstPath
+	}
+	return rel
+}
+
+// errPath extracts the file name from an *fs.PathError / *os.LinkError.
+func errPath(err error) string {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Path
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return le.New
+	}
+	return ""
+}
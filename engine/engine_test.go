@@ -0,0 +1,2085 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ---------- helpers ----------
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return b
+}
+
+// ---------- unit: path relations ----------
+
+func TestIsSubpathAndSamePath(t *testing.T) {
+	root := t.TempDir()
+	child := filepath.Join(root, "child")
+	sibling := filepath.Join(root, "sibling")
+
+	if err := os.MkdirAll(child, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(sibling, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	absRoot, _ := filepath.Abs(root)
+	absChild, _ := filepath.Abs(child)
+	absSibling, _ := filepath.Abs(sibling)
+
+	if !isSubpath(absChild, absRoot) {
+		t.Fatalf("expected %q to be subpath of %q", absChild, absRoot)
+	}
+	if isSubpath(absSibling, absChild) {
+		t.Fatalf("did not expect %q to be subpath of %q", absSibling, absChild)
+	}
+	if samePath(absRoot, strings.Clone(absRoot)) != true {
+		t.Fatalf("samePath should be true for identical paths")
+	}
+
+	// Case-insensitive check (Windows前提だが、関数は小文字化して比較している)
+	if runtime.GOOS == "windows" {
+		upper := strings.ToUpper(absRoot)
+		if !samePath(absRoot, upper) {
+			t.Fatalf("samePath should treat case-insensitively on Windows")
+		}
+	}
+}
+
+func TestShouldExclude(t *testing.T) {
+	patterns := []string{".git", "*.tmp", "node_modules"}
+
+	yes := []string{
+		filepath.Join("foo", ".git"),
+		filepath.Join("foo", "node_modules", "pkg", "index.js"),
+		filepath.Join("foo", "bar.tmp"),
+	}
+	no := []string{
+		filepath.Join("foo", ".gitignore"),
+		filepath.Join("foo", "bar.txt"),
+	}
+
+	for _, rel := range yes {
+		if !shouldExclude(rel, nil, patterns) {
+			t.Fatalf("shouldExclude(%q) = false, want true", rel)
+		}
+	}
+	for _, rel := range no {
+		if shouldExclude(rel, nil, patterns) {
+			t.Fatalf("shouldExclude(%q) = true, want false", rel)
+		}
+	}
+}
+
+// ---------- unit: primitives ----------
+
+func TestAbsDuration(t *testing.T) {
+	if absDuration(-5*time.Second) != 5*time.Second {
+		t.Fatal("absDuration failed for negative duration")
+	}
+	if absDuration(3*time.Second) != 3*time.Second {
+		t.Fatal("absDuration failed for positive duration")
+	}
+}
+
+func TestSha1sum(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "x.txt")
+	data := []byte("hello syncdir")
+	writeFile(t, f, data)
+
+	sha1h, err := LookupHasher("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fileSum(f, sha1h, options{})
+	if err != nil {
+		t.Fatalf("fileSum: %v", err)
+	}
+	want := sha1.Sum(data)
+	if !bytes.Equal(got, want[:]) {
+		t.Fatalf("sha1 mismatch: got %x want %x", got, want)
+	}
+}
+
+// ---------- unit/integration: file equality & copy ----------
+
+func TestSameFileAndCopyOneFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	dst := filepath.Join(dir, "dst.txt")
+
+	writeFile(t, src, []byte("abc"))
+	// 初回コピー
+	if err := copyOneFile(src, dst, options{}); err != nil {
+		t.Fatalf("copyOneFile: %v", err)
+	}
+	// 同一判定（サイズ＆mtime）
+	si, _ := os.Stat(src)
+	di, _ := os.Stat(dst)
+	changes, err := sameFile(src, dst, si, di, options{})
+	if err != nil {
+		t.Fatalf("sameFile: %v", err)
+	}
+	if changes != 0 {
+		t.Fatalf("sameFile should report no changes right after copy, got %v", changes)
+	}
+
+	// 中身を更新 → same=false
+	time.Sleep(2 * time.Second) // CIでの時間解像度/負荷に余裕を持たせる
+	writeFile(t, src, []byte("abcd"))
+	si, _ = os.Stat(src)
+	di, _ = os.Stat(dst)
+	changes, _ = sameFile(src, dst, si, di, options{})
+	if changes != ChangeSize|ChangeTime {
+		t.Fatalf("sameFile after content change = %v, want size,time", changes)
+	}
+
+	// checksum オプションでも検証
+	changes, _ = sameFile(src, dst, si, di, options{Options: Options{Checksum: true}})
+	if changes != ChangeChecksum|ChangeSize|ChangeTime {
+		t.Fatalf("sameFile(checksum) after content change = %v", changes)
+	}
+}
+
+// ---------- integration: syncDir copy & mirror ----------
+
+func TestSyncDir_CopyAndMirror(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	// SRCにファイル群を作成
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(src, "dir1", "b.txt"), []byte("world"))
+	writeFile(t, filepath.Join(src, "node_modules", "skip.txt"), []byte("skip me"))
+
+	// 1回目：差分コピー + 除外
+	opt := options{Options: Options{Recursive: true, Mirror: false, DryRun: false, Excludes: []string{"node_modules"}}}
+	if err := syncDir(src, dst, opt); err != nil {
+		t.Fatalf("syncDir(copy): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil {
+		t.Fatalf("a.txt not copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "dir1", "b.txt")); err != nil {
+		t.Fatalf("dir1/b.txt not copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "node_modules", "skip.txt")); !os.IsNotExist(err) {
+		t.Fatalf("excluded file should not exist in dst")
+	}
+
+	// DSTだけに余分を作っておく
+	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("remove me"))
+
+	// 2回目：ミラーで余分削除（除外は尊重）
+	opt = options{Options: Options{Recursive: true, Mirror: true, DryRun: false, Excludes: []string{"node_modules"}}}
+	if err := syncDir(src, dst, opt); err != nil {
+		t.Fatalf("syncDir(mirror): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "extra.txt")); !os.IsNotExist(err) {
+		t.Fatalf("extra.txt should be removed in mirror mode")
+	}
+}
+
+// ---------- unit: ensureDir dry-run ----------
+
+func TestEnsureDir_DryRun(t *testing.T) {
+	parent := t.TempDir()
+	target := filepath.Join(parent, "newdir")
+
+	// dry-runなら作られない
+	if err := ensureDir(target, options{Options: Options{DryRun: true}}); err != nil {
+		t.Fatalf("ensureDir(dry-run) error: %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("directory should not be created in dry-run")
+	}
+}
+
+func TestSameFile_ChecksumEqual(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	os.WriteFile(a, []byte("same"), 0o644)
+	os.WriteFile(b, []byte("same"), 0o644)
+
+	si, _ := os.Stat(a)
+	bi, _ := os.Stat(b)
+	// 時刻がズレていても checksum なら true を期待
+	changes, err := sameFile(a, b, si, bi, options{Options: Options{Checksum: true}})
+	if err != nil || changes != 0 {
+		t.Fatalf("checksum equal should be true, err=%v", err)
+	}
+}
+func TestMirror_RemoveDir_And_SkipExcludedVerbose(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	// SRC: a/keep.txt のみ
+	writeFile(t, filepath.Join(src, "a", "keep.txt"), []byte("k"))
+
+	// DST: 余分な dir を用意（mirror で消えることを期待）
+	writeFile(t, filepath.Join(dst, "b", "extra.txt"), []byte("x"))
+
+	// DST: 除外対象も用意（node_modules）→ mirror時に "mirror-skip (excluded)" の行が実行される
+	writeFile(t, filepath.Join(dst, "node_modules", "stay.txt"), []byte("s"))
+
+	opt := options{Options: Options{
+		Recursive: true,
+		Mirror:    true,
+		DryRun:    false,
+		Reporter:  NewTextReporter(io.Discard, true), // ← verbose 行を実行させる
+		Excludes:  []string{"node_modules"},          // ← mirror-skip (excluded) を踏む
+	}}
+	if err := syncDir(src, dst, opt); err != nil {
+		t.Fatalf("syncDir mirror: %v", err)
+	}
+
+	// b/ は削除される
+	if _, err := os.Stat(filepath.Join(dst, "b")); !os.IsNotExist(err) {
+		t.Fatalf("mirror should remove extra dir 'b'")
+	}
+	// 除外は残る
+	if _, err := os.Stat(filepath.Join(dst, "node_modules", "stay.txt")); err != nil {
+		t.Fatalf("excluded path should remain: %v", err)
+	}
+}
+func TestRemovePath_FileAndDir_RealDelete(t *testing.T) {
+	base := t.TempDir()
+
+	// file
+	f := filepath.Join(base, "x.txt")
+	writeFile(t, f, []byte("x"))
+	if err := removePath(f, false, options{Options: Options{DryRun: false}}); err != nil {
+		t.Fatalf("remove file: %v", err)
+	}
+	if _, err := os.Stat(f); !os.IsNotExist(err) {
+		t.Fatalf("file should be removed")
+	}
+
+	// dir
+	d := filepath.Join(base, "d")
+	writeFile(t, filepath.Join(d, "y.txt"), []byte("y"))
+	if err := removePath(d, true, options{Options: Options{DryRun: false}}); err != nil {
+		t.Fatalf("remove dir: %v", err)
+	}
+	if _, err := os.Stat(d); !os.IsNotExist(err) {
+		t.Fatalf("dir should be removed")
+	}
+}
+func TestSyncDir_Parallel(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	var names []string
+	for i := 0; i < 40; i++ {
+		name := filepath.Join(fmt.Sprintf("d%d", i%4), fmt.Sprintf("f%02d.txt", i))
+		writeFile(t, filepath.Join(src, name), []byte(name))
+		names = append(names, name)
+	}
+
+	// dry-run の出力は worker 数に関係なく walk 順で並ぶこと
+	var seqOut, parOut bytes.Buffer
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true, DryRun: true, Reporter: NewTextReporter(&seqOut, false)}}); err != nil {
+		t.Fatalf("syncDir(dry-run, sequential): %v", err)
+	}
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true, DryRun: true, Parallel: 8, Reporter: NewTextReporter(&parOut, false)}}); err != nil {
+		t.Fatalf("syncDir(dry-run, parallel): %v", err)
+	}
+	if seqOut.String() != parOut.String() {
+		t.Fatalf("parallel output order differs:\nseq:\n%s\npar:\n%s", seqOut.String(), parOut.String())
+	}
+
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true, Parallel: 8}}); err != nil {
+		t.Fatalf("syncDir(parallel): %v", err)
+	}
+	for _, name := range names {
+		if got := string(readFile(t, filepath.Join(dst, name))); got != name {
+			t.Fatalf("%s: got %q", name, got)
+		}
+	}
+}
+
+func TestOrderedEvents_Window(t *testing.T) {
+	var got []string
+	out := newOrderedEvents(reporterFunc(func(ev Event) { got = append(got, ev.Path) }), 2)
+	a, b := out.reserve(), out.reserve()
+	out.done(b, []Event{{Path: "b"}}) // a がまだ遅い: b は保留
+
+	reserved := make(chan int)
+	go func() { reserved <- out.reserve() }()
+	select {
+	case s := <-reserved:
+		t.Fatalf("reserve returned %d with a window of 2 outstanding", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+	out.done(a, []Event{{Path: "a"}})
+	select {
+	case c := <-reserved:
+		out.done(c, []Event{{Path: "c"}})
+	case <-time.After(5 * time.Second):
+		t.Fatal("reserve still blocked after the window moved")
+	}
+	if strings.Join(got, ",") != "a,b,c" {
+		t.Fatalf("events = %v, want a,b,c", got)
+	}
+}
+
+func TestSyncDir_ParallelError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("chmod 000 does not block reads on Windows")
+	}
+	src := t.TempDir()
+	dst := t.TempDir()
+	for i := 0; i < 10; i++ {
+		writeFile(t, filepath.Join(src, fmt.Sprintf("f%d.txt", i)), []byte("x"))
+	}
+	bad := filepath.Join(src, "f5.txt")
+	if err := os.Chmod(bad, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(bad, 0o644)
+	if f, err := os.Open(bad); err == nil {
+		f.Close()
+		t.Skip("running with privileges that ignore file modes")
+	}
+
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true, Parallel: 4}}); err == nil {
+		t.Fatalf("expected error from unreadable file")
+	}
+}
+
+func TestCopyOneFile_AtomicReplace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	dst := filepath.Join(dir, "out", "dst.txt")
+	writeFile(t, src, []byte("new content"))
+	writeFile(t, dst, []byte("old"))
+
+	if err := copyOneFile(src, dst, options{}); err != nil {
+		t.Fatalf("copyOneFile: %v", err)
+	}
+	if got := string(readFile(t, dst)); got != "new content" {
+		t.Fatalf("dst = %q", got)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dst))
+	if len(entries) != 1 {
+		t.Fatalf("temp file left behind: %v", entries)
+	}
+}
+
+func TestSyncDir_CleansStaleTemps(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	stale := filepath.Join(dst, "sub", ".a.txt.12345"+tempSuffix)
+	writeFile(t, stale, []byte("half-writ"))
+
+	// dry-run では報告だけ
+	var out bytes.Buffer
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true, DryRun: true, Reporter: NewTextReporter(&out, false)}}); err != nil {
+		t.Fatalf("syncDir(dry-run): %v", err)
+	}
+	if !strings.Contains(out.String(), "stale temp") {
+		t.Fatalf("dry-run should report stale temp, got %q", out.String())
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatalf("dry-run removed stale temp: %v", err)
+	}
+
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true}}); err != nil {
+		t.Fatalf("syncDir: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temp should be removed")
+	}
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "out")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(src, "dir1", "b.txt"), []byte("world"))
+
+	res, err := New(Options{Recursive: true}).Sync(src, dst)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if res.Counts[EventCopy] != 2 || res.Bytes != 10 {
+		t.Fatalf("Result = %+v", res)
+	}
+	// 2回目は全部 skip
+	res, err = New(Options{Recursive: true}).Sync(src, dst)
+	if err != nil || res.Counts[EventCopy] != 0 || res.Counts[EventSkip] != 2 {
+		t.Fatalf("second Sync: res=%+v err=%v", res, err)
+	}
+
+	// 検証エラーは sentinel でラップされる
+	cases := []struct {
+		opt      Options
+		src, dst string
+		want     error
+	}{
+		{Options{Recursive: true}, filepath.Join(src, "nope"), dst, ErrSrcNotExist},
+		{Options{}, src, dst, ErrNotRecursive},
+		{Options{Recursive: true}, src, src, ErrSamePath},
+		{Options{Recursive: true}, src, filepath.Join(src, "inner"), ErrDstInsideSrc},
+		{Options{Recursive: true}, filepath.Join(src, "dir1"), src + string(os.PathSeparator) + "..", ErrSrcInsideDst},
+		{Options{Recursive: true, Parallel: -1}, src, dst, ErrInvalidOption},
+	}
+	for _, c := range cases {
+		if _, err := New(c.opt).Sync(c.src, c.dst); !errors.Is(err, c.want) {
+			t.Fatalf("Sync(%q, %q): err=%v, want %v", c.src, c.dst, err, c.want)
+		}
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "sub", "b.txt"), []byte("b"))
+	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("x"))
+
+	p, err := New(Options{Mirror: true}).Plan(src, dst)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	kinds := map[string]int{}
+	for _, op := range p.Ops {
+		kinds[op.Type]++
+	}
+	if kinds[EventMkdir] != 1 || kinds[EventCopy] != 2 || kinds[EventDelete] != 1 {
+		t.Fatalf("ops = %+v", p.Ops)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Plan must not change DST")
+	}
+
+	// JSON で往復しても同じ plan
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatalf("ReadPlan: %v", err)
+	}
+
+	// plan 後に SRC を変更 → その copy は refuse、他は実行
+	time.Sleep(10 * time.Millisecond)
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("changed"))
+
+	var log bytes.Buffer
+	res, err := New(Options{Reporter: NewTextReporter(&log, false)}).Apply(p2)
+	if !errors.Is(err, ErrPlanStale) {
+		t.Fatalf("Apply: err=%v, want ErrPlanStale", err)
+	}
+	if res.Counts[EventRefuse] != 1 || !strings.Contains(log.String(), "SRC changed since plan") {
+		t.Fatalf("refusals: res=%+v log=%q", res, log.String())
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("refused copy must not run")
+	}
+	if got := string(readFile(t, filepath.Join(dst, "sub", "b.txt"))); got != "b" {
+		t.Fatalf("sub/b.txt = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "extra.txt")); !os.IsNotExist(err) {
+		t.Fatalf("planned delete should run")
+	}
+}
+
+func TestPlanApply_DeleteChangedTree(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(dst, "old", "sub", "a.txt"), []byte("a"))
+
+	p, err := New(Options{Mirror: true}).Plan(src, dst)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if len(p.Ops) != 1 || p.Ops[0].Tree == "" {
+		t.Fatalf("ops = %+v", p.Ops)
+	}
+	// a file appears two levels down: old's own mtime does not change
+	writeFile(t, filepath.Join(dst, "old", "sub", "new-report.txt"), []byte("keep me"))
+	_, err = New(Options{}).Apply(p)
+	if !errors.Is(err, ErrPlanStale) {
+		t.Fatalf("Apply: err=%v, want ErrPlanStale", err)
+	}
+	if got := string(readFile(t, filepath.Join(dst, "old", "sub", "new-report.txt"))); got != "keep me" {
+		t.Fatalf("new-report.txt = %q", got)
+	}
+
+	if p, err = New(Options{Mirror: true}).Plan(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{}).Apply(p); err != nil {
+		t.Fatalf("Apply of a fresh plan: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "old")); !os.IsNotExist(err) {
+		t.Fatalf("old/ not deleted: %v", err)
+	}
+}
+
+func TestPlanApply_Trash(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("x"))
+
+	p, err := New(Options{Mirror: true, Trash: true}).Plan(src, dst)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := ReadPlan(&buf)
+	if err != nil || !p2.Options.Trash {
+		t.Fatalf("ReadPlan: %+v, %v", p2, err)
+	}
+	if _, err := New(Options{}).Apply(p2); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	runs, err := ListTrash(filepath.Join(dst, defaultTrashDir))
+	if err != nil || len(runs) != 1 || len(runs[0].Entries) != 1 || runs[0].Entries[0].Path != "extra.txt" {
+		t.Fatalf("trash = %+v, %v", runs, err)
+	}
+}
+
+func TestPlanApply_Backup(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("new"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("old, longer"))
+	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("x"))
+
+	p, err := New(Options{Mirror: true, Backup: true}).Plan(src, dst)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{}).Apply(p2); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := string(readFile(t, filepath.Join(dst, "a.txt~"))); got != "old, longer" {
+		t.Fatalf("a.txt~ = %q", got)
+	}
+	if got := string(readFile(t, filepath.Join(dst, "extra.txt~"))); got != "x" {
+		t.Fatalf("extra.txt~ = %q", got)
+	}
+}
+
+func TestSyncDir_LinkModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "real.txt"), []byte("data"))
+	writeFile(t, filepath.Join(src, "dir", "inner.txt"), []byte("inner"))
+	mustSymlink(t, "real.txt", filepath.Join(src, "file-link"))
+	mustSymlink(t, "dir", filepath.Join(src, "dir-link"))
+	mustSymlink(t, "nowhere", filepath.Join(src, "dangling"))
+	mustSymlink(t, "..", filepath.Join(src, "dir", "loop"))
+	mustSymlink(t, filepath.Join(src, "real.txt"), filepath.Join(src, "abs-link"))
+
+	run := func(mode LinkMode, rewrite bool) string {
+		t.Helper()
+		dst := filepath.Join(t.TempDir(), "out")
+		opt := options{Options: Options{Recursive: true, Links: mode, RewriteAbsLinks: rewrite}}
+		if err := syncDir(src, dst, opt); err != nil {
+			t.Fatalf("syncDir(%s): %v", mode, err)
+		}
+		return dst
+	}
+
+	// copy: ファイルリンクは実体コピー、ディレクトリリンクと dangling はスキップ
+	dst := run(LinksCopy, false)
+	if fi, err := os.Lstat(filepath.Join(dst, "file-link")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("copy: file-link should be a regular file: %v", err)
+	}
+	for _, name := range []string{"dir-link", "dangling", filepath.Join("dir", "loop")} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Fatalf("copy: %s should be skipped", name)
+		}
+	}
+
+	// preserve: リンクのまま再作成（dangling も）
+	dst = run(LinksPreserve, false)
+	for name, want := range map[string]string{"file-link": "real.txt", "dir-link": "dir", "dangling": "nowhere", "abs-link": filepath.Join(src, "real.txt")} {
+		if got, err := os.Readlink(filepath.Join(dst, name)); err != nil || got != want {
+			t.Fatalf("preserve: %s -> %q (%v), want %q", name, got, err, want)
+		}
+	}
+	dst = run(LinksPreserve, true)
+	if got, _ := os.Readlink(filepath.Join(dst, "abs-link")); got != filepath.Join(dst, "real.txt") {
+		t.Fatalf("rewrite: abs-link -> %q", got)
+	}
+
+	// skip: リンクは一切作らない
+	dst = run(LinksSkip, false)
+	if _, err := os.Lstat(filepath.Join(dst, "file-link")); !os.IsNotExist(err) {
+		t.Fatalf("skip: file-link should not exist")
+	}
+
+	// follow: ディレクトリリンクも中身ごとコピー、ループは止まる
+	dst = run(LinksFollow, false)
+	if got := string(readFile(t, filepath.Join(dst, "dir-link", "inner.txt"))); got != "inner" {
+		t.Fatalf("follow: dir-link/inner.txt = %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "dir", "loop")); !os.IsNotExist(err) {
+		t.Fatalf("follow: loop should be cut")
+	}
+}
+
+func mustSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+}
+
+func TestSyncDir_Preserve(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permission bits")
+	}
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh\n"))
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 内容はそのまま、SRC 側で実行ビットとディレクトリ時刻だけ変える
+	if err := os.Chmod(filepath.Join(src, "bin", "run.sh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "bin"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// --preserve なし: 内容が同じなのでメタデータは古いまま
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(filepath.Join(dst, "bin", "run.sh")); fi.Mode().Perm() != 0o644 {
+		t.Fatalf("without preserve mode = %v", fi.Mode())
+	}
+
+	var log bytes.Buffer
+	opt := options{Options: Options{Recursive: true, Preserve: PreserveMode | PreserveTimes, Reporter: NewTextReporter(&log, true)}}
+	if err := syncDir(src, dst, opt); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(filepath.Join(dst, "bin", "run.sh")); fi.Mode().Perm() != 0o755 {
+		t.Fatalf("preserve mode = %v", fi.Mode())
+	}
+	if fi, _ := os.Stat(filepath.Join(dst, "bin")); !fi.ModTime().Equal(old) {
+		t.Fatalf("dir mtime = %v, want %v", fi.ModTime(), old)
+	}
+	if !strings.Contains(log.String(), "meta (mode)") || !strings.Contains(log.String(), "meta (times)") {
+		t.Fatalf("missing meta events:\n%s", log.String())
+	}
+}
+
+func TestPreserve_ChownDenied(t *testing.T) {
+	if !ownerSupported || os.Getuid() == 0 {
+		t.Skip("needs a non-root Unix user")
+	}
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(dst, "b.tmp"), []byte("b"))
+	if err := os.Chmod(filepath.Join(src, "a.txt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var evs []Event
+	opt := options{Options: Options{Preserve: PreserveOwner | PreserveMode, Reporter: reporterFunc(func(ev Event) { evs = append(evs, ev) })}, stats: &runStats{}}
+	opt, err := opt.withRoots(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si, _ := os.Lstat(filepath.Join(src, "a.txt"))
+	si = ownedByForTest(si, os.Getuid()+1) // 他人の所有: chown は EPERM になる
+	di, _ := os.Lstat(filepath.Join(dst, "a.txt"))
+
+	if err := preserveOnTemp(filepath.Join(src, "a.txt"), filepath.Join(dst, "b.tmp"), filepath.Join(dst, "b.txt"), si, opt); err != nil {
+		t.Fatalf("preserveOnTemp: %v", err)
+	}
+	if err := syncMeta(filepath.Join(src, "a.txt"), filepath.Join(dst, "a.txt"), si, di, opt); err != nil {
+		t.Fatalf("syncMeta: %v", err)
+	}
+	var warnings, metas []Event
+	for _, ev := range evs {
+		switch ev.Type {
+		case EventWarning:
+			warnings = append(warnings, ev)
+		case EventMeta:
+			metas = append(metas, ev)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Path != "b.txt" || warnings[0].Reason != "owner" {
+		t.Fatalf("warnings = %+v, want one for b.txt", warnings)
+	}
+	if len(metas) != 1 || metas[0].Reason != "mode" || metas[0].Changes&ChangeOwner != 0 {
+		t.Fatalf("meta events = %+v, want mode only", metas)
+	}
+	if fi, _ := os.Stat(filepath.Join(dst, "a.txt")); fi.Mode().Perm() != 0o600 {
+		t.Fatalf("mode = %v, want 0600", fi.Mode())
+	}
+}
+
+func TestSyncDir_PreserveXattr(t *testing.T) {
+	if !xattrSupported {
+		t.Skip("xattrs not supported on this platform")
+	}
+	src := t.TempDir()
+	dst := t.TempDir()
+	f := filepath.Join(src, "a.txt")
+	writeFile(t, f, []byte("a"))
+	if err := setXattrForTest(f, "user.syncdir.test", []byte("v1")); err != nil {
+		t.Skipf("filesystem has no user xattrs: %v", err)
+	}
+	opt := options{Options: Options{Recursive: true, Preserve: PreserveXattr}}
+	if err := syncDir(src, dst, opt); err != nil {
+		t.Fatal(err)
+	}
+	if diff, err := xattrsDiffer(f, filepath.Join(dst, "a.txt")); err != nil || diff {
+		t.Fatalf("xattrs differ after copy: diff=%v err=%v", diff, err)
+	}
+}
+
+func TestPlanApply_Preserve(t *testing.T) {
+	if !xattrSupported {
+		t.Skip("xattrs not supported on this platform")
+	}
+	src := t.TempDir()
+	dst := t.TempDir()
+	f := filepath.Join(src, "a.txt")
+	writeFile(t, f, []byte("a"))
+	if err := setXattrForTest(f, "user.syncdir.test", []byte("v1")); err != nil {
+		t.Skipf("filesystem has no user xattrs: %v", err)
+	}
+	p, err := New(Options{Preserve: PreserveXattr}).Plan(src, dst)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"preserve": "xattr"`) {
+		t.Fatalf("plan = %s", buf.String())
+	}
+	p2, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{}).Apply(p2); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if diff, err := xattrsDiffer(f, filepath.Join(dst, "a.txt")); err != nil || diff {
+		t.Fatalf("xattrs differ after apply: diff=%v err=%v", diff, err)
+	}
+}
+
+func TestPlanApply_Meta(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no POSIX permission bits on Windows")
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "new", "b.txt"), []byte("b"))
+	if _, err := New(Options{Recursive: true, Preserve: PreserveMode | PreserveTimes}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	// metadata-only changes: a.txt's mode, and a directory created later
+	if err := os.Chmod(filepath.Join(src, "a.txt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(src, "fresh", "c.txt"), []byte("c"))
+	if err := os.Chmod(filepath.Join(src, "fresh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(Options{Preserve: PreserveMode}).Plan(src, dst)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	var meta []string
+	for _, op := range p.Ops {
+		if op.Type == EventMeta {
+			meta = append(meta, op.Path)
+		}
+	}
+	if len(meta) != 1 || meta[0] != "a.txt" {
+		t.Fatalf("meta ops = %v; want [a.txt]", meta)
+	}
+	if _, err := New(Options{}).Apply(p); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	for rel, want := range map[string]os.FileMode{"a.txt": 0o600, "fresh": 0o700} {
+		fi, err := os.Stat(filepath.Join(dst, rel))
+		if err != nil || fi.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, %v; want %v", rel, fi.Mode().Perm(), err, want)
+		}
+	}
+}
+
+func TestParsePreserve(t *testing.T) {
+	p, err := ParsePreserve("mode, times")
+	if err != nil || p != PreserveMode|PreserveTimes || p.String() != "mode,times" {
+		t.Fatalf("ParsePreserve = %v (%s), %v", p, p, err)
+	}
+	if p, _ := ParsePreserve("all"); p != PreserveAll {
+		t.Fatalf("all = %v", p)
+	}
+	if _, err := ParsePreserve("acl"); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("unknown kind: err=%v", err)
+	}
+}
+
+func TestDeltaCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.img")
+	dst := filepath.Join(dir, "dst.img")
+
+	const bs = 4096
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*bs/16) // 4 ブロック
+	writeFile(t, dst, data)
+	changed := append([]byte(nil), data...)
+	copy(changed[2*bs+10:], "CHANGED") // 3 ブロック目だけ変更
+	writeFile(t, src, changed)
+
+	var log bytes.Buffer
+	opt := options{Options: Options{Delta: true, DeltaBlock: bs, Reporter: NewJSONReporter(&log)}}
+	si, _ := os.Stat(src)
+	if err := copyAndReport(src, dst, si, "changed", ChangeSize, opt); err != nil {
+		t.Fatalf("copyAndReport(delta): %v", err)
+	}
+	if !bytes.Equal(readFile(t, dst), changed) {
+		t.Fatalf("delta result differs from source")
+	}
+	if !strings.Contains(log.String(), `"written":4096`) || !strings.Contains(log.String(), "changed (delta)") {
+		t.Fatalf("want exactly one block written, got %s", log.String())
+	}
+
+	// SRC が短くなったら切り詰める
+	writeFile(t, src, changed[:bs+100])
+	si, _ = os.Stat(src)
+	if _, err := deltaCopy(src, dst, si, opt); err != nil {
+		t.Fatalf("deltaCopy(shrink): %v", err)
+	}
+	if !bytes.Equal(readFile(t, dst), changed[:bs+100]) {
+		t.Fatalf("shrunk delta result differs from source")
+	}
+	if di, _ := os.Stat(dst); !di.ModTime().Equal(si.ModTime()) {
+		t.Fatalf("mtime not applied")
+	}
+}
+
+func TestDeltaCopy_ReadOnlyDst(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a read-only file cannot be renamed over on Windows")
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.bin"), []byte("new data"))
+	writeFile(t, filepath.Join(dst, "a.bin"), []byte("old data"))
+	if err := os.Chmod(filepath.Join(dst, "a.bin"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.OpenFile(filepath.Join(dst, "a.bin"), os.O_RDWR, 0); err == nil {
+		f.Close()
+		t.Skip("file modes are not enforced (running as root?)")
+	}
+
+	// the in-place update cannot open DST, so the file is copied in full
+	if _, err := New(Options{Recursive: true, Checksum: true, Delta: true}).Sync(src, dst); err != nil {
+		t.Fatalf("Sync(delta, read-only DST): %v", err)
+	}
+	if got := string(readFile(t, filepath.Join(dst, "a.bin"))); got != "new data" {
+		t.Fatalf("a.bin = %q", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"4096": 4096, "64K": 64 << 10, "10M": 10 << 20, "1.5G": 3 << 29, "2MiB": 2 << 20} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Fatalf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"ten", "-1", "NaN", "Inf", "+Inf", "1e30", "8388608T", "9007199254740993T", "0.5", "0.0001K"} {
+		if n, err := ParseSize(in); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("ParseSize(%q) = %d, %v; want ErrInvalidOption", in, n, err)
+		}
+	}
+	if n, err := ParseSize("0"); err != nil || n != 0 {
+		t.Fatalf("ParseSize(0) = %d, %v", n, err)
+	}
+}
+
+func TestCopyResumable(t *testing.T) {
+	old := partialCheckpoint
+	partialCheckpoint = 16
+	defer func() { partialCheckpoint = old }()
+
+	dir := t.TempDir()
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8) // 8 チェックポイント分
+	writeFile(t, filepath.Join(srcDir, "big.bin"), data)
+	si, _ := os.Stat(filepath.Join(srcDir, "big.bin"))
+
+	// 中断された前回の実行を再現: 3 チェックポイント + 未確定の 5 バイト
+	dstPath := filepath.Join(dstDir, "big.bin")
+	opt := options{Options: Options{Partial: true}}
+	part := partialPath(dstPath, opt)
+	writeFile(t, part, append(append([]byte(nil), data[:48]...), "XXXXX"...))
+	if err := writePartialState(part, partialState{SrcSize: si.Size(), SrcMtime: si.ModTime(), Offset: 48}); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	_, err := New(Options{Recursive: true, Mirror: true, Partial: true, Reporter: NewJSONReporter(&log)}).Sync(srcDir, dstDir)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !bytes.Equal(readFile(t, dstPath), data) {
+		t.Fatalf("resumed copy differs from source")
+	}
+	if !strings.Contains(log.String(), `"resumed":48`) || !strings.Contains(log.String(), `"written":80`) {
+		t.Fatalf("want resume at 48, got %s", log.String())
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+	if _, err := os.Stat(part + partialMeta); !os.IsNotExist(err) {
+		t.Fatalf("partial state left behind: %v", err)
+	}
+
+	// SRC が変わっていれば最初からやり直す
+	writeFile(t, part, data[:48])
+	if err := writePartialState(part, partialState{SrcSize: si.Size() + 1, SrcMtime: si.ModTime(), Offset: 48}); err != nil {
+		t.Fatal(err)
+	}
+	if off, err := copyResumable(filepath.Join(srcDir, "big.bin"), dstPath, opt); err != nil || off != 0 {
+		t.Fatalf("copyResumable(stale) = %d, %v; want fresh start", off, err)
+	}
+
+	// --partial-dir は mirror で消されない
+	opt.PartialDir = ".partial"
+	writeFile(t, filepath.Join(dstDir, ".partial", "big.bin"), data[:16])
+	if _, err := New(Options{Recursive: true, Mirror: true, Partial: true, PartialDir: ".partial"}).Sync(srcDir, dstDir); err != nil {
+		t.Fatalf("Sync(partial-dir): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, ".partial", "big.bin")); err != nil {
+		t.Fatalf("mirror removed the partial dir: %v", err)
+	}
+	if _, err := New(Options{Recursive: true, PartialDir: "a/b"}).Sync(srcDir, dstDir); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("PartialDir with separator: got %v", err)
+	}
+}
+
+func TestFilter_Gitignore(t *testing.T) {
+	f, err := CompileFilter([]string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"/build/",
+		"docs/*.md",
+		"**/cache",
+		"tmp/**",
+		"a/**/z",
+	})
+	if err != nil {
+		t.Fatalf("CompileFilter: %v", err)
+	}
+	cases := []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{"x.log", false, true},
+		{"sub/x.log", false, true},
+		{"sub/keep.log", false, false}, // 否定で再度含める
+		{"build", true, true},
+		{"build", false, false},         // dir 限定
+		{"sub/build", true, false},      // 先頭 / でルートに固定
+		{"build/out.bin", false, true},  // 除外 dir の中身
+		{"build/keep.log", false, true}, // 除外 dir の中は否定でも戻らない
+		{"docs/a.md", false, true},
+		{"docs/sub/a.md", false, false}, // * は / をまたがない
+		{"x/y/cache", true, true},
+		{"tmp", true, false},
+		{"tmp/a/b", false, true},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"readme.md", false, false},
+	}
+	for _, c := range cases {
+		if got := f.Excluded(filepath.FromSlash(c.rel), c.dir); got != c.want {
+			t.Errorf("Excluded(%q, dir=%v) = %v, want %v", c.rel, c.dir, got, c.want)
+		}
+	}
+
+	if _, err := CompileFilter([]string{"[a-"}); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("bad pattern: got %v", err)
+	}
+}
+
+func TestSyncDir_ExcludeFromNegation(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	writeFile(t, filepath.Join(src, "a.log"), []byte("a"))
+	writeFile(t, filepath.Join(src, "keep.log"), []byte("k"))
+	writeFile(t, filepath.Join(src, "build", "out"), []byte("o"))
+	writeFile(t, filepath.Join(dst, "build", "old"), []byte("o")) // 除外 dir は mirror でも残す
+	writeFile(t, filepath.Join(dst, "b.log"), []byte("b"))
+
+	ignore := filepath.Join(dir, ".syncignore")
+	writeFile(t, ignore, []byte("# logs\r\n*.log\r\n!keep.log\r\n/build/\r\n"))
+	excl, err := ReadExcludeFile(ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{Recursive: true, Mirror: true, Excludes: excl}).Sync(src, dst); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	for rel, want := range map[string]bool{"a.log": false, "keep.log": true, "build/out": false, "build/old": true, "b.log": true} {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(rel)))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestFilter_RulesFirstMatchWins(t *testing.T) {
+	f, err := NewFilter([]Rule{
+		{Include: true, Patterns: []string{"build/release/**"}},
+		{Patterns: []string{"build/"}},
+		{Patterns: []string{"*.o"}},
+		{Include: true, Patterns: []string{"keep.o"}}, // 先に *.o が一致するので効かない
+	})
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	for rel, want := range map[string]bool{
+		"build":                 true,
+		"build/debug/x":         true, // 親 dir の判定を継承
+		"build/release":         true,
+		"build/release/app.exe": false,
+		"src/a.o":               true,
+		"src/keep.o":            true,
+		"src/a.c":               false,
+	} {
+		isDir := rel == "build" || rel == "build/release"
+		if got := f.Excluded(filepath.FromSlash(rel), isDir); got != want {
+			t.Errorf("Excluded(%q) = %v, want %v", rel, got, want)
+		}
+	}
+	if !f.Descend("src") {
+		t.Errorf("Descend: unanchored include keep.o can match anywhere")
+	}
+
+	f, _ = NewFilter([]Rule{{Include: true, Patterns: []string{"build/release/**"}}, {Patterns: []string{"build/"}}})
+	if !f.Descend("build") || !f.Descend(filepath.FromSlash("build/release")) || f.Descend(filepath.FromSlash("build/debug")) {
+		t.Errorf("Descend: want build and build/release only")
+	}
+}
+
+func TestSyncDir_IncludeInsideExcluded(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	writeFile(t, filepath.Join(src, "build", "debug", "app"), []byte("d"))
+	writeFile(t, filepath.Join(src, "build", "release", "app"), []byte("r"))
+	writeFile(t, filepath.Join(src, "main.c"), []byte("m"))
+	writeFile(t, filepath.Join(dst, "build", "debug", "old"), []byte("o"))   // 除外: mirror でも残す
+	writeFile(t, filepath.Join(dst, "build", "release", "old"), []byte("o")) // 含める: mirror で消す
+
+	rules := []Rule{{Include: true, Patterns: []string{"build/release/**"}}, {Patterns: []string{"build/"}}}
+	if _, err := New(Options{Recursive: true, Mirror: true, Rules: rules}).Sync(src, dst); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	for rel, want := range map[string]bool{
+		"main.c":            true,
+		"build/release/app": true,
+		"build/release/old": false,
+		"build/debug/app":   false,
+		"build/debug/old":   true,
+	} {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(rel)))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestBisync(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	state := filepath.Join(dir, "state.json")
+	setTime := func(p string, tm time.Time) {
+		t.Helper()
+		if err := os.Chtimes(p, tm, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+	run := func(opt Options) {
+		t.Helper()
+		if _, err := New(opt).Bisync(a, b, state); err != nil {
+			t.Fatalf("Bisync: %v", err)
+		}
+	}
+
+	// 初回: 両側をマージし、削除はしない
+	writeFile(t, filepath.Join(a, "shared.txt"), []byte("v1"))
+	writeFile(t, filepath.Join(a, "onlyA.txt"), []byte("a"))
+	writeFile(t, filepath.Join(b, "sub", "onlyB.txt"), []byte("b"))
+	run(Options{})
+	for _, p := range []string{filepath.Join(b, "shared.txt"), filepath.Join(b, "onlyA.txt"), filepath.Join(a, "sub", "onlyB.txt")} {
+		if !exists(p) {
+			t.Fatalf("first run did not merge %s", p)
+		}
+	}
+
+	// 片側の変更・削除を反映する
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, filepath.Join(b, "shared.txt"), []byte("v2 from B"))
+	if err := os.Remove(filepath.Join(a, "onlyA.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(b, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	run(Options{})
+	if got := string(readFile(t, filepath.Join(a, "shared.txt"))); got != "v2 from B" {
+		t.Fatalf("B's edit not propagated: %q", got)
+	}
+	if exists(filepath.Join(b, "onlyA.txt")) || exists(filepath.Join(a, "sub")) {
+		t.Fatalf("deletions not propagated")
+	}
+
+	// 両側で変更: keep-both (既定)
+	writeFile(t, filepath.Join(a, "shared.txt"), []byte("A edit"))
+	writeFile(t, filepath.Join(b, "shared.txt"), []byte("B edit!"))
+	setTime(filepath.Join(b, "shared.txt"), old)
+	var log bytes.Buffer
+	run(Options{Reporter: NewJSONReporter(&log)})
+	alt := conflictName("shared.txt", "B", old)
+	for _, root := range []string{a, b} {
+		if got := string(readFile(t, filepath.Join(root, "shared.txt"))); got != "A edit" {
+			t.Fatalf("%s/shared.txt = %q, want A's version", root, got)
+		}
+		if got := string(readFile(t, filepath.Join(root, filepath.FromSlash(alt)))); got != "B edit!" {
+			t.Fatalf("%s/%s = %q, want B's version", root, alt, got)
+		}
+	}
+	if !strings.Contains(log.String(), `"type":"conflict"`) {
+		t.Fatalf("no conflict event: %s", log.String())
+	}
+
+	// 両側で変更: newer は新しい方を採る
+	writeFile(t, filepath.Join(a, "shared.txt"), []byte("older A"))
+	setTime(filepath.Join(a, "shared.txt"), old)
+	writeFile(t, filepath.Join(b, "shared.txt"), []byte("newer B"))
+	run(Options{Conflict: ConflictNewer})
+	if got := string(readFile(t, filepath.Join(a, "shared.txt"))); got != "newer B" {
+		t.Fatalf("newer policy: A has %q", got)
+	}
+
+	// prompt: Resolve の答えに従い、skip は状態を記録しない
+	writeFile(t, filepath.Join(a, "shared.txt"), []byte("A again"))
+	writeFile(t, filepath.Join(b, "shared.txt"), []byte("B again!"))
+	asked := 0
+	skip := func(Conflict) Resolution { asked++; return ResolveSkip }
+	run(Options{Conflict: ConflictPrompt, Resolve: skip})
+	run(Options{Conflict: ConflictPrompt, Resolve: skip})
+	if asked != 2 || string(readFile(t, filepath.Join(b, "shared.txt"))) != "B again!" {
+		t.Fatalf("skip: asked=%d", asked)
+	}
+
+	// 片側が空 (未マウント等) なら何も消さずに止まる
+	if err := os.RemoveAll(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(b, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{}).Bisync(a, b, state); !errors.Is(err, ErrBisyncEmptySide) {
+		t.Fatalf("empty side: got %v", err)
+	}
+	if !exists(filepath.Join(a, "shared.txt")) {
+		t.Fatalf("empty side deleted files in A")
+	}
+}
+
+// waitFor は cond が真になるまで最大 5 秒待つ。
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "old.txt"), []byte("old"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var log bytes.Buffer
+	rep := NewJSONReporter(&log)
+	ready := make(chan Event, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- New(Options{
+			Mirror:   true,
+			Excludes: []string{"*.log"},
+			Debounce: 50 * time.Millisecond,
+			Reporter: reporterFunc(func(ev Event) {
+				if ev.Type == EventWatch && ev.Reason == "ready" {
+					ready <- ev
+				}
+				rep.Report(ev)
+			}),
+		}).Watch(ctx, src, dst)
+	}()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Watch: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch never became ready")
+	}
+	if string(readFile(t, filepath.Join(dst, "a.txt"))) != "a" {
+		t.Fatal("initial sync missing")
+	}
+
+	present := func(rel string) func() bool {
+		return func() bool { _, err := os.Stat(filepath.Join(dst, rel)); return err == nil }
+	}
+	// 新規ファイル・新規ディレクトリ配下・変更・削除 (mirror)
+	writeFile(t, filepath.Join(src, "b.txt"), []byte("b"))
+	writeFile(t, filepath.Join(src, "newdir", "deep", "c.txt"), []byte("c"))
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a2"))
+	writeFile(t, filepath.Join(src, "skip.log"), []byte("x"))
+	if err := os.Remove(filepath.Join(src, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b.txt", present("b.txt"))
+	waitFor(t, "newdir/deep/c.txt", present(filepath.Join("newdir", "deep", "c.txt")))
+	waitFor(t, "a.txt update", func() bool {
+		b, _ := os.ReadFile(filepath.Join(dst, "a.txt"))
+		return string(b) == "a2"
+	})
+	waitFor(t, "old.txt removal", func() bool { return !present("old.txt")() })
+
+	// 新規ディレクトリにも監視が張られていること
+	writeFile(t, filepath.Join(src, "newdir", "deep", "d.txt"), []byte("d"))
+	waitFor(t, "newdir/deep/d.txt", present(filepath.Join("newdir", "deep", "d.txt")))
+	if present("skip.log")() {
+		t.Fatal("excluded file was synced")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Watch after cancel: %v", err)
+	}
+	if !strings.Contains(log.String(), `"reason":"batch"`) {
+		t.Fatalf("no batch event: %s", log.String())
+	}
+}
+
+func TestWatch_BatchInExcludedDir(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "build", "keep.txt"), []byte("k"))
+	writeFile(t, filepath.Join(dst, "build", "old.txt"), []byte("o"))
+	opt := Options{Recursive: true, Mirror: true, MaxDelete: 1, Excludes: []string{"build/", "!keep.txt"}}
+	o, err := options{Options: opt}.withRoots(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.filter.Excluded(filepath.Join("build", "keep.txt"), false) {
+		t.Fatal("!keep.txt re-included a file below the excluded build/")
+	}
+
+	// the batch agrees with the full walk: nothing below build/ is touched
+	changed := map[string]bool{filepath.Join("build", "keep.txt"): true, filepath.Join("build", "old.txt"): true}
+	if err := New(opt).syncBatch(src, dst, changed, o); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "build", "keep.txt")); !os.IsNotExist(err) {
+		t.Fatal("watch batch synced build/keep.txt")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "build", "old.txt")); err != nil {
+		t.Fatal("watch batch deleted the excluded build/old.txt")
+	}
+}
+
+func TestWatch_BatchDeletePercent(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		writeFile(t, filepath.Join(dst, name), []byte(name))
+	}
+	writeFile(t, filepath.Join(src, "d"), []byte("d"))
+	opt := Options{Recursive: true, Mirror: true, MaxDeletePercent: 50}
+	o, err := options{Options: opt}.withRoots(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SRC lost a, b and c (an unmounted share, say): 3 of 4 is over 50%
+	err = New(opt).syncBatch(src, dst, map[string]bool{"a": true, "b": true, "c": true}, o)
+	var le *DeleteLimitError
+	if !errors.As(err, &le) || le.Entries != 3 || le.Total != 4 {
+		t.Fatalf("syncBatch = %v; want a DeleteLimitError for 3 of 4", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a")); err != nil {
+		t.Fatal("a was deleted despite the limit")
+	}
+	if err := New(opt).syncBatch(src, dst, map[string]bool{"a": true}, o); err != nil {
+		t.Fatalf("1 of 4: %v", err)
+	}
+}
+
+type reporterFunc func(Event)
+
+func (f reporterFunc) Report(ev Event) { f(ev) }
+
+func TestPollWatcher(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "keep.txt"), []byte("1"))
+	writeFile(t, filepath.Join(src, "gone.txt"), []byte("1"))
+	f, err := CompileFilter([]string{"*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newPollWatcher(src, options{filter: f}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	writeFile(t, filepath.Join(src, "sub", "new.txt"), []byte("n"))
+	writeFile(t, filepath.Join(src, "x.log"), []byte("n"))
+	if err := os.Remove(filepath.Join(src, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"sub": true, filepath.Join("sub", "new.txt"): true, "gone.txt": true}
+	got := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case rel := <-w.Changes():
+			if !want[rel] {
+				t.Fatalf("unexpected change %q", rel)
+			}
+			got[rel] = true
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("changes = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSync_Progress(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "same.txt"), []byte("same"))
+	writeFile(t, filepath.Join(src, "sub", "big.bin"), bytes.Repeat([]byte("x"), 3<<20))
+	writeFile(t, filepath.Join(src, "skip.tmp"), []byte("excluded"))
+	if _, err := New(Options{Recursive: true, Excludes: []string{"*.tmp"}}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(src, "sub", "big.bin"), bytes.Repeat([]byte("y"), 3<<20))
+	mt := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "sub", "big.bin"), mt, mt); err != nil {
+		t.Fatal(err)
+	}
+
+	var snaps []Progress
+	_, err := New(Options{
+		Recursive:        true,
+		Excludes:         []string{"*.tmp"},
+		Progress:         func(p Progress) { snaps = append(snaps, p) },
+		ProgressInterval: time.Millisecond,
+	}).Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := snaps[len(snaps)-1]
+	total := int64(4 + 3<<20)
+	if !last.Done || last.Files != 2 || last.FilesTotal != 2 || last.Bytes != total || last.BytesTotal != total {
+		t.Fatalf("final snapshot = %+v", last)
+	}
+	for i, p := range snaps[:len(snaps)-1] {
+		if p.Done || p.Bytes > total || (i > 0 && p.Bytes < snaps[i-1].Bytes) {
+			t.Fatalf("snapshot %d = %+v", i, p)
+		}
+	}
+}
+
+func TestParseBwLimit(t *testing.T) {
+	b, err := ParseBwLimit("10M")
+	if err != nil || len(b) != 1 || b.At(time.Now()) != 10<<20 {
+		t.Fatalf("10M = %v, %v", b, err)
+	}
+	if b, err := ParseBwLimit("off"); err != nil || b != nil {
+		t.Fatalf("off = %v, %v", b, err)
+	}
+	b, err = ParseBwLimit("18:00,off 08:00,2M 12:30,512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)
+	for clock, want := range map[time.Duration]int64{
+		3 * time.Hour:                 0, // yesterday's 18:00 slot
+		8 * time.Hour:                 2 << 20,
+		12*time.Hour + 29*time.Minute: 2 << 20,
+		12*time.Hour + 30*time.Minute: 512 << 10,
+		20 * time.Hour:                0,
+	} {
+		if got := b.At(day.Add(clock)); got != want {
+			t.Errorf("At(%v) = %d, want %d", clock, got, want)
+		}
+	}
+	for _, bad := range []string{"fast", "8:00", "25:00,1M", "08:00,x", "08:00,1M 08:00,2M", "NaN", "Inf", "0.5", "08:00,0.5"} {
+		if _, err := ParseBwLimit(bad); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("ParseBwLimit(%q) err = %v", bad, err)
+		}
+	}
+}
+
+func TestSyncDir_BwLimit(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	for i := 0; i < 4; i++ {
+		writeFile(t, filepath.Join(src, fmt.Sprintf("f%d.bin", i)), bytes.Repeat([]byte{byte(i)}, 64<<10))
+	}
+	// 256K at 1M/s: the limit is shared, so 4 workers still need ~250ms
+	start := time.Now()
+	if err := syncDir(src, dst, options{Options: Options{Recursive: true, Parallel: 4}, limit: newLimiter(BwLimit{{Rate: 1 << 20}})}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("limited sync took %v, want >= ~250ms", d)
+	}
+	if !bytes.Equal(readFile(t, filepath.Join(dst, "f3.bin")), bytes.Repeat([]byte{3}, 64<<10)) {
+		t.Fatal("f3.bin content mismatch")
+	}
+}
+
+func TestSync_Backup(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("v1"))
+	writeFile(t, filepath.Join(src, "gone", "g.txt"), []byte("g"))
+	if _, err := New(Options{Recursive: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	bump := func(p string, data string) {
+		writeFile(t, p, []byte(data))
+		mt := time.Now().Add(time.Hour)
+		if err := os.Chtimes(p, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// suffix mode: a.txt~ next to the file, gone~ for the mirrored-away dir
+	bump(filepath.Join(src, "a.txt"), "v2")
+	if err := os.RemoveAll(filepath.Join(src, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{Recursive: true, Mirror: true, Backup: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readFile(t, filepath.Join(dst, "a.txt~"))); got != "v1" {
+		t.Fatalf("a.txt~ = %q", got)
+	}
+	if got := string(readFile(t, filepath.Join(dst, "gone~", "g.txt"))); got != "g" {
+		t.Fatalf("gone~/g.txt = %q", got)
+	}
+	// backups survive the next mirror run
+	if _, err := New(Options{Recursive: true, Mirror: true, Backup: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt~")); err != nil {
+		t.Fatalf("suffixed backup was mirrored away: %v", err)
+	}
+
+	// dir mode: .backup/<stamp>/a.txt, and .backup itself is excluded from the mirror pass
+	bump(filepath.Join(src, "a.txt"), "version 3")
+	var log bytes.Buffer
+	opt := Options{Recursive: true, Mirror: true, BackupDir: ".backup", Backup: true, Reporter: NewJSONReporter(&log)}
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	stamps, _ := filepath.Glob(filepath.Join(dst, ".backup", "*", "a.txt"))
+	if len(stamps) != 1 || string(readFile(t, stamps[0])) != "v2" {
+		t.Fatalf("backup-dir copies = %v", stamps)
+	}
+	if string(readFile(t, filepath.Join(dst, "a.txt"))) != "version 3" {
+		t.Fatal("a.txt not updated")
+	}
+	if !strings.Contains(log.String(), `"type":"backup"`) {
+		t.Fatalf("no backup event: %s", log.String())
+	}
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stamps[0]); err != nil {
+		t.Fatalf("backup dir was mirrored away: %v", err)
+	}
+	// a run within the same second gets a stamp of its own
+	bump(filepath.Join(src, "a.txt"), "version four")
+	start := time.Now()
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	bump(filepath.Join(src, "a.txt"), "v5")
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	stamps, _ = filepath.Glob(filepath.Join(dst, ".backup", "*", "a.txt"))
+	if len(stamps) != 3 {
+		t.Fatalf("backup-dir copies = %v (runs started %v apart)", stamps, time.Since(start))
+	}
+
+	// a SRC entry ending in the suffix would be clobbered by a backup
+	writeFile(t, filepath.Join(src, "a.txt~"), []byte("mine"))
+	if _, err := New(Options{Recursive: true, Backup: true}).Sync(src, dst); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("SRC a.txt~ with Backup: err = %v", err)
+	}
+	if _, err := New(Options{Recursive: true, Backup: true, Excludes: []string{"*~"}}).Sync(src, dst); err != nil {
+		t.Fatalf("excluded SRC a.txt~: %v", err)
+	}
+}
+
+func TestSync_BackupSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.txt"), filepath.Join(dir, "dst.txt")
+	writeFile(t, src, []byte("new"))
+	writeFile(t, dst, []byte("old"))
+	if _, err := New(Options{Backup: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readFile(t, dst+"~")); got != "old" {
+		t.Fatalf("dst.txt~ = %q", got)
+	}
+	if got := string(readFile(t, dst)); got != "new" {
+		t.Fatalf("dst.txt = %q", got)
+	}
+}
+
+func TestSync_TrashRestorePurge(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "keep.txt"), []byte("k"))
+	writeFile(t, filepath.Join(dst, "old.txt"), []byte("old"))
+	writeFile(t, filepath.Join(dst, "olddir", "x.txt"), []byte("x"))
+
+	var log bytes.Buffer
+	opt := Options{Recursive: true, Mirror: true, Trash: true, Reporter: NewJSONReporter(&log)}
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old.txt")); !os.IsNotExist(err) {
+		t.Fatal("old.txt still in DST")
+	}
+	runs, err := ListTrash(filepath.Join(dst, defaultTrashDir))
+	if err != nil || len(runs) != 1 || len(runs[0].Entries) != 2 {
+		t.Fatalf("ListTrash = %+v, %v", runs, err)
+	}
+	if !strings.Contains(log.String(), `"type":"trash"`) {
+		t.Fatalf("no trash event: %s", log.String())
+	}
+	// the trash is excluded: a second mirror run leaves it alone
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if runs2, _ := ListTrash(filepath.Join(dst, defaultTrashDir)); len(runs2) != 1 {
+		t.Fatalf("trash after second run = %+v", runs2)
+	}
+
+	// old.txt was recreated meanwhile: refused and kept; olddir comes back
+	writeFile(t, filepath.Join(dst, "old.txt"), []byte("new"))
+	_, err = New(Options{}).Restore(runs[0].Dir)
+	if !errors.Is(err, ErrRestoreConflict) {
+		t.Fatalf("Restore err = %v", err)
+	}
+	if string(readFile(t, filepath.Join(dst, "olddir", "x.txt"))) != "x" {
+		t.Fatal("olddir/x.txt not restored")
+	}
+	if string(readFile(t, filepath.Join(dst, "old.txt"))) != "new" {
+		t.Fatal("restore overwrote old.txt")
+	}
+	left, err := ReadTrashRun(runs[0].Dir)
+	if err != nil || len(left.Entries) != 1 || left.Entries[0].Path != "old.txt" {
+		t.Fatalf("manifest after restore = %+v, %v", left, err)
+	}
+
+	if _, err := New(Options{}).PurgeTrash(filepath.Join(dst, defaultTrashDir), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(runs[0].Dir); err != nil {
+		t.Fatal("a fresh run was purged")
+	}
+	if _, err := New(Options{}).PurgeTrash(filepath.Join(dst, defaultTrashDir), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(runs[0].Dir); !os.IsNotExist(err) {
+		t.Fatal("run not purged")
+	}
+}
+
+func TestSync_DeleteLimit(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "keep.txt"), []byte("k"))
+	writeFile(t, filepath.Join(dst, "keep.txt"), []byte("k"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("aaaa"))
+	writeFile(t, filepath.Join(dst, "dir", "b.txt"), []byte("bb"))
+	writeFile(t, filepath.Join(dst, "dir", "c.txt"), []byte("c"))
+
+	// a.txt, dir, dir/b.txt, dir/c.txt: 4 of 5 entries, 7 bytes
+	for _, opt := range []Options{{MaxDelete: 3}, {MaxDeletePercent: 50}, {MaxDelete: 3, DryRun: true}} {
+		opt.Recursive, opt.Mirror = true, true
+		_, err := New(opt).Sync(src, dst)
+		var le *DeleteLimitError
+		if !errors.Is(err, ErrDeleteLimit) || !errors.As(err, &le) {
+			t.Fatalf("%+v: err = %v", opt, err)
+		}
+		if le.Entries != 4 || le.Total != 5 || le.Bytes != 7 || len(le.Sample) != 2 {
+			t.Fatalf("%+v: %+v", opt, le)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil {
+			t.Fatalf("%+v: a.txt deleted: %v", opt, err)
+		}
+	}
+
+	if _, err := New(Options{Recursive: true, Mirror: true, MaxDelete: 4, MaxDeletePercent: 80}).Sync(src, dst); err != nil {
+		t.Fatalf("within limits: %v", err)
+	}
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("aaaa"))
+	if _, err := New(Options{Recursive: true, Mirror: true, MaxDelete: 0, MaxDeletePercent: 1, ForceDelete: true}).Sync(src, dst); err != nil {
+		t.Fatalf("ForceDelete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); !os.IsNotExist(err) {
+		t.Fatal("a.txt not deleted with ForceDelete")
+	}
+	if _, err := New(Options{Recursive: true, MaxDeletePercent: 101}).Sync(src, dst); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("MaxDeletePercent 101: err = %v", err)
+	}
+}
+
+func TestSync_ChecksumCache(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	cache := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("same"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("same"))
+	mt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, p := range []string{filepath.Join(src, "a.txt"), filepath.Join(dst, "a.txt")} {
+		if err := os.Chtimes(p, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opt := Options{Recursive: true, Checksum: true, ChecksumCache: cache}
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{src, dst} {
+		file, _ := checksumCacheFile(cache, root, DefaultChecksumAlgo)
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("no cache for %s: %v", root, err)
+		}
+	}
+
+	// rewrite DST in place with the same size, mtime and inode: the cached
+	// hash still matches, so only a rebuild notices the change
+	if err := os.WriteFile(filepath.Join(dst, "a.txt"), []byte("diff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dst, "a.txt"), mt, mt); err != nil {
+		t.Fatal(err)
+	}
+	res, err := New(opt).Sync(src, dst)
+	if err != nil || res.Counts[EventCopy] != 0 {
+		t.Fatalf("cached run: %+v, %v", res, err)
+	}
+	if n, err := New(opt).RebuildChecksumCache(dst); err != nil || n != 1 {
+		t.Fatalf("RebuildChecksumCache = %d, %v", n, err)
+	}
+	res, err = New(opt).Sync(src, dst)
+	if err != nil || res.Counts[EventCopy] != 1 || string(readFile(t, filepath.Join(dst, "a.txt"))) != "same" {
+		t.Fatalf("after rebuild: %+v, %v", res, err)
+	}
+
+	// the copy replaced DST's file, so its stale entry is gone
+	c, err := openHashCache(cache, dst, DefaultChecksumAlgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := c.files["a.txt"]; ok && !e.sameMeta(cacheEntryOf(filepath.Join(dst, "a.txt"), fi)) {
+		t.Fatalf("stale entry kept: %+v", c.files)
+	}
+}
+
+func TestHashers(t *testing.T) {
+	for in, want := range map[string]string{"": "ef46db3751d8e999", "abc": "44bc2cf5ad770999", "Nobody inspects the spammish repetition": "fbcea83c8a378bf1"} {
+		d := newXXH64()
+		for i := 0; i < len(in); i++ { // byte by byte: exercises the buffering
+			d.Write([]byte{in[i]})
+		}
+		if got := fmt.Sprintf("%016x", d.Sum64()); got != want {
+			t.Errorf("xxh64(%q) = %s, want %s", in, got, want)
+		}
+	}
+
+	f := filepath.Join(t.TempDir(), "x.txt")
+	data := bytes.Repeat([]byte("hello syncdir "), 10)
+	writeFile(t, f, data)
+	sha := sha256.Sum256(data)
+	crc := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	for name, want := range map[string][]byte{"sha256": sha[:], "CRC32C": binary.BigEndian.AppendUint32(nil, crc)} {
+		h, err := LookupHasher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fileSum(f, h, options{}); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s = %x, %v; want %x", name, got, err, want)
+		}
+	}
+	if _, err := LookupHasher("md4"); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("LookupHasher(md4) err = %v", err)
+	}
+
+	// each algorithm keeps its own cache, tagged with its name
+	src, dst, cache := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("a"))
+	opt := Options{Recursive: true, Checksum: true, ChecksumCache: cache, ChecksumAlgo: "xxh64"}
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := checksumCacheFile(cache, src, "xxh64")
+	var cf hashCacheFile
+	if err := json.Unmarshal(readFile(t, file), &cf); err != nil || cf.Algo != "xxh64" || len(cf.Files["a.txt"].Sum) != 16 {
+		t.Fatalf("cache %s = %+v, %v", file, cf, err)
+	}
+	opt.ChecksumAlgo = "blake9"
+	if _, err := New(opt).Sync(src, dst); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("unknown algo: err = %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "same.txt"), []byte("same"))
+	writeFile(t, filepath.Join(src, "size.txt"), []byte("longer"))
+	writeFile(t, filepath.Join(src, "content.txt"), []byte("aaaa"))
+	writeFile(t, filepath.Join(src, "old.txt"), []byte("old"))
+	writeFile(t, filepath.Join(src, "sub", "missing.txt"), []byte("m"))
+	writeFile(t, filepath.Join(src, "skip.log"), []byte("x"))
+	if _, err := New(Options{Recursive: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dst, "sub", "missing.txt"))
+	writeFile(t, filepath.Join(dst, "size.txt"), []byte("short"))
+	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("e"))
+	writeFile(t, filepath.Join(dst, "skip.log"), []byte("changed"))
+	fi, _ := os.Stat(filepath.Join(src, "content.txt"))
+	writeFile(t, filepath.Join(dst, "content.txt"), []byte("bbbb"))
+	os.Chtimes(filepath.Join(dst, "content.txt"), fi.ModTime(), fi.ModTime())
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dst, "old.txt"), old, old)
+
+	verify := func(opt Options) (map[string]string, error) {
+		diffs := map[string]string{}
+		opt.Reporter = reporterFunc(func(ev Event) {
+			if ev.Type == EventDiff {
+				diffs[filepath.ToSlash(ev.Path)] = ev.Reason
+			}
+		})
+		opt.Excludes = []string{"*.log"}
+		_, err := New(opt).Verify(src, dst)
+		return diffs, err
+	}
+	diffs, err := verify(Options{})
+	want := map[string]string{"size.txt": DiffSize, "old.txt": DiffMeta, "sub/missing.txt": DiffMissing, "extra.txt": DiffExtra}
+	if !errors.Is(err, ErrMismatch) || fmt.Sprint(diffs) != fmt.Sprint(want) {
+		t.Fatalf("Verify = %v, %v; want %v", diffs, err, want)
+	}
+	want["content.txt"] = DiffContent
+	if diffs, _ = verify(Options{Checksum: true}); fmt.Sprint(diffs) != fmt.Sprint(want) {
+		t.Fatalf("Verify --checksum = %v; want %v", diffs, want)
+	}
+	if string(readFile(t, filepath.Join(dst, "size.txt"))) != "short" {
+		t.Fatal("Verify changed DST")
+	}
+
+	// repair fixes all but the extra file, which is only reported
+	diffs, err = verify(Options{Checksum: true, Repair: true})
+	if len(diffs) != 5 || !errors.Is(err, ErrMismatch) || !strings.Contains(err.Error(), "1 of 5") {
+		t.Fatalf("repair: %v, %v", diffs, err)
+	}
+	if string(readFile(t, filepath.Join(dst, "content.txt"))) != "aaaa" || string(readFile(t, filepath.Join(dst, "sub", "missing.txt"))) != "m" {
+		t.Fatal("repair did not recopy")
+	}
+	os.Remove(filepath.Join(dst, "extra.txt"))
+	if diffs, err = verify(Options{Checksum: true}); err != nil || len(diffs) != 0 {
+		t.Fatalf("after repair: %v, %v", diffs, err)
+	}
+}
+
+func TestVerify_Backups(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("new"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("old"))
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dst, "a.txt"), old, old)
+	if _, err := New(Options{Recursive: true, Backup: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(src, "b.txt"), []byte("new"))
+	writeFile(t, filepath.Join(dst, "b.txt"), []byte("old"))
+	os.Chtimes(filepath.Join(dst, "b.txt"), old, old)
+	if _, err := New(Options{Recursive: true, BackupDir: ".bk", Backup: true}).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify skips both kinds without Backup, which would change --repair
+	diffs := 0
+	rep := reporterFunc(func(ev Event) {
+		if ev.Type == EventDiff {
+			diffs++
+			t.Logf("diff %s: %s", ev.Reason, ev.Path)
+		}
+	})
+	if _, err := New(Options{BackupDir: ".bk", Reporter: rep}).Verify(src, dst); err != nil || diffs != 0 {
+		t.Fatalf("Verify = %v with %d diff(s); want no diffs", err, diffs)
+	}
+	if _, err := New(Options{Reporter: rep}).Verify(src, dst); !errors.Is(err, ErrMismatch) || diffs != 1 {
+		t.Fatalf("Verify without BackupDir = %v with %d diff(s); want only .bk", err, diffs)
+	}
+}
+
+func TestItemize(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "sub", "b.txt"), []byte("b"))
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("old a"))
+	writeFile(t, filepath.Join(dst, "gone.txt"), []byte("x"))
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dst, "a.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	opt := Options{Recursive: true, Mirror: true, DryRun: true, Reporter: NewItemizeReporter(&log, false)}
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	sep := string(filepath.Separator)
+	for _, want := range []string{">f.st.... a.txt", "cd+++++++ sub" + sep, ">f+++++++ sub" + sep + "b.txt", "*deleting gone.txt"} {
+		if !strings.Contains(log.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, log.String())
+		}
+	}
+
+	ev := Event{Type: EventMeta, Dir: true, Changes: ChangePerms | ChangeGroup}
+	if got := ev.Itemize(); got != ".d...p.g." {
+		t.Fatalf("Itemize(meta) = %q", got)
+	}
+	data, err := json.Marshal(ev)
+	if err != nil || !strings.Contains(string(data), `"changes":"perms,group"`) {
+		t.Fatalf("json = %s, %v", data, err)
+	}
+	var back Event
+	if err := json.Unmarshal(data, &back); err != nil || back.Changes != ev.Changes {
+		t.Fatalf("round trip = %v, %v", back.Changes, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(src, "sub", "b.txt"), []byte("hi"))
+	writeFile(t, filepath.Join(src, "skip.tmp"), []byte("tmp"))
+	writeFile(t, filepath.Join(dst, "gone.txt"), []byte("x"))
+
+	opt := Options{Recursive: true, Mirror: true, Excludes: []string{"*.tmp"}}
+	res, err := New(opt).Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := res.Stats
+	if st.FilesScanned != 2 || st.FilesCopied != 2 || st.Excluded != 1 || st.Deleted != 1 || st.DirsCreated != 1 {
+		t.Fatalf("counts = %+v", st)
+	}
+	if st.BytesRead != 7 || st.BytesWritten != 7 || st.BytesHashed != 0 || st.Errors != 0 || st.Elapsed <= 0 {
+		t.Fatalf("bytes = %+v", st)
+	}
+
+	opt.Checksum = true
+	var sum Event
+	opt.Reporter = reporterFunc(func(ev Event) {
+		if ev.Type == EventSummary {
+			sum = ev
+		}
+	})
+	res, err = New(opt).Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = res.Stats
+	if st.FilesSkipped != 2 || st.BytesWritten != 0 || st.BytesHashed != 14 || st.Throughput() != 0 {
+		t.Fatalf("checksum run = %+v", st)
+	}
+	if sum.Stats == nil || *sum.Stats != st {
+		t.Fatalf("summary stats = %+v, want %+v", sum.Stats, st)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "blk", "f.txt"), []byte("f"))
+	writeFile(t, filepath.Join(src, "isdir.txt"), []byte("i"))
+	writeFile(t, filepath.Join(src, "z.txt"), []byte("z"))
+	writeFile(t, filepath.Join(dst, "blk"), []byte("a file where SRC has a dir"))
+	writeFile(t, filepath.Join(dst, "isdir.txt", "inner"), []byte("a dir where SRC has a file"))
+	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("x"))
+
+	var errs []Event
+	opt := Options{Recursive: true, Mirror: true, KeepGoing: true, Parallel: 2, Reporter: reporterFunc(func(ev Event) {
+		if ev.Type == EventError {
+			errs = append(errs, ev)
+		}
+	})}
+	res, err := New(opt).Sync(src, dst)
+	var pe *PartialError
+	if !errors.Is(err, ErrPartial) || !errors.As(err, &pe) {
+		t.Fatalf("err = %v, want a *PartialError", err)
+	}
+	got := map[string]string{}
+	for _, f := range pe.Failures {
+		got[f.Path] = f.Op
+	}
+	if len(pe.Failures) != 2 || got["blk"] != OpMkdir || got["isdir.txt"] != OpCopy {
+		t.Fatalf("failures = %v", pe.Failures)
+	}
+	if len(errs) != 2 || res.Stats.Errors != 2 || errs[0].Reason == "" {
+		t.Fatalf("error events = %+v, stats = %+v", errs, res.Stats)
+	}
+	for _, name := range []string{"a.txt", "z.txt"} {
+		if got := string(readFile(t, filepath.Join(dst, name))); got != name[:1] {
+			t.Fatalf("%s = %q", name, got)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "extra.txt")); !os.IsNotExist(err) {
+		t.Fatalf("extra.txt not mirrored away: %v", err)
+	}
+}
+
+func TestKeepGoing_UnsearchableDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permission bits")
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "d", "keep.txt"), []byte("k"))
+	writeFile(t, filepath.Join(dst, "d", "keep.txt"), []byte("k"))
+	writeFile(t, filepath.Join(dst, "d", "gone.txt"), []byte("g"))
+	// listable but not searchable: names are readable, lstat is not
+	locked := filepath.Join(src, "d")
+	if err := os.Chmod(locked, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0o755)
+	if _, err := os.Lstat(filepath.Join(locked, "keep.txt")); err == nil {
+		t.Skip("running with privileges that ignore file modes")
+	}
+
+	_, err := New(Options{Recursive: true, Mirror: true, KeepGoing: true}).Sync(src, dst)
+	var pe *PartialError
+	if !errors.As(err, &pe) || len(pe.Failures) == 0 {
+		t.Fatalf("err = %v, want a *PartialError", err)
+	}
+	for _, name := range []string{"keep.txt", "gone.txt"} {
+		if _, err := os.Lstat(filepath.Join(dst, "d", name)); err != nil {
+			t.Fatalf("d/%s deleted although SRC could not be checked: %v", name, err)
+		}
+	}
+	if got := string(readFile(t, filepath.Join(dst, "a.txt"))); got != "a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+
+	// without --keep-going the unreadable entry stops the run; still nothing is deleted
+	if _, err := New(Options{Recursive: true, Mirror: true}).Sync(src, dst); err == nil {
+		t.Fatal("expected an error without KeepGoing")
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "d", "keep.txt")); err != nil {
+		t.Fatalf("d/keep.txt deleted: %v", err)
+	}
+}
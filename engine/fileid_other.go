@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package engine
+
+import "io/fs"
+
+// fileID is not available from a plain Stat here; the checksum cache
+// falls back to size and mtime.
+func fileID(string, fs.FileInfo) (dev, ino uint64) { return 0, 0 }
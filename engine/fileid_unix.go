@@ -0,0 +1,18 @@
+//go:build unix
+
+package engine
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the device and inode of fi, which the checksum cache
+// compares to notice a file replaced by another of the same size and mtime.
+func fileID(_ string, fi fs.FileInfo) (dev, ino uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino)
+}
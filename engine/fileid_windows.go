@@ -0,0 +1,31 @@
+//go:build windows
+
+package engine
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the volume serial number and file index of the file at
+// path, which the checksum cache compares to notice a file replaced by
+// another of the same size and mtime. Stat does not report them on
+// Windows, so the file is opened (without read access) to ask; if that
+// fails both are 0 and the cache falls back to size and mtime.
+func fileID(path string, _ fs.FileInfo) (dev, ino uint64) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0
+	}
+	share := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	h, err := syscall.CreateFile(p, 0, share, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, 0
+	}
+	defer syscall.CloseHandle(h)
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return 0, 0
+	}
+	return uint64(d.VolumeSerialNumber), uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)
+}
@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/* =========================
+           FILTER
+========================= */
+
+// A Filter decides which entries are excluded. It is an ordered list of
+// Rules; the first Rule with a matching pattern decides. Within a Rule the
+// patterns follow .gitignore rules:
+//
+//   - blank lines and lines starting with "#" are ignored
+//   - "!pattern" negates: in an exclude Rule it re-includes, in an include
+//     Rule it excludes; the last matching pattern of the Rule wins
+//   - a trailing "/" matches directories only
+//   - a pattern with a "/" at the start or in the middle is anchored to the
+//     root; otherwise it matches a name at any depth
+//   - "*", "?" and "[...]" do not match "/"; "**" matches any number of
+//     directories ("**/x", "x/**", "a/**/b")
+//
+// Paths are relative to the SRC/DST root. An entry no Rule matches inherits
+// the decision for its nearest matched parent directory, and is included if
+// there is none.
+type Filter struct {
+	blocks []filterBlock
+}
+
+// Rule is one entry of an ordered filter list, such as one --include,
+// --exclude or --exclude-from on the command line.
+type Rule struct {
+	Include  bool     `json:"include,omitempty"`
+	Patterns []string `json:"patterns"`
+}
+
+type filterBlock struct {
+	include bool
+	rules   []filterRule
+}
+
+type filterRule struct {
+	segs    []string // slash-separated pattern; unanchored ones start with "**"
+	negate  bool
+	dirOnly bool
+}
+
+// NewFilter compiles rules in order. Syntax errors wrap ErrInvalidOption.
+func NewFilter(rules []Rule) (*Filter, error) {
+	f := &Filter{}
+	for _, r := range rules {
+		b := filterBlock{include: r.Include}
+		for _, p := range r.Patterns {
+			fr, ok, err := parseFilterRule(p)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				b.rules = append(b.rules, fr)
+			}
+		}
+		if len(b.rules) > 0 {
+			f.blocks = append(f.blocks, b)
+		}
+	}
+	return f, nil
+}
+
+// CompileFilter compiles patterns as a single exclude Rule, i.e. with plain
+// .gitignore semantics.
+func CompileFilter(patterns []string) (*Filter, error) {
+	return NewFilter([]Rule{{Patterns: patterns}})
+}
+
+// compileFilter builds the Filter for o: its Rules, then Excludes as one
+// more exclude Rule.
+func compileFilter(o Options) (*Filter, error) {
+	rules := append(append([]Rule(nil), o.Rules...), Rule{Patterns: o.Excludes})
+	return NewFilter(rules)
+}
+
+func parseFilterRule(p string) (filterRule, bool, error) {
+	orig := p
+	p = trimTrailingSpaces(filepath.ToSlash(p))
+	if p == "" || strings.HasPrefix(p, "#") {
+		return filterRule{}, false, nil
+	}
+	var r filterRule
+	switch {
+	case strings.HasPrefix(p, "!"):
+		r.negate = true
+		p = p[1:]
+	case strings.HasPrefix(p, `\!`), strings.HasPrefix(p, `\#`):
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return filterRule{}, false, wrapf(ErrInvalidOption, "empty exclude pattern %q", orig)
+	}
+	r.segs = strings.Split(p, "/")
+	if !anchored {
+		r.segs = append([]string{"**"}, r.segs...)
+	}
+	for _, s := range r.segs {
+		if _, err := path.Match(s, ""); err != nil {
+			return filterRule{}, false, wrapf(ErrInvalidOption, "bad exclude pattern %q", orig)
+		}
+	}
+	return r, true, nil
+}
+
+// trimTrailingSpaces drops trailing spaces unless escaped with "\".
+func trimTrailingSpaces(p string) string {
+	for strings.HasSuffix(p, " ") && !strings.HasSuffix(p, `\ `) {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// Excluded reports whether rel (a path relative to the root) is excluded.
+// As in git, an entry below an excluded directory stays excluded whatever
+// matches it, unless Descend holds for that directory.
+func (f *Filter) Excluded(rel string, isDir bool) bool {
+	if f == nil || len(f.blocks) == 0 {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i < len(parts); i++ {
+		if matched, excluded := f.decide(parts[:i], true); matched && excluded && !f.descend(parts[:i]) {
+			return true
+		}
+	}
+	for i := len(parts); i > 0; i-- {
+		if matched, excluded := f.decide(parts[:i], isDir || i < len(parts)); matched {
+			return excluded
+		}
+	}
+	return false
+}
+
+// Descend reports whether the excluded directory rel still has to be walked
+// because a pattern of an include Rule could match something inside it.
+// Negations in exclude Rules do not count, so as in git they cannot
+// re-include anything below an excluded directory.
+func (f *Filter) Descend(rel string) bool {
+	if f == nil {
+		return false
+	}
+	return f.descend(strings.Split(filepath.ToSlash(rel), "/"))
+}
+
+func (f *Filter) descend(parts []string) bool {
+	for _, b := range f.blocks {
+		for _, r := range b.rules {
+			if b.include && !r.negate && matchBelow(r.segs, parts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decide applies the first block with a matching pattern.
+func (f *Filter) decide(parts []string, isDir bool) (matched, excluded bool) {
+	for _, b := range f.blocks {
+		if m, neg := b.match(parts, isDir); m {
+			return true, b.include == neg
+		}
+	}
+	return false, false
+}
+
+// match returns whether any pattern matched, and whether the last one to
+// match was negated.
+func (b filterBlock) match(parts []string, isDir bool) (matched, negated bool) {
+	for _, r := range b.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchSegs(r.segs, parts) {
+			matched, negated = true, r.negate
+		}
+	}
+	return matched, negated
+}
+
+func matchSegs(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				return len(name) > 0 // "x/**" matches inside x, not x itself
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegs(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchBelow reports whether pat could match a path strictly below name.
+func matchBelow(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" || len(name) == 0 {
+			return true
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return false
+}
+
+// ReadExcludeFile returns the lines of a .gitignore-style file, for
+// Options.Excludes or a Rule. Comments and blank lines are kept; they are
+// skipped when compiling.
+func ReadExcludeFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lines = append(lines, strings.TrimSuffix(sc.Text(), "\r"))
+	}
+	return lines, sc.Err()
+}
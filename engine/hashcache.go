@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/* =========================
+        CHECKSUM CACHE
+========================= */
+
+// With Options.Checksum and Options.ChecksumCache set, file hashes are kept
+// between runs: one cache file per tree (SRC and DST each) in the
+// ChecksumCache directory, named after the tree's absolute path and the
+// algorithm (Options.ChecksumAlgo), which is also recorded inside. An entry
+// is keyed by the path relative to the tree and is reused while the file's
+// size, mtime and file ID (device and inode on Unix, volume serial number
+// and file index on Windows) are unchanged; otherwise the file is hashed
+// again. When the cache is saved, entries whose file has gone or changed
+// are dropped. An unreadable or outdated cache file is ignored and
+// rewritten, and nothing is written under DryRun. RebuildChecksumCache
+// rehashes a whole tree.
+
+const checksumCacheVersion = 1
+
+type hashCacheFile struct {
+	Version int                       `json:"version"`
+	Root    string                    `json:"root"`
+	Algo    string                    `json:"algo"`
+	Files   map[string]hashCacheEntry `json:"files"`
+}
+
+type hashCacheEntry struct {
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"` // Unix nanoseconds
+	Dev   uint64 `json:"dev,omitempty"`
+	Ino   uint64 `json:"ino,omitempty"`
+	Sum   string `json:"sum"` // hex
+}
+
+// sameMeta reports whether e still describes the file it was taken from.
+func (e hashCacheEntry) sameMeta(o hashCacheEntry) bool {
+	return e.Size == o.Size && e.Mtime == o.Mtime && e.Dev == o.Dev && e.Ino == o.Ino
+}
+
+// cacheEntryOf is the metadata part of the entry for the file at path.
+func cacheEntryOf(path string, fi fs.FileInfo) hashCacheEntry {
+	dev, ino := fileID(path, fi)
+	return hashCacheEntry{Size: fi.Size(), Mtime: fi.ModTime().UnixNano(), Dev: dev, Ino: ino}
+}
+
+// hashCache is the loaded cache of one tree.
+type hashCache struct {
+	file string // cache file
+	root string // absolute tree root
+	algo string // Hasher name
+
+	mu    sync.Mutex
+	files map[string]hashCacheEntry
+	used  map[string]bool // looked up or added this run
+	dirty bool
+}
+
+// DefaultChecksumCache is the directory the CLI keeps checksum caches in,
+// under the user cache directory.
+func DefaultChecksumCache() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "syncdir", "checksums"), nil
+}
+
+// checksumCacheFile is the cache file for the tree at root and algorithm
+// algo inside dir.
+func checksumCacheFile(dir, root, algo string) (file, absRoot string) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root
+	}
+	sum := sha1.Sum([]byte(absRoot))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+"-"+algo+".json"), absRoot
+}
+
+func newHashCache(dir, root, algo string) *hashCache {
+	file, absRoot := checksumCacheFile(dir, root, algo)
+	return &hashCache{file: file, root: absRoot, algo: algo, files: map[string]hashCacheEntry{}, used: map[string]bool{}}
+}
+
+// openHashCache loads the cache of the tree at root; nil when dir is "".
+func openHashCache(dir, root, algo string) (*hashCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	c := newHashCache(dir, root, algo)
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cf hashCacheFile
+	if json.Unmarshal(data, &cf) != nil || cf.Version != checksumCacheVersion || cf.Algo != algo || cf.Root != c.root {
+		c.dirty = true // start over
+		return c, nil
+	}
+	if cf.Files != nil {
+		c.files = cf.Files
+	}
+	return c, nil
+}
+
+// sum returns the hash of path, whose metadata is fi, from the cache when
+// it is still valid. A nil cache always hashes. h must be the cache's
+// algorithm.
+func (c *hashCache) sum(path string, fi fs.FileInfo, h Hasher, opt options) ([]byte, error) {
+	if c == nil {
+		return fileSum(path, h, opt)
+	}
+	key, ok := c.key(path)
+	if !ok {
+		return fileSum(path, h, opt)
+	}
+	e := cacheEntryOf(path, fi)
+	c.mu.Lock()
+	old, found := c.files[key]
+	c.used[key] = true
+	c.mu.Unlock()
+	if found && old.sameMeta(e) {
+		if sum, err := hex.DecodeString(old.Sum); err == nil && len(sum) == h.New().Size() {
+			return sum, nil
+		}
+	}
+	sum, err := fileSum(path, h, opt)
+	if err != nil {
+		return nil, err
+	}
+	e.Sum = hex.EncodeToString(sum)
+	c.mu.Lock()
+	c.files[key] = e
+	c.dirty = true
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// forget drops the entry of path, which is about to be overwritten.
+func (c *hashCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	if key, ok := c.key(path); ok {
+		c.mu.Lock()
+		if _, found := c.files[key]; found {
+			delete(c.files, key)
+			c.dirty = true
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *hashCache) key(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(c.root, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// save drops stale entries and writes the cache if anything changed.
+func (c *hashCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.files {
+		if c.used[key] {
+			continue
+		}
+		path := filepath.Join(c.root, filepath.FromSlash(key))
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.Mode().IsRegular() || !cacheEntryOf(path, fi).sameMeta(e) {
+			delete(c.files, key)
+			c.dirty = true
+		}
+	}
+	if !c.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(hashCacheFile{Version: checksumCacheVersion, Root: c.root, Algo: c.algo, Files: c.files})
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.file); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// withHashCaches loads the caches of both trees for a --checksum run.
+func (o options) withHashCaches(src, dst string) (options, error) {
+	if !o.Checksum || o.ChecksumCache == "" {
+		return o, nil
+	}
+	algo := o.hasher().Name()
+	var err error
+	if o.srcSums, err = openHashCache(o.ChecksumCache, src, algo); err != nil {
+		return o, err
+	}
+	if o.dstSums, err = openHashCache(o.ChecksumCache, dst, algo); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// saveHashCaches writes the caches back, except under DryRun.
+func (o options) saveHashCaches() error {
+	if o.DryRun {
+		return nil
+	}
+	if err := o.srcSums.save(); err != nil {
+		return err
+	}
+	return o.dstSums.save()
+}
+
+// RebuildChecksumCache hashes every regular file under root and replaces
+// the tree's cache in Options.ChecksumCache with the result. Uses
+// ChecksumAlgo and BwLimit; it returns the number of files hashed.
+func (s *Syncer) RebuildChecksumCache(root string) (int, error) {
+	if s.opt.ChecksumCache == "" {
+		return 0, wrapf(ErrInvalidOption, "ChecksumCache is not set")
+	}
+	root = filepath.Clean(root)
+	if fi, err := os.Stat(root); err != nil {
+		if os.IsNotExist(err) {
+			return 0, wrapf(ErrSrcNotExist, "%s", root)
+		}
+		return 0, err
+	} else if !fi.IsDir() {
+		return 0, wrapf(ErrInvalidOption, "not a directory: %s", root)
+	}
+	h, err := LookupHasher(s.opt.ChecksumAlgo)
+	if err != nil {
+		return 0, err
+	}
+	c := newHashCache(s.opt.ChecksumCache, root, h.Name())
+	c.dirty = true
+	opt := options{limit: newLimiter(s.opt.BwLimit)}
+	n := 0
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || isTempName(d.Name()) {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if _, err := c.sum(path, fi, h, opt); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, c.save()
+}
@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* =========================
+       HASH ALGORITHMS
+========================= */
+
+// Options.ChecksumAlgo picks the algorithm for every content hash a run
+// takes: --checksum comparisons, the checksum cache (whose files record the
+// algorithm's name) and the verification after a --delta update. Built in
+// are sha1 (the default), sha256, crc32c and xxh64, a fast
+// non-cryptographic 64-bit hash. RegisterHasher adds more.
+
+// DefaultChecksumAlgo is used when Options.ChecksumAlgo is "".
+const DefaultChecksumAlgo = "sha1"
+
+// Hasher is a checksum algorithm.
+type Hasher interface {
+	Name() string   // stored with persisted hashes, e.g. "sha256"
+	New() hash.Hash // a fresh hash state
+}
+
+type hasherFunc struct {
+	name string
+	fn   func() hash.Hash
+}
+
+func (h hasherFunc) Name() string   { return h.name }
+func (h hasherFunc) New() hash.Hash { return h.fn() }
+
+// NewHasher makes a Hasher for RegisterHasher from a constructor.
+func NewHasher(name string, fn func() hash.Hash) Hasher {
+	return hasherFunc{name: name, fn: fn}
+}
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[string]Hasher{}
+)
+
+func init() {
+	crc32c := crc32.MakeTable(crc32.Castagnoli)
+	RegisterHasher(NewHasher("sha1", sha1.New))
+	RegisterHasher(NewHasher("sha256", sha256.New))
+	RegisterHasher(NewHasher("crc32c", func() hash.Hash { return crc32.New(crc32c) }))
+	RegisterHasher(NewHasher("xxh64", func() hash.Hash { return newXXH64() }))
+}
+
+// RegisterHasher makes h available to Options.ChecksumAlgo under h.Name(),
+// replacing an algorithm of the same name.
+func RegisterHasher(h Hasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[strings.ToLower(h.Name())] = h
+}
+
+// LookupHasher returns the algorithm called name ("" for the default).
+func LookupHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DefaultChecksumAlgo
+	}
+	hashersMu.RLock()
+	h, ok := hashers[strings.ToLower(name)]
+	hashersMu.RUnlock()
+	if !ok {
+		return nil, wrapf(ErrInvalidOption, "unknown checksum algorithm %q (have %s)", name, strings.Join(HasherNames(), ", "))
+	}
+	return h, nil
+}
+
+// HasherNames lists the registered algorithms.
+func HasherNames() []string {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasher is the run's algorithm. ChecksumAlgo was validated up front.
+func (o options) hasher() Hasher {
+	h, err := LookupHasher(o.ChecksumAlgo)
+	if err != nil {
+		h, _ = LookupHasher(DefaultChecksumAlgo)
+	}
+	return h
+}
+
+// fileSum hashes path with h, reading at most as fast as opt.limit allows,
+// and counts the bytes in opt.stats.
+func fileSum(path string, h Hasher, opt options) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hh := h.New()
+	n, err := io.Copy(hh, opt.limit.reader(f))
+	opt.stats.addHashed(n)
+	if err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+/* ---------- xxh64 ---------- */
+
+// xxh64 is XXH64 with seed 0, streaming.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // bytes in buf
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func newXXH64() *xxh64 {
+	d := &xxh64{}
+	d.Reset()
+	return d
+}
+
+func (d *xxh64) Reset() {
+	p1, p2 := xxPrime1, xxPrime2 // variables: the sums wrap around
+	d.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	d.total, d.n = 0, 0
+}
+
+func (d *xxh64) Size() int      { return 8 }
+func (d *xxh64) BlockSize() int { return 32 }
+
+func xxRound(acc, in uint64) uint64 {
+	acc += in * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (d *xxh64) stripe(b []byte) {
+	for i := range d.v {
+		d.v[i] = xxRound(d.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (d *xxh64) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+	if d.n > 0 {
+		c := copy(d.buf[d.n:], b)
+		d.n += c
+		b = b[c:]
+		if d.n < len(d.buf) {
+			return n, nil
+		}
+		d.stripe(d.buf[:])
+		d.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		d.stripe(b)
+	}
+	d.n = copy(d.buf[:], b)
+	return n, nil
+}
+
+func (d *xxh64) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		v := d.v
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, x := range v {
+			h = xxMerge(h, x)
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += d.total
+
+	b := d.buf[:d.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (d *xxh64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, d.Sum64())
+}
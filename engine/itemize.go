@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"strings"
+)
+
+/* =========================
+       ITEMIZED CHANGES
+========================= */
+
+// Copy, meta and symlink events carry the attributes that made the entry
+// change as Event.Changes. Itemize renders an event as an rsync-style change
+// code, YXcstpogx: Y is the update ('>' a file is copied, 'c' a directory or
+// link is created, '.' only metadata changes, '*' a message such as
+// "*deleting"), X the entry type ('f', 'd' or 'L'), and each further
+// column is the letter of a changed attribute, '.' for an unchanged one, or
+// '+' throughout for a new entry.
+
+// Change is a set of attributes in which a DST entry differed from SRC.
+type Change uint8
+
+const (
+	ChangeChecksum Change = 1 << iota // c: content hash (or link target)
+	ChangeSize                        // s
+	ChangeTime                        // t: mtime
+	ChangePerms                       // p
+	ChangeOwner                       // o
+	ChangeGroup                       // g
+	ChangeXattr                       // x
+)
+
+var changeNames = []struct {
+	c      Change
+	letter byte
+	name   string
+}{
+	{ChangeChecksum, 'c', "checksum"},
+	{ChangeSize, 's', "size"},
+	{ChangeTime, 't', "time"},
+	{ChangePerms, 'p', "perms"},
+	{ChangeOwner, 'o', "owner"},
+	{ChangeGroup, 'g', "group"},
+	{ChangeXattr, 'x', "xattr"},
+}
+
+func (c Change) String() string {
+	var names []string
+	for _, n := range changeNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText makes Changes appear as e.g. "size,time" in JSON output.
+func (c Change) MarshalText() ([]byte, error) { return []byte(c.String()), nil }
+
+func (c *Change) UnmarshalText(b []byte) error {
+	*c = 0
+	for _, f := range strings.Split(string(b), ",") {
+		if f == "" {
+			continue
+		}
+		found := false
+		for _, n := range changeNames {
+			if n.name == f {
+				*c |= n.c
+				found = true
+			}
+		}
+		if !found {
+			return wrapf(ErrInvalidOption, "unknown change %q", f)
+		}
+	}
+	return nil
+}
+
+// columns renders the attribute columns of a change code.
+func (c Change) columns() string {
+	b := make([]byte, len(changeNames))
+	for i, n := range changeNames {
+		b[i] = '.'
+		if c&n.c != 0 {
+			b[i] = n.letter
+		}
+	}
+	return string(b)
+}
+
+// Itemize returns the change code of ev, or "" for event types that have
+// none. Unchanged entries (skip events) get blank attribute columns.
+func (ev Event) Itemize() string {
+	kind := byte('f')
+	if ev.Dir {
+		kind = 'd'
+	}
+	created := strings.Repeat("+", len(changeNames))
+	switch ev.Type {
+	case EventCopy:
+		if strings.HasPrefix(ev.Reason, "new") {
+			return ">f" + created
+		}
+		return ">f" + ev.Changes.columns()
+	case EventMkdir:
+		return "cd" + created
+	case EventSymlink:
+		if ev.Changes == 0 {
+			return "cL" + created
+		}
+		return "cL" + ev.Changes.columns()
+	case EventMeta:
+		return "." + string(kind) + ev.Changes.columns()
+	case EventSkip:
+		if ev.Reason != "same" {
+			return ""
+		}
+		if ev.Target != "" {
+			kind = 'L'
+		}
+		return "." + string(kind) + strings.Repeat(" ", len(changeNames))
+	case EventDelete:
+		return "*deleting"
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/* =========================
+          KEEP GOING
+========================= */
+
+// By default the first failure stops a Sync. With Options.KeepGoing a
+// failing entry is reported as an error event (Reason names the operation)
+// and the run carries on with the rest; Sync then returns a *PartialError
+// listing every failure. The mirror pass deletes nothing at or below a path
+// that failed, since an unreadable SRC directory or entry would make it look
+// deleted; a DST entry whose SRC counterpart cannot be checked is a failure
+// of its own, never a deletion. Validation errors, the deletion limits
+// and failures outside single entries (such as saving the hash cache)
+// still stop the run.
+
+// ErrPartial is wrapped by *PartialError.
+var ErrPartial = errors.New("partial transfer")
+
+// Operations a Failure can name.
+const (
+	OpScan   = "scan"   // reading a directory or an entry's metadata
+	OpMkdir  = "mkdir"  // creating a DST directory
+	OpCopy   = "copy"   // copying or updating a file
+	OpLink   = "link"   // handling a symlink in SRC
+	OpMeta   = "meta"   // syncing directory metadata (Preserve)
+	OpDelete = "delete" // a mirror deletion
+)
+
+// Failure is one entry a KeepGoing run could not sync.
+type Failure struct {
+	Op   string // OpCopy, OpDelete, ...
+	Path string // relative to the SRC/DST root
+	Dir  bool
+	Err  error
+}
+
+func (f Failure) Error() string {
+	return fmt.Sprintf("%s %s: %s", f.Op, f.Path, f.Reason())
+}
+
+// Reason is Err without the path it usually repeats, e.g.
+// "open: permission denied".
+func (f Failure) Reason() string { return failureCause(f.Err) }
+
+func (f Failure) Unwrap() error { return f.Err }
+
+// PartialError reports a KeepGoing run that finished with failures.
+type PartialError struct {
+	Failures []Failure // in the order they were reported
+	Skipped  int       // mirror deletions left out at or below failed paths
+}
+
+func (e *PartialError) Error() string {
+	msg := fmt.Sprintf("%v: %d failure(s)", ErrPartial, len(e.Failures))
+	if e.Skipped > 0 {
+		msg += fmt.Sprintf(", %d mirror deletion(s) skipped after failures", e.Skipped)
+	}
+	return msg
+}
+
+func (e *PartialError) Unwrap() error { return ErrPartial }
+
+// failureCause drops the path an *fs.PathError or *os.LinkError repeats,
+// e.g. "open: permission denied".
+func failureCause(err error) string {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Op + ": " + pe.Err.Error()
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return le.Op + ": " + le.Err.Error()
+	}
+	return err.Error()
+}
+
+// failureLog collects the failures of a KeepGoing run; workers add
+// concurrently. A nil *failureLog means KeepGoing is off.
+type failureLog struct {
+	mu       sync.Mutex
+	failures []Failure
+	paths    []string // failed entries, relative; mirrorTree spares them
+	skipped  int
+}
+
+// keepGoing records err for the entry rel and returns nil, so the caller
+// carries on; without KeepGoing it returns err unchanged.
+func (o options) keepGoing(op, rel string, dir bool, err error) error {
+	if err == nil || o.failed == nil {
+		return err
+	}
+	if errors.Is(err, ErrDeleteLimit) {
+		return err
+	}
+	l := o.failed
+	l.mu.Lock()
+	l.failures = append(l.failures, Failure{Op: op, Path: rel, Dir: dir, Err: err})
+	l.paths = append(l.paths, rel)
+	l.mu.Unlock()
+	o.emit(Event{Type: EventError, Path: rel, Dir: dir, Reason: op, Error: failureCause(err)})
+	return nil
+}
+
+// spares reports whether rel is, or is inside, an entry that failed.
+func (l *failureLog) spares(rel string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range l.paths {
+		if d == "." || rel == d || strings.HasPrefix(rel, d+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipDelete counts a mirror deletion left out by spares.
+func (l *failureLog) skipDelete() {
+	l.mu.Lock()
+	l.skipped++
+	l.mu.Unlock()
+}
+
+// err returns the run's *PartialError, or nil if nothing failed.
+func (l *failureLog) err() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.failures) == 0 {
+		return nil
+	}
+	return &PartialError{Failures: append([]Failure(nil), l.failures...), Skipped: l.skipped}
+}
@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+/* =========================
+          SYMLINKS
+========================= */
+
+// LinkMode selects how symbolic links inside SRC are handled. The SRC root
+// itself is always resolved.
+type LinkMode string
+
+const (
+	LinksCopy     LinkMode = "copy"     // copy file targets; skip directory links (default)
+	LinksPreserve LinkMode = "preserve" // recreate links as links
+	LinksSkip     LinkMode = "skip"     // ignore links entirely
+	LinksFollow   LinkMode = "follow"   // copy file targets and descend into directory links
+)
+
+// EventSymlink is reported when a link is (re)created under LinksPreserve.
+const EventSymlink = "symlink"
+
+func (m LinkMode) valid() bool {
+	switch m {
+	case "", LinksCopy, LinksPreserve, LinksSkip, LinksFollow:
+		return true
+	}
+	return false
+}
+
+func isSymlink(d fs.DirEntry) bool { return d.Type()&fs.ModeSymlink != 0 }
+
+// walkSrc walks src/sub like filepath.WalkDir, but hands fn the path
+// relative to src as well. Under LinksFollow, directory links are descended
+// into by walking their resolved target; a link whose target is the directory being
+// walked or one of its ancestors is passed to fn unresolved instead, which
+// is how loops are cut.
+func walkSrc(src, sub string, opt options, fn func(srcPath, rel string, d fs.DirEntry, err error) error) error {
+	start := filepath.Join(src, sub)
+	root, err := filepath.EvalSymlinks(start)
+	if err != nil {
+		root = start
+	}
+	return walkSrcAt(start, sub, []string{root}, opt, fn)
+}
+
+func walkSrcAt(root, prefix string, chain []string, opt options, fn func(string, string, fs.DirEntry, error) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		rel, _ := filepath.Rel(root, p)
+		if prefix != "" {
+			rel = filepath.Join(prefix, rel)
+		}
+		if err != nil || opt.Links != LinksFollow || !isSymlink(d) {
+			return fn(p, rel, d, err)
+		}
+		target, terr := filepath.EvalSymlinks(p)
+		ti, serr := os.Stat(target)
+		if terr != nil || serr != nil || !ti.IsDir() {
+			return fn(p, rel, d, nil)
+		}
+		for _, c := range chain {
+			if samePath(c, target) || isSubpath(c, target) {
+				return fn(p, rel, d, nil) // loop
+			}
+		}
+		return walkSrcAt(target, rel, append(chain[:len(chain):len(chain)], target), opt, fn)
+	})
+}
+
+// handleLink deals with a symlink found in SRC. It returns the target's
+// info when the link should be copied as a regular file, or nil when it has
+// been handled (preserved or skipped).
+func handleLink(srcPath, dstPath string, opt options) (fs.FileInfo, error) {
+	switch opt.Links {
+	case LinksSkip:
+		opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Reason: "symlink"})
+		return nil, nil
+	case LinksPreserve:
+		return nil, syncLink(srcPath, dstPath, opt)
+	}
+	ti, err := os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Reason: "dangling symlink"})
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ti.IsDir() {
+		reason := "dir symlink"
+		if opt.Links == LinksFollow {
+			reason = "symlink loop"
+		}
+		opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Dir: true, Reason: reason})
+		return nil, nil
+	}
+	return ti, nil
+}
+
+// syncLink makes dstPath a link with the same target as srcPath.
+func syncLink(srcPath, dstPath string, opt options) error {
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+	target = opt.linkTarget(target)
+	ev := Event{Type: EventSymlink, Src: srcPath, Dst: dstPath, Target: target, Reason: "new"}
+	if cur, err := os.Readlink(dstPath); err == nil {
+		if cur == target {
+			opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Target: target, Reason: "same"})
+			return nil
+		}
+		ev.Reason, ev.Changes = "changed", ChangeChecksum
+	}
+	if err := createLink(target, dstPath, opt); err != nil {
+		return err
+	}
+	opt.emit(ev)
+	return nil
+}
+
+// createLink creates the link under a temp name and renames it into place,
+// so an existing file or link at dstPath is replaced atomically.
+func createLink(target, dstPath string, opt options) error {
+	if opt.DryRun {
+		return nil
+	}
+	dir := filepath.Dir(dstPath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, tempPattern(dstPath))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dstPath); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// linkTarget rewrites an absolute target that points inside SRC to the
+// same place inside DST when RewriteAbsLinks is set.
+func (o options) linkTarget(target string) string {
+	if !o.RewriteAbsLinks || !filepath.IsAbs(target) || o.srcRoot == "" {
+		return target
+	}
+	absSrc, _ := filepath.Abs(o.srcRoot)
+	absDst, _ := filepath.Abs(o.dstRoot)
+	if !samePath(target, absSrc) && !isSubpath(target, absSrc) {
+		return target
+	}
+	rel, err := filepath.Rel(absSrc, target)
+	if err != nil {
+		return target
+	}
+	return filepath.Join(absDst, rel)
+}
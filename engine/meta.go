@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/* =========================
+          METADATA
+========================= */
+
+// Preserve is a set of metadata kinds to carry over from SRC to DST. Copied
+// files always get the source permissions and mtime; Preserve additionally
+// brings existing (unchanged) files and directories in line, and adds
+// ownership and extended attributes.
+type Preserve uint8
+
+const (
+	PreserveMode  Preserve = 1 << iota // permission bits, setuid/setgid/sticky
+	PreserveOwner                      // uid/gid (Unix)
+	PreserveTimes                      // mtime, including directories
+	PreserveXattr                      // extended attributes (Linux)
+
+	PreserveAll = PreserveMode | PreserveOwner | PreserveTimes | PreserveXattr
+)
+
+// EventMeta is reported when metadata of an existing entry is updated.
+// Reason lists the kinds that differed, e.g. "mode,times".
+const EventMeta = "meta"
+
+// EventWarning is reported once per run when ownership cannot be preserved
+// because the process may not chown (EPERM, usually: not root). The entry is
+// still copied; Reason is "owner" and Error the cause.
+const EventWarning = "warning"
+
+var preserveNames = []struct {
+	p    Preserve
+	name string
+}{
+	{PreserveMode, "mode"},
+	{PreserveOwner, "owner"},
+	{PreserveTimes, "times"},
+	{PreserveXattr, "xattr"},
+}
+
+// ParsePreserve parses a comma-separated list such as "mode,times" or "all".
+func ParsePreserve(s string) (Preserve, error) {
+	var p Preserve
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if f == "all" {
+			p |= PreserveAll
+			continue
+		}
+		found := false
+		for _, n := range preserveNames {
+			if n.name == f {
+				p |= n.p
+				found = true
+			}
+		}
+		if !found {
+			return 0, wrapf(ErrInvalidOption, "unknown --preserve kind %q", f)
+		}
+	}
+	return p, nil
+}
+
+func (p Preserve) String() string {
+	var names []string
+	for _, n := range preserveNames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText makes a Preserve appear as e.g. "mode,times" in plan files.
+func (p Preserve) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *Preserve) UnmarshalText(b []byte) error {
+	v, err := ParsePreserve(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+func (p Preserve) validate() error {
+	if p&PreserveOwner != 0 && !ownerSupported {
+		return wrapf(ErrInvalidOption, "preserving owner is not supported on this platform")
+	}
+	if p&PreserveXattr != 0 && !xattrSupported {
+		return wrapf(ErrInvalidOption, "preserving xattrs is not supported on this platform")
+	}
+	return nil
+}
+
+const modeMask = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// syncMeta makes dstPath's preserved metadata match srcInfo and reports
+// which kinds differed. Symlinks are left alone. Under DryRun nothing is
+// changed but the differences are still reported.
+func syncMeta(srcPath, dstPath string, si, di fs.FileInfo, opt options) error {
+	p := opt.Preserve
+	if p == 0 || si.Mode()&fs.ModeSymlink != 0 || di.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	var changed []string
+	var changes Change
+	apply := func(kind string, fn func() error) error {
+		changed = append(changed, kind)
+		if opt.DryRun {
+			return nil
+		}
+		if err := fn(); err != nil {
+			return fmt.Errorf("preserve %s: %w", kind, err)
+		}
+		return nil
+	}
+
+	// owner first: chown clears setuid/setgid, so mode has to come after it
+	if p&PreserveOwner != 0 {
+		su, sg, sok := ownerOf(si)
+		du, dg, dok := ownerOf(di)
+		if sok && dok && (su != du || sg != dg) {
+			if su != du {
+				changes |= ChangeOwner
+			}
+			if sg != dg {
+				changes |= ChangeGroup
+			}
+			err := apply("owner", func() error { return os.Lchown(dstPath, su, sg) })
+			if opt.chownDenied(dstPath, err) {
+				changed, changes = changed[:len(changed)-1], changes&^(ChangeOwner|ChangeGroup)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	if p&PreserveMode != 0 && si.Mode()&modeMask != di.Mode()&modeMask {
+		changes |= ChangePerms
+		if err := apply("mode", func() error { return os.Chmod(dstPath, si.Mode()&modeMask) }); err != nil {
+			return err
+		}
+	}
+	if p&PreserveXattr != 0 {
+		diff, err := xattrsDiffer(srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+		if diff {
+			changes |= ChangeXattr
+			if err := apply("xattr", func() error { return copyXattrs(srcPath, dstPath) }); err != nil {
+				return err
+			}
+		}
+	}
+	if p&PreserveTimes != 0 && !si.ModTime().Equal(di.ModTime()) {
+		changes |= ChangeTime
+		mt := si.ModTime()
+		if err := apply("times", func() error { return os.Chtimes(dstPath, mt, mt) }); err != nil {
+			return err
+		}
+	}
+
+	if len(changed) > 0 {
+		opt.emit(Event{Type: EventMeta, Src: srcPath, Dst: dstPath, Dir: si.IsDir(), Reason: strings.Join(changed, ","), Changes: changes})
+	}
+	return nil
+}
+
+// preserveOnTemp applies owner and xattrs to tmpPath, freshly written for
+// dstPath, before it is renamed into place. copyOneFile sets mode and mtime
+// itself, after this (chown may clear setuid/setgid).
+func preserveOnTemp(srcPath, tmpPath, dstPath string, si fs.FileInfo, opt options) error {
+	if opt.Preserve&PreserveOwner != 0 {
+		if uid, gid, ok := ownerOf(si); ok {
+			if err := os.Lchown(tmpPath, uid, gid); err != nil {
+				err = fmt.Errorf("preserve owner: %w", err)
+				if !opt.chownDenied(dstPath, err) {
+					return err
+				}
+			}
+		}
+	}
+	if opt.Preserve&PreserveXattr != 0 {
+		if err := copyXattrs(srcPath, tmpPath); err != nil {
+			return fmt.Errorf("preserve xattr: %w", err)
+		}
+	}
+	return nil
+}
+
+// chownDenied reports whether err is a chown refused with EPERM. The first
+// such refusal of the run is reported as an EventWarning for dstPath; the
+// caller then goes on without the owner instead of failing the entry.
+func (o options) chownDenied(dstPath string, err error) bool {
+	if !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	if o.stats == nil || o.stats.chownWarned.CompareAndSwap(false, true) {
+		o.emit(Event{Type: EventWarning, Dst: dstPath, Reason: "owner", Error: err.Error()})
+	}
+	return true
+}
+
+// dirMeta remembers a directory whose metadata is applied after the sync,
+// because writing its children changes its mtime.
+type dirMeta struct {
+	srcPath, dstPath string
+	info             fs.FileInfo
+}
+
+// newDirMeta stats d only when something is preserved.
+func newDirMeta(srcPath, dstPath string, d fs.DirEntry, opt options) (dirMeta, error) {
+	dm := dirMeta{srcPath: srcPath, dstPath: dstPath}
+	if opt.Preserve != 0 {
+		info, err := d.Info()
+		if err != nil {
+			return dm, err
+		}
+		dm.info = info
+	}
+	return dm, nil
+}
+
+// finishDirs applies preserved metadata to directories deepest-first.
+func finishDirs(dirs []dirMeta, opt options) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		di, err := os.Stat(d.dstPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // dry-run, or removed meanwhile
+		}
+		if err == nil {
+			err = syncMeta(d.srcPath, d.dstPath, d.info, di, opt)
+		}
+		if err = opt.keepGoing(OpMeta, opt.relPath(d.dstPath), true, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
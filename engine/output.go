@@ -0,0 +1,348 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* =========================
+          OUTPUT
+========================= */
+
+// Every action a Syncer takes is reported to its Reporter as an Event.
+// TextReporter renders events as the classic log lines; JSONReporter writes
+// one object per line. Both see exactly the same event stream.
+
+// Event types.
+const (
+	EventMkdir   = "mkdir"
+	EventCopy    = "copy"
+	EventSkip    = "skip"
+	EventExclude = "exclude"
+	EventDelete  = "delete"
+	EventCleanup = "cleanup"
+	EventError   = "error"
+	EventSummary = "summary"
+)
+
+// Event describes one action. Path is relative to the SRC/DST root.
+type Event struct {
+	Time      time.Time      `json:"time"`
+	Type      string         `json:"type"`
+	Path      string         `json:"path,omitempty"`
+	Src       string         `json:"src,omitempty"`
+	Dst       string         `json:"dst,omitempty"`
+	Dir       bool           `json:"dir,omitempty"`
+	Target    string         `json:"target,omitempty"` // symlink target
+	Size      int64          `json:"size,omitempty"`
+	Written   int64          `json:"written,omitempty"` // bytes actually written (< Size for delta updates)
+	Resumed   int64          `json:"resumed,omitempty"` // offset an interrupted copy resumed from
+	Backup    string         `json:"backup,omitempty"`  // where the previous version was saved (backup or trash)
+	Reason    string         `json:"reason,omitempty"`
+	Detail    string         `json:"detail,omitempty"`  // EventDiff: what differs
+	Changes   Change         `json:"changes,omitempty"` // copy/meta/symlink: attributes that differed (see Itemize)
+	DryRun    bool           `json:"dry_run,omitempty"`
+	ElapsedMs float64        `json:"elapsed_ms,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Counts    map[string]int `json:"counts,omitempty"` // summary only
+	Stats     *Stats         `json:"stats,omitempty"`  // summary only
+}
+
+// Reporter receives events. Calls are serialized by the Syncer, and events
+// arrive in walk order even when files are copied in parallel.
+type Reporter interface {
+	Report(ev Event)
+}
+
+// TextReporter reproduces the human log format. Real (non dry-run) mkdir,
+// copy and delete actions stay silent, as they always have.
+type TextReporter struct {
+	w       io.Writer
+	verbose bool
+	itemize bool
+}
+
+// NewTextReporter writes log lines to w; verbose adds skip/exclude lines.
+func NewTextReporter(w io.Writer, verbose bool) TextReporter {
+	return TextReporter{w: w, verbose: verbose}
+}
+
+// NewItemizeReporter is a TextReporter that prints every change, dry run or
+// not, as "CODE PATH" with the code from Event.Itemize; verbose adds the
+// unchanged entries. Other events are logged as by NewTextReporter.
+func NewItemizeReporter(w io.Writer, verbose bool) TextReporter {
+	return TextReporter{w: w, verbose: verbose, itemize: true}
+}
+
+func (r TextReporter) Report(ev Event) {
+	if r.itemize {
+		if code := ev.Itemize(); code != "" && (ev.Type != EventSkip || r.verbose) {
+			line := code + " " + ev.Path
+			if ev.Dir {
+				line += string(filepath.Separator)
+			}
+			if ev.Type == EventSymlink {
+				line += " -> " + ev.Target
+			}
+			_, _ = fmt.Fprintln(r.w, line)
+			return
+		}
+	}
+	line := ""
+	switch ev.Type {
+	case EventMkdir:
+		if ev.DryRun {
+			line = "[DRY] MKDIR " + ev.Dst
+		}
+	case EventCopy:
+		if ev.DryRun {
+			line = fmt.Sprintf("[DRY] COPY %s -> %s", ev.Src, ev.Dst)
+		} else if r.verbose && ev.Resumed > 0 {
+			line = fmt.Sprintf("resume (at %d bytes): %s", ev.Resumed, ev.Dst)
+		}
+	case EventSymlink:
+		if ev.DryRun {
+			line = fmt.Sprintf("[DRY] LINK %s -> %s", ev.Dst, ev.Target)
+		}
+	case EventMeta:
+		if ev.DryRun {
+			line = fmt.Sprintf("[DRY] META %s (%s)", ev.Dst, ev.Reason)
+		} else if r.verbose {
+			line = fmt.Sprintf("meta (%s): %s", ev.Reason, ev.Dst)
+		}
+	case EventSkip:
+		if r.verbose {
+			line = fmt.Sprintf("skip (%s): %s", ev.Reason, ev.Dst)
+		}
+	case EventExclude:
+		if r.verbose {
+			if ev.Reason == "mirror" {
+				line = "mirror-skip (excluded): " + ev.Path
+			} else {
+				line = "exclude: " + ev.Path
+			}
+		}
+	case EventDelete:
+		if ev.DryRun {
+			if ev.Dir {
+				line = "[DRY] RMDIR " + ev.Dst
+			} else {
+				line = "[DRY] DEL   " + ev.Dst
+			}
+		}
+	case EventCleanup:
+		if ev.DryRun {
+			line = fmt.Sprintf("[DRY] DEL   %s (%s)", ev.Dst, ev.Reason)
+		} else if r.verbose {
+			line = fmt.Sprintf("cleanup (%s): %s", ev.Reason, ev.Dst)
+		}
+	case EventBackup:
+		if ev.DryRun {
+			line = fmt.Sprintf("[DRY] BACKUP %s -> %s", ev.Dst, ev.Backup)
+		} else if r.verbose {
+			line = fmt.Sprintf("backup (%s): %s -> %s", ev.Reason, ev.Dst, ev.Backup)
+		}
+	case EventTrash:
+		switch {
+		case ev.Reason == "restored":
+			if ev.DryRun {
+				line = "[DRY] RESTORE " + ev.Dst
+			} else if r.verbose {
+				line = "restore: " + ev.Dst
+			}
+		case ev.DryRun:
+			line = fmt.Sprintf("[DRY] TRASH %d entries -> %s", ev.Size, ev.Dst)
+		default:
+			line = fmt.Sprintf("trash: %d item(s) moved to %s (undo: syncdir restore %q)", ev.Size, ev.Dst, ev.Dst)
+		}
+	case EventError:
+		if ev.Reason != "" { // a KeepGoing failure; a fatal error is the caller's to print
+			line = fmt.Sprintf("error (%s): %s", ev.Reason, ev.Path)
+			if ev.Dir {
+				line += string(filepath.Separator)
+			}
+			line += ": " + ev.Error
+		}
+	case EventWarning:
+		line = fmt.Sprintf("warning (%s): %s: %s", ev.Reason, ev.Path, ev.Error)
+	case EventRefuse:
+		line = fmt.Sprintf("refuse: %s (%s)", ev.Dst, ev.Reason)
+	case EventConflict:
+		line = fmt.Sprintf("conflict: %s (%s)", ev.Path, ev.Reason)
+	case EventDiff:
+		line = fmt.Sprintf("%s: %s", ev.Reason, ev.Path)
+		if ev.Dir {
+			line += string(filepath.Separator)
+		}
+		if ev.Detail != "" {
+			line += " (" + ev.Detail + ")"
+		}
+	case EventWatch:
+		switch {
+		case ev.Reason == "ready":
+			line = fmt.Sprintf("watching %s -> %s", ev.Src, ev.Dst)
+		case !r.verbose:
+		case ev.Reason == "batch":
+			line = fmt.Sprintf("watch: syncing %d changed path(s)", ev.Size)
+		default:
+			line = "watch: " + ev.Reason
+		}
+	case EventSummary:
+		if ev.DryRun {
+			line = "[DRY-RUN] no changes were made."
+		}
+	}
+	// errors are returned to the caller, which decides how to print them
+	if line != "" {
+		_, _ = fmt.Fprintln(r.w, line)
+	}
+}
+
+// JSONReporter writes each event as one JSON object per line.
+type JSONReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{enc: json.NewEncoder(w)}
+}
+
+func (r *JSONReporter) Report(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.enc.Encode(ev)
+}
+
+// tally counts events on their way to the real Reporter so the run can end
+// with a summary event and a Result.
+type tally struct {
+	mu     sync.Mutex
+	next   Reporter
+	start  time.Time
+	counts map[string]int
+	bytes  int64
+	data   runStats // byte and scan counters, see options.stats
+}
+
+func newTally(next Reporter) *tally {
+	return &tally{next: next, start: time.Now(), counts: map[string]int{}}
+}
+
+func (t *tally) Report(ev Event) {
+	t.mu.Lock()
+	t.counts[ev.Type]++
+	if ev.Type == EventCopy {
+		t.bytes += ev.Size
+	}
+	t.mu.Unlock()
+	t.next.Report(ev)
+}
+
+func (t *tally) summary(dryRun bool) Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int, len(t.counts))
+	for k, v := range t.counts {
+		counts[k] = v
+	}
+	st := t.stats()
+	return Event{
+		Time:      time.Now(),
+		Type:      EventSummary,
+		Size:      t.bytes,
+		DryRun:    dryRun,
+		ElapsedMs: msSince(t.start),
+		Counts:    counts,
+		Stats:     &st,
+	}
+}
+
+// eventBuf holds one walk entry's events until orderedEvents releases them.
+type eventBuf struct{ events []Event }
+
+func (b *eventBuf) Report(ev Event) { b.events = append(b.events, ev) }
+
+// orderedEvents forwards per-entry event buffers in sequence order. Entries
+// that finish early are held until every lower sequence number is out. To
+// bound what is held behind one slow entry, reserve hands out at most
+// window sequence numbers beyond the oldest one not yet forwarded.
+type orderedEvents struct {
+	mu      sync.Mutex
+	moved   *sync.Cond // signalled when next advances
+	rep     Reporter
+	window  int
+	next    int // oldest sequence number not yet forwarded
+	seq     int // next sequence number to hand out
+	pending map[int][]Event
+}
+
+// orderWindow is the window copyTree uses: a few thousand buffered entries
+// at most, however long a single large file takes.
+const orderWindow = 4096
+
+func newOrderedEvents(rep Reporter, window int) *orderedEvents {
+	o := &orderedEvents{rep: rep, window: window, pending: map[int][]Event{}}
+	o.moved = sync.NewCond(&o.mu)
+	return o
+}
+
+// reserve returns the next sequence number, waiting while window numbers
+// are already outstanding. Every number handed out must reach done.
+func (o *orderedEvents) reserve() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.seq-o.next >= o.window {
+		o.moved.Wait()
+	}
+	o.seq++
+	return o.seq - 1
+}
+
+func (o *orderedEvents) done(seq int, evs []Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending[seq] = evs
+	for {
+		evs, ok := o.pending[o.next]
+		if !ok {
+			return
+		}
+		delete(o.pending, o.next)
+		for _, ev := range evs {
+			o.rep.Report(ev)
+		}
+		o.next++
+		o.moved.Broadcast()
+	}
+}
+
+// flush forwards whatever is still pending (gaps left by an aborted walk).
+func (o *orderedEvents) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seqs := make([]int, 0, len(o.pending))
+	for s := range o.pending {
+		seqs = append(seqs, s)
+	}
+	sort.Ints(seqs)
+	for _, s := range seqs {
+		for _, ev := range o.pending[s] {
+			o.rep.Report(ev)
+		}
+	}
+	o.pending = map[int][]Event{}
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+type discard struct{}
+
+func (discard) Report(Event) {}
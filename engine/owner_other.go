@@ -0,0 +1,9 @@
+//go:build !unix
+
+package engine
+
+import "io/fs"
+
+const ownerSupported = false
+
+func ownerOf(fs.FileInfo) (uid, gid int, ok bool) { return 0, 0, false }
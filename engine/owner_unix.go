@@ -0,0 +1,18 @@
+//go:build unix
+
+package engine
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+const ownerSupported = true
+
+func ownerOf(fi fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
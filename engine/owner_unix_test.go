@@ -0,0 +1,22 @@
+//go:build unix
+
+package engine
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// ownedByForTest returns fi as if it belonged to uid.
+func ownedByForTest(fi fs.FileInfo, uid int) fs.FileInfo {
+	st := *fi.Sys().(*syscall.Stat_t)
+	st.Uid = uint32(uid)
+	return ownedInfo{fi, &st}
+}
+
+type ownedInfo struct {
+	fs.FileInfo
+	st *syscall.Stat_t
+}
+
+func (i ownedInfo) Sys() any { return i.st }
@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* =========================
+       RESUMABLE COPY
+========================= */
+
+// With Options.Partial, large files are written to a partial file that
+// survives an interrupted run. Every partialCheckpoint bytes the data is
+// fsynced and a small JSON sidecar records the offset together with the
+// source size and mtime. The next run resumes from that offset if the source
+// is unchanged, and starts over otherwise. When the copy completes the
+// partial file is renamed over the target, so DST still only ever sees
+// complete files.
+
+const (
+	partialSuffix = ".syncdir-partial"
+	partialMeta   = ".json"
+)
+
+// partialCheckpoint is both the fsync interval and the minimum file size for
+// which the partial mechanism is used; smaller files are simply recopied.
+var partialCheckpoint int64 = 8 << 20
+
+type partialState struct {
+	SrcSize  int64     `json:"src_size"`
+	SrcMtime time.Time `json:"src_mtime"`
+	Offset   int64     `json:"offset"` // bytes known to be on disk
+}
+
+// partialPath is where the partial data for dstPath lives: next to it as
+// ".<name>.syncdir-partial", or inside opt.PartialDir (a directory name,
+// created in the target's own directory).
+func partialPath(dstPath string, opt options) string {
+	dir, base := filepath.Split(dstPath)
+	if opt.PartialDir != "" {
+		return filepath.Join(dir, opt.PartialDir, base)
+	}
+	return filepath.Join(dir, "."+base+partialSuffix)
+}
+
+// isPartialName matches partial files and their sidecars.
+func isPartialName(name string) bool {
+	return strings.Contains(name, partialSuffix)
+}
+
+// isPartialDir reports whether d is a PartialDir inside DST (never synced,
+// never mirrored away).
+func isPartialDir(d fs.DirEntry, opt options) bool {
+	return opt.PartialDir != "" && d.IsDir() && d.Name() == opt.PartialDir
+}
+
+// copyResumable copies srcPath to dstPath through a partial file and returns
+// the offset it resumed from (0 for a fresh start).
+func copyResumable(srcPath, dstPath string, opt options) (int64, error) {
+	part := partialPath(dstPath, opt)
+	if err := os.MkdirAll(filepath.Dir(part), 0o755); err != nil {
+		return 0, err
+	}
+
+	sf, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer sf.Close()
+	si, err := sf.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	offset := resumeOffset(part, si)
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	pf, err := os.OpenFile(part, flags, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer pf.Close()
+	if err := pf.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := pf.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := sf.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	state := partialState{SrcSize: si.Size(), SrcMtime: si.ModTime(), Offset: offset}
+	buf := bufio.NewWriterSize(pf, 2<<20)
+	for {
+		n, err := io.CopyN(opt.copyWriter(buf), sf, partialCheckpoint)
+		state.Offset += n
+		opt.stats.transfer(n)
+		if err != nil && err != io.EOF {
+			return offset, err
+		}
+		if ferr := buf.Flush(); ferr != nil {
+			return offset, ferr
+		}
+		if serr := pf.Sync(); serr != nil {
+			return offset, serr
+		}
+		if werr := writePartialState(part, state); werr != nil {
+			return offset, werr
+		}
+		if err == io.EOF || n < partialCheckpoint {
+			break
+		}
+	}
+
+	if err := preserveOnTemp(srcPath, part, dstPath, si, opt); err != nil {
+		return offset, err
+	}
+	mode := si.Mode().Perm()
+	if opt.Preserve&PreserveMode != 0 {
+		mode = si.Mode() & modeMask
+	}
+	if err := pf.Chmod(mode); err != nil {
+		return offset, err
+	}
+	if err := pf.Close(); err != nil {
+		return offset, err
+	}
+	mt := si.ModTime()
+	if err := os.Chtimes(part, mt, mt); err != nil {
+		return offset, err
+	}
+	if err := os.Rename(part, dstPath); err != nil {
+		return offset, err
+	}
+	_ = os.Remove(part + partialMeta)
+	if opt.PartialDir != "" {
+		_ = os.Remove(filepath.Dir(part)) // only succeeds once empty
+	}
+	return offset, nil
+}
+
+// resumeOffset returns the checkpointed offset of an existing partial file
+// for si, or 0 if there is none or the source has changed since.
+func resumeOffset(part string, si fs.FileInfo) int64 {
+	b, err := os.ReadFile(part + partialMeta)
+	if err != nil {
+		return 0
+	}
+	var st partialState
+	if json.Unmarshal(b, &st) != nil {
+		return 0
+	}
+	if st.SrcSize != si.Size() || !st.SrcMtime.Equal(si.ModTime()) || st.Offset > si.Size() {
+		return 0
+	}
+	pi, err := os.Stat(part)
+	if err != nil || pi.Size() < st.Offset {
+		return 0
+	}
+	return st.Offset
+}
+
+func writePartialState(part string, st partialState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := part + partialMeta + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, part+partialMeta)
+}
+
+// validPartialDir accepts "" or a single path element other than "." / "..".
+func validPartialDir(name string) bool {
+	return name == "" || (name != "." && name != ".." && filepath.Base(name) == name && !strings.ContainsAny(name, `/\`))
+}
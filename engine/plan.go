@@ -0,0 +1,403 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/* =========================
+        PLAN / APPLY
+========================= */
+
+// A Plan is a reviewed dry-run: every mkdir/copy/delete a sync would do,
+// and under Preserve every metadata-only update, with the SRC and DST state
+// each decision was based on. Apply executes it
+// and refuses any operation whose recorded state no longer matches.
+
+const planVersion = 1
+
+// EventRefuse is reported by Apply for an operation whose preconditions no
+// longer hold; the operation is skipped.
+const EventRefuse = "refuse"
+
+// ErrPlanStale is returned by Apply when at least one operation was refused.
+var ErrPlanStale = errors.New("plan is stale")
+
+type Plan struct {
+	Version int         `json:"version"`
+	Created time.Time   `json:"created"`
+	Src     string      `json:"src"` // absolute
+	Dst     string      `json:"dst"` // absolute
+	Options PlanOptions `json:"options"`
+	Ops     []Op        `json:"ops"`
+}
+
+// PlanOptions records the options the plan was made with, for the reviewer.
+// Apply also honors Preserve for the entries it copies and creates, and the
+// Backup and Trash settings, so overwritten and deleted entries end up
+// where the dry run said they would.
+type PlanOptions struct {
+	Mirror       bool     `json:"mirror,omitempty"`
+	Checksum     bool     `json:"checksum,omitempty"`
+	ChecksumAlgo string   `json:"checksum_algo,omitempty"` // with Checksum
+	Rules        []Rule   `json:"rules,omitempty"`
+	Excludes     []string `json:"excludes,omitempty"`
+	Preserve     Preserve `json:"preserve,omitempty"`
+	Backup       bool     `json:"backup,omitempty"`
+	BackupDir    string   `json:"backup_dir,omitempty"`    // with Backup
+	BackupSuffix string   `json:"backup_suffix,omitempty"` // with Backup
+	Trash        bool     `json:"trash,omitempty"`
+	TrashDir     string   `json:"trash_dir,omitempty"` // with Trash
+}
+
+// Op is one planned operation. Path is slash-separated and relative to the
+// plan's Src/Dst. A nil Dst means DST must not exist when the op runs.
+type Op struct {
+	Type    string     `json:"op"` // EventMkdir, EventCopy, EventSymlink, EventMeta or EventDelete
+	Path    string     `json:"path"`
+	Dir     bool       `json:"dir,omitempty"`
+	Target  string     `json:"target,omitempty"` // EventSymlink
+	Reason  string     `json:"reason,omitempty"`
+	Changes Change     `json:"changes,omitempty"` // what differed in DST (see Itemize)
+	Src     *FileState `json:"src,omitempty"`
+	Dst     *FileState `json:"dst,omitempty"`
+	Tree    string     `json:"tree,omitempty"` // EventDelete of a directory: treeDigest of its content
+}
+
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func stateOf(fi fs.FileInfo) *FileState {
+	return &FileState{Size: fi.Size(), ModTime: fi.ModTime()}
+}
+
+func (f *FileState) matches(fi fs.FileInfo) bool {
+	return f.Size == fi.Size() && f.ModTime.Equal(fi.ModTime())
+}
+
+// Plan dry-runs a directory sync and records what it would do. The Syncer's
+// Reporter still sees the usual dry-run events.
+func (s *Syncer) Plan(src, dst string) (*Plan, error) {
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	if fi, err := os.Stat(src); err == nil && !fi.IsDir() {
+		return nil, wrapf(ErrInvalidOption, "plan needs a directory SRC: %s", src)
+	}
+	absSrc, _ := filepath.Abs(src)
+	absDst, _ := filepath.Abs(dst)
+
+	b := &planBuilder{next: s.reporter()}
+	opt := s.opt
+	opt.Recursive = true
+	opt.DryRun = true
+	opt.Reporter = b
+	if _, err := New(opt).Sync(src, dst); err != nil {
+		return nil, err
+	}
+	po := PlanOptions{Mirror: s.opt.Mirror, Checksum: s.opt.Checksum, Rules: s.opt.Rules, Excludes: s.opt.Excludes, Preserve: s.opt.Preserve}
+	if s.opt.Backup {
+		po.Backup, po.BackupDir, po.BackupSuffix = true, s.opt.BackupDir, s.opt.BackupSuffix
+	}
+	if s.opt.Trash {
+		po.Trash, po.TrashDir = true, s.opt.TrashDir
+	}
+	if po.Checksum {
+		po.ChecksumAlgo = options{Options: s.opt}.hasher().Name()
+	}
+	return &Plan{
+		Version: planVersion,
+		Created: time.Now(),
+		Src:     absSrc,
+		Dst:     absDst,
+		Options: po,
+		Ops:     b.ops,
+	}, b.err
+}
+
+// planBuilder turns dry-run events into Ops, stat-ing both sides as it goes.
+type planBuilder struct {
+	next Reporter
+	ops  []Op
+	err  error
+}
+
+func (b *planBuilder) Report(ev Event) {
+	b.next.Report(ev)
+	if b.err != nil {
+		return
+	}
+	op := Op{Type: ev.Type, Path: filepath.ToSlash(ev.Path), Dir: ev.Dir, Reason: ev.Reason, Changes: ev.Changes}
+	switch ev.Type {
+	case EventMkdir:
+	case EventCopy:
+		si, err := os.Stat(ev.Src)
+		if err != nil {
+			b.err = err
+			return
+		}
+		op.Src = stateOf(si)
+		if di, err := os.Lstat(ev.Dst); err == nil {
+			op.Dst = stateOf(di)
+		}
+	case EventSymlink:
+		si, err := os.Lstat(ev.Src)
+		if err != nil {
+			b.err = err
+			return
+		}
+		op.Src = stateOf(si)
+		op.Target = ev.Target
+		if di, err := os.Lstat(ev.Dst); err == nil {
+			op.Dst = stateOf(di)
+		}
+	case EventMeta:
+		si, err := os.Lstat(ev.Src)
+		if err != nil {
+			b.err = err
+			return
+		}
+		di, err := os.Lstat(ev.Dst)
+		if err != nil {
+			b.err = err
+			return
+		}
+		op.Src, op.Dst = stateOf(si), stateOf(di)
+	case EventDelete:
+		di, err := os.Lstat(ev.Dst)
+		if err != nil {
+			b.err = err
+			return
+		}
+		op.Dst = stateOf(di)
+		if di.IsDir() {
+			if op.Tree, err = treeDigest(ev.Dst); err != nil {
+				b.err = err
+				return
+			}
+		}
+	default:
+		return
+	}
+	b.ops = append(b.ops, op)
+}
+
+// WritePlan encodes p as indented JSON.
+func WritePlan(w io.Writer, p *Plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// ReadPlan decodes a plan written by WritePlan.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	var p Plan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Version != planVersion {
+		return nil, wrapf(ErrInvalidOption, "unsupported plan version %d (want %d)", p.Version, planVersion)
+	}
+	if p.Src == "" || p.Dst == "" {
+		return nil, wrapf(ErrInvalidOption, "plan has no src/dst")
+	}
+	return &p, nil
+}
+
+// Apply executes p in order. Each operation's preconditions are checked
+// right before it runs; failing ones are reported as EventRefuse and
+// skipped, and Apply then returns an error wrapping ErrPlanStale. Only
+// Options.DryRun, Partial/PartialDir, BwLimit and Reporter are used; the
+// preserve, backup and trash settings come from the plan (see PlanOptions).
+func (s *Syncer) Apply(p *Plan) (Result, error) {
+	if err := p.Options.Preserve.validate(); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+	t := newTally(s.reporter())
+	ao := Options{DryRun: s.opt.DryRun, Partial: s.opt.Partial, PartialDir: s.opt.PartialDir, Preserve: p.Options.Preserve}
+	ao.Backup, ao.BackupDir, ao.BackupSuffix = p.Options.Backup, p.Options.BackupDir, p.Options.BackupSuffix
+	ao.Trash, ao.TrashDir = p.Options.Trash, p.Options.TrashDir
+	opt := options{Options: ao, rep: t, stats: &t.data, dstRoot: p.Dst, limit: newLimiter(s.opt.BwLimit)}
+	opt = opt.withBackupRoot(t.start)
+	opt.trash = newTrashRun(p.Dst, ao)
+
+	refused := 0
+	var err error
+	var dirs []dirMeta // created directories, for their preserved metadata
+	for _, op := range p.Ops {
+		rel := filepath.FromSlash(op.Path)
+		if !filepath.IsLocal(rel) {
+			err = wrapf(ErrInvalidOption, "plan path escapes root: %q", op.Path)
+			break
+		}
+		srcPath := filepath.Join(p.Src, rel)
+		dstPath := filepath.Join(p.Dst, rel)
+
+		si, why := op.check(srcPath, dstPath)
+		if why != "" {
+			refused++
+			opt.emit(Event{Type: EventRefuse, Src: srcPath, Dst: dstPath, Dir: op.Dir, Reason: why})
+			continue
+		}
+		switch op.Type {
+		case EventMkdir:
+			if err = ensureDir(dstPath, opt); err == nil && opt.Preserve != 0 {
+				var info fs.FileInfo
+				if info, err = os.Stat(srcPath); err == nil {
+					dirs = append(dirs, dirMeta{srcPath: srcPath, dstPath: dstPath, info: info})
+				}
+			}
+		case EventCopy:
+			err = copyAndReport(srcPath, dstPath, si, op.Reason, op.Changes, opt)
+		case EventSymlink:
+			if err = createLink(op.Target, dstPath, opt); err == nil {
+				opt.emit(Event{Type: EventSymlink, Src: srcPath, Dst: dstPath, Target: op.Target, Reason: op.Reason, Changes: op.Changes})
+			}
+		case EventMeta:
+			var di fs.FileInfo
+			if di, err = os.Lstat(dstPath); err == nil {
+				err = syncMeta(srcPath, dstPath, si, di, opt)
+			}
+		case EventDelete:
+			err = removePath(dstPath, op.Dir, opt)
+		default:
+			err = wrapf(ErrInvalidOption, "unknown plan op %q", op.Type)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = finishDirs(dirs, opt)
+	}
+	reportTrash(0, opt)
+	if err != nil {
+		opt.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	} else if refused > 0 {
+		err = fmt.Errorf("%w: %d of %d operations refused", ErrPlanStale, refused, len(p.Ops))
+	}
+	sum := t.summary(opt.DryRun)
+	t.next.Report(sum)
+	return Result{Counts: sum.Counts, Bytes: sum.Size, Elapsed: time.Since(t.start), DryRun: opt.DryRun, Stats: *sum.Stats}, err
+}
+
+// check returns why op can no longer run as planned ("" if it can), plus
+// the current SRC info for copies.
+func (op Op) check(srcPath, dstPath string) (fs.FileInfo, string) {
+	di, dErr := os.Lstat(dstPath)
+	switch op.Type {
+	case EventMkdir:
+		if dErr == nil && !di.IsDir() {
+			return nil, "DST exists and is not a directory"
+		}
+		return nil, ""
+
+	case EventCopy:
+		si, err := os.Stat(srcPath)
+		if err != nil {
+			return nil, "SRC is gone"
+		}
+		if op.Src == nil || !op.Src.matches(si) {
+			return nil, "SRC changed since plan"
+		}
+		if op.Dst == nil {
+			if dErr == nil {
+				return nil, "DST appeared since plan"
+			}
+		} else if dErr != nil || !op.Dst.matches(di) {
+			return nil, "DST changed since plan"
+		}
+		return si, ""
+
+	case EventSymlink:
+		si, err := os.Lstat(srcPath)
+		if err != nil {
+			return nil, "SRC is gone"
+		}
+		if op.Src == nil || !op.Src.matches(si) {
+			return nil, "SRC changed since plan"
+		}
+		if op.Dst == nil {
+			if dErr == nil {
+				return nil, "DST appeared since plan"
+			}
+		} else if dErr != nil || !op.Dst.matches(di) {
+			return nil, "DST changed since plan"
+		}
+		return nil, ""
+
+	case EventMeta:
+		si, err := os.Lstat(srcPath)
+		if err != nil {
+			return nil, "SRC is gone"
+		}
+		if op.Src == nil || !op.Src.matches(si) {
+			return nil, "SRC changed since plan"
+		}
+		if dErr != nil {
+			return nil, "DST is gone"
+		}
+		// a directory's mtime moves with the copies into it, which come first
+		if di.IsDir() != op.Dir || (!op.Dir && (op.Dst == nil || !op.Dst.matches(di))) {
+			return nil, "DST changed since plan"
+		}
+		return si, ""
+
+	case EventDelete:
+		if _, err := os.Lstat(srcPath); err == nil {
+			return nil, "SRC now has this entry"
+		}
+		if dErr != nil {
+			return nil, "DST is gone"
+		}
+		if di.IsDir() != op.Dir || op.Dst == nil || !op.Dst.matches(di) {
+			return nil, "DST changed since plan"
+		}
+		if op.Tree != "" {
+			if tree, err := treeDigest(dstPath); err != nil || tree != op.Tree {
+				return nil, "DST content changed since plan"
+			}
+		}
+		return nil, ""
+	}
+	return nil, ""
+}
+
+// treeDigest hashes the path, type, size and mtime of every entry below
+// dir. A planned directory delete records it, so Apply refuses to remove a
+// subtree that gained, lost or changed entries after the review; the
+// directory's own mtime only covers its direct children.
+func treeDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		size := fi.Size()
+		if fi.IsDir() {
+			size = 0
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d\x00%d\n", filepath.ToSlash(rel), fi.Mode().Type(), size, fi.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* =========================
+          PROGRESS
+========================= */
+
+// With Options.Progress set, Sync first walks SRC to count the files and
+// bytes that pass the rules. During the run Progress is called every
+// Options.ProgressInterval from a single goroutine with the running totals,
+// and once more with Done set at the end. A file that turns out to be up to
+// date counts as done at once; a copied file advances as its data is
+// written.
+
+// Progress is a snapshot of a running Sync.
+type Progress struct {
+	Files      int           // files finished (copied or found up to date)
+	FilesTotal int           // files counted before the run
+	Bytes      int64         // bytes of finished files plus bytes written so far
+	BytesTotal int64         // size of the counted files
+	Current    string        // path, relative to DST, of the file most recently started
+	Elapsed    time.Duration // since the run started (including the count)
+	Rate       float64       // bytes per second, smoothed; 0 until known
+	ETA        time.Duration // estimated time left; 0 when unknown
+	Done       bool          // the final call of a run
+}
+
+const defaultProgressInterval = 250 * time.Millisecond
+
+// progress holds the counters of one run; meters for individual files add
+// to them concurrently.
+type progress struct {
+	files      atomic.Int64
+	bytes      atomic.Int64
+	filesTotal int
+	bytesTotal int64
+	start      time.Time
+
+	mu      sync.Mutex
+	current string
+}
+
+// startProgress counts the work under src and starts calling
+// Options.Progress. The returned function reports the final snapshot and
+// stops the ticker; it must be called exactly once.
+func startProgress(src, dst string, srcInfo fs.FileInfo, opt options) (*progress, func()) {
+	p := &progress{start: time.Now()}
+	if srcInfo.IsDir() {
+		p.filesTotal, p.bytesTotal = countTree(src, dst, opt)
+	} else {
+		p.filesTotal, p.bytesTotal = 1, srcInfo.Size()
+	}
+
+	interval := opt.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		var rate float64
+		lastBytes, lastTime := int64(0), p.start
+		for {
+			select {
+			case <-stop:
+				snap := p.snapshot(rate)
+				snap.Done = true
+				opt.Progress(snap)
+				return
+			case now := <-t.C:
+				b := p.bytes.Load()
+				if dt := now.Sub(lastTime).Seconds(); dt > 0 {
+					inst := float64(b-lastBytes) / dt
+					if rate == 0 {
+						rate = inst
+					} else {
+						rate = 0.3*inst + 0.7*rate
+					}
+				}
+				lastBytes, lastTime = b, now
+				opt.Progress(p.snapshot(rate))
+			}
+		}
+	}()
+	return p, func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (p *progress) snapshot(rate float64) Progress {
+	p.mu.Lock()
+	cur := p.current
+	p.mu.Unlock()
+	s := Progress{
+		Files:      int(p.files.Load()),
+		FilesTotal: p.filesTotal,
+		Bytes:      p.bytes.Load(),
+		BytesTotal: p.bytesTotal,
+		Current:    cur,
+		Elapsed:    time.Since(p.start),
+		Rate:       rate,
+	}
+	if left := s.BytesTotal - s.Bytes; rate > 0 && left > 0 {
+		s.ETA = time.Duration(float64(left) / rate * float64(time.Second))
+	}
+	return s
+}
+
+// begin marks rel as the current file and returns its meter.
+func (p *progress) begin(rel string) *meter {
+	p.mu.Lock()
+	p.current = rel
+	p.mu.Unlock()
+	return &meter{run: p}
+}
+
+// meter counts the bytes written for one file.
+type meter struct {
+	run *progress
+	n   int64
+}
+
+func (m *meter) add(n int64) {
+	if m != nil {
+		m.n += n
+		m.run.bytes.Add(n)
+	}
+}
+
+// done finishes the file: bytes not seen by the meter (a skip, a dry run,
+// the part a resumed copy did not rewrite) are added in one step.
+func (m *meter) done(size int64) {
+	if rest := size - m.n; rest > 0 {
+		m.run.bytes.Add(rest)
+	}
+	m.run.files.Add(1)
+}
+
+// writer returns w counting through m, or w itself when m is nil.
+func (m *meter) writer(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return meterWriter{w: w, m: m}
+}
+
+type meterWriter struct {
+	w io.Writer
+	m *meter
+}
+
+func (mw meterWriter) Write(b []byte) (int, error) {
+	n, err := mw.w.Write(b)
+	mw.m.add(int64(n))
+	return n, err
+}
+
+// copyWriter wraps the destination of a data copy with the file's meter
+// and the run's rate limit.
+func (o options) copyWriter(w io.Writer) io.Writer {
+	return o.limit.writer(o.meter.writer(w))
+}
+
+// track starts a meter for the file at dstPath when progress is on. The
+// returned function finishes it.
+func (o options) track(dstPath string, size int64) (options, func()) {
+	if o.prog == nil {
+		return o, func() {}
+	}
+	m := o.prog.begin(o.relPath(dstPath))
+	o.meter = m
+	return o, func() { m.done(size) }
+}
+
+// countTree counts the files under src that copyTree would hand to syncFile.
+// It is best effort: unreadable entries are left out rather than failing.
+func countTree(src, dst string, opt options) (files int, bytes int64) {
+	o, err := opt.withRoots(src, dst)
+	if err != nil {
+		return 0, 0
+	}
+	_ = walkSrc(src, "", o, func(srcPath, rel string, d fs.DirEntry, err error) error {
+		if err != nil || rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if isPartialDir(d, o) || (o.filter.Excluded(rel, true) && !o.filter.Descend(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isTempName(d.Name()) || isPartialName(d.Name()) || o.filter.Excluded(rel, false) {
+			return nil
+		}
+		var info fs.FileInfo
+		if isSymlink(d) {
+			if o.Links == LinksPreserve || o.Links == LinksSkip {
+				return nil
+			}
+			info, err = os.Stat(srcPath)
+		} else {
+			info, err = d.Info()
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	return files, bytes
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* =========================
+         STATISTICS
+========================= */
+
+// Every run keeps transfer statistics: the per-type event counts of its
+// tally plus byte counters fed by the copy, delta and hashing code. They
+// end up in Result.Stats and in the summary event (as "stats"), so a
+// library caller or a JSON consumer sees the same numbers the CLI prints
+// for --stats. Under DryRun nothing is read, written or hashed for copies;
+// Result.Bytes still says how much would have been copied.
+
+// Stats are the totals of one run.
+type Stats struct {
+	FilesScanned int           `json:"files_scanned"` // SRC files compared (not excluded)
+	FilesCopied  int           `json:"files_copied"`
+	FilesSkipped int           `json:"files_skipped"` // up to date, links skipped by Links, deletions spared by KeepGoing
+	Excluded     int           `json:"excluded"`      // entries excluded by the rules
+	Deleted      int           `json:"deleted"`       // entries removed (or trashed) by the mirror pass
+	DirsCreated  int           `json:"dirs_created"`
+	BytesRead    int64         `json:"bytes_read"`    // file data read to copy or update files
+	BytesWritten int64         `json:"bytes_written"` // file data written to DST
+	BytesHashed  int64         `json:"bytes_hashed"`  // data hashed for Checksum and Delta (cache hits cost nothing)
+	Errors       int           `json:"errors"`
+	Elapsed      time.Duration `json:"elapsed_ns"`
+}
+
+// Throughput is BytesWritten per second of Elapsed.
+func (s Stats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.BytesWritten) / s.Elapsed.Seconds()
+}
+
+// runStats are the counters the engine adds to while it works; workers add
+// concurrently. A nil *runStats counts nothing.
+type runStats struct {
+	scanned atomic.Int64
+	read    atomic.Int64
+	written atomic.Int64
+	hashed  atomic.Int64
+
+	chownWarned atomic.Bool // an EventWarning about EPERM from chown was sent
+}
+
+func (s *runStats) scan() {
+	if s != nil {
+		s.scanned.Add(1)
+	}
+}
+
+// transfer counts n bytes copied from SRC to DST.
+func (s *runStats) transfer(n int64) {
+	if s != nil {
+		s.read.Add(n)
+		s.written.Add(n)
+	}
+}
+
+func (s *runStats) addRead(n int64) {
+	if s != nil {
+		s.read.Add(n)
+	}
+}
+
+func (s *runStats) addWritten(n int64) {
+	if s != nil {
+		s.written.Add(n)
+	}
+}
+
+func (s *runStats) addHashed(n int64) {
+	if s != nil {
+		s.hashed.Add(n)
+	}
+}
+
+// stats combines the event counts with the byte counters. t.mu is held.
+func (t *tally) stats() Stats {
+	return Stats{
+		FilesScanned: int(t.data.scanned.Load()),
+		FilesCopied:  t.counts[EventCopy],
+		FilesSkipped: t.counts[EventSkip],
+		Excluded:     t.counts[EventExclude],
+		Deleted:      t.counts[EventDelete],
+		DirsCreated:  t.counts[EventMkdir],
+		BytesRead:    t.data.read.Load(),
+		BytesWritten: t.data.written.Load(),
+		BytesHashed:  t.data.hashed.Load(),
+		Errors:       t.counts[EventError],
+		Elapsed:      time.Since(t.start),
+	}
+}
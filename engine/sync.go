@@ -0,0 +1,685 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/* =========================
+         CORE LOGIC
+========================= */
+
+// errStopWalk is returned from the walk callback once a worker has failed,
+// so WalkDir stops queueing new work. It never reaches the caller.
+var errStopWalk = errors.New("walk stopped")
+
+func syncDir(src, dst string, opt options) error {
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+	opt, err := opt.withRoots(src, dst)
+	if err != nil {
+		return err
+	}
+
+	if err := sweepStaleTemps(dst, opt); err != nil {
+		return err
+	}
+	return syncSubtree(src, dst, "", opt)
+}
+
+// withRoots sets the SRC/DST roots and compiles the filter if needed.
+func (o options) withRoots(src, dst string) (options, error) {
+	o.srcRoot = src
+	o.dstRoot = dst
+	o = o.withBackupRoot(time.Now())
+	if o.trash == nil {
+		o.trash = newTrashRun(dst, o.Options)
+	}
+	if o.filter == nil {
+		fo := o.Options
+		fo.Rules = append(reservedRules(src, dst, fo), fo.Rules...)
+		f, err := compileFilter(fo)
+		if err != nil {
+			return o, err
+		}
+		o.filter = f
+	}
+	return o, nil
+}
+
+// syncSubtree runs both passes over sub ("" for everything), a path
+// relative to the roots that exists in SRC.
+func syncSubtree(src, dst, sub string, opt options) error {
+	// forward pass
+	dirs, err := copyTree(src, dst, sub, opt)
+	if err != nil {
+		return err
+	}
+
+	// mirror pass (copyTree has waited for every worker by now)
+	if opt.Mirror {
+		trashed := opt.trash.entries()
+		err := mirrorTree(src, dst, sub, opt)
+		reportTrash(trashed, opt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// directory metadata last: every write above bumps the parent's mtime
+	return finishDirs(dirs, opt)
+}
+
+// mirrorTree deletes entries under DST/sub that are not in SRC. They are
+// collected first, so the deletion limits are checked before anything is
+// removed.
+func mirrorTree(src, dst, sub string, opt options) error {
+	root := filepath.Join(dst, sub)
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return nil
+	}
+	var dels []pendingDelete
+	var count deleteCount
+	err := filepath.WalkDir(root, func(dstPath string, d fs.DirEntry, walkErr error) error {
+		rel, _ := filepath.Rel(dst, dstPath)
+		if walkErr != nil {
+			return opt.keepGoing(OpScan, rel, d == nil || d.IsDir(), walkErr)
+		}
+		if rel == "." || (!d.IsDir() && (isTempName(d.Name()) || isPartialName(d.Name()))) {
+			return nil
+		}
+		if isBackupName(d.Name(), opt) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil // an earlier run's backup; never mirrored away
+		}
+		if isPartialDir(d, opt) {
+			return fs.SkipDir
+		}
+		if opt.filter.Excluded(rel, d.IsDir()) {
+			opt.emit(Event{Type: EventExclude, Path: rel, Reason: "mirror", Dir: d.IsDir()})
+			if d.IsDir() && !opt.filter.Descend(rel) {
+				return fs.SkipDir
+			}
+			return nil // a descended dir is kept; included entries below it are checked
+		}
+		srcPath := filepath.Join(src, rel)
+		_, err := os.Lstat(srcPath)
+		if err == nil {
+			count.total++
+			return nil
+		}
+		if opt.failed.spares(rel) {
+			// SRC may only look empty here; leave DST alone
+			count.total++
+			opt.failed.skipDelete()
+			opt.emit(Event{Type: EventSkip, Dst: dstPath, Dir: d.IsDir(), Reason: "failed entry"})
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !notInSrc(err) {
+			// e.g. EACCES: SRC may well have the entry
+			count.total++
+			if err := opt.keepGoing(OpScan, rel, d.IsDir(), err); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		n, size, err := treeSize(dstPath, d)
+		if err != nil {
+			return opt.keepGoing(OpScan, rel, d.IsDir(), err)
+		}
+		dels = append(dels, pendingDelete{path: dstPath, dir: d.IsDir()})
+		count.entries += n
+		count.bytes += size
+		count.total += n
+		if d.IsDir() {
+			// 削除予定のディレクトリ配下には降りない（中身は treeSize で数えた）
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkDeleteLimit(dels, count, opt); err != nil {
+		return err
+	}
+	for _, del := range dels {
+		err := removePath(del.path, del.dir, opt)
+		if err = opt.keepGoing(OpDelete, opt.relPath(del.path), del.dir, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notInSrc reports whether an Lstat error means the entry is missing from
+// SRC, as opposed to SRC not being checkable.
+func notInSrc(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// copyTree walks SRC (or its subtree sub) and hands every regular file to a pool of opt.Parallel
+// workers. Directories are created inline by the walker, so a file's parent
+// always exists before its job is queued. Log lines are buffered per entry
+// and written in walk order regardless of which worker finishes first.
+// Under opt.Preserve it returns the directories, in walk order, for
+// finishDirs.
+func copyTree(src, dst, sub string, opt options) ([]dirMeta, error) {
+	workers := opt.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	out := newOrderedEvents(opt.reporter(), orderWindow)
+	defer out.flush()
+
+	type job struct {
+		seq              int
+		srcPath, dstPath string
+		info             fs.FileInfo
+	}
+	jobs := make(chan job, workers)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		failed   atomic.Bool
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			failed.Store(true)
+		})
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				var buf eventBuf
+				if !failed.Load() {
+					jopt := opt
+					jopt.rep = &buf
+					err := syncFile(j.srcPath, j.dstPath, j.info, jopt)
+					if err = jopt.keepGoing(OpCopy, opt.relPath(j.dstPath), false, err); err != nil {
+						fail(err)
+					}
+				}
+				out.done(j.seq, buf.events)
+			}
+		}()
+	}
+
+	var dirs []dirMeta
+	// excluded dirs walked for the sake of an include rule; created only
+	// once something inside them is included
+	var pending []dirMeta
+	mkdir := func(dm dirMeta, lopt options) error {
+		if err := ensureDir(dm.dstPath, lopt); err != nil {
+			return err
+		}
+		if opt.Preserve != 0 {
+			dirs = append(dirs, dm)
+		}
+		return nil
+	}
+	walkErr := walkSrc(src, sub, opt, func(srcPath, rel string, d fs.DirEntry, walkErr error) error {
+		if failed.Load() {
+			return errStopWalk
+		}
+		if walkErr != nil && opt.failed == nil {
+			return walkErr
+		}
+		var buf eventBuf
+		lopt := opt
+		lopt.rep = &buf
+		mySeq := out.reserve()
+
+		if walkErr != nil {
+			// KeepGoing: an unreadable directory is skipped (and spared by the mirror pass)
+			err := lopt.keepGoing(OpScan, rel, d == nil || d.IsDir(), walkErr)
+			out.done(mySeq, buf.events)
+			return err
+		}
+
+		if !d.IsDir() && (isTempName(d.Name()) || isPartialName(d.Name())) {
+			// another sync's in-flight temp or partial file; never worth copying
+			out.done(mySeq, nil)
+			return nil
+		}
+		if isPartialDir(d, opt) {
+			out.done(mySeq, nil)
+			return fs.SkipDir
+		}
+		dstPath := filepath.Join(dst, rel)
+		for len(pending) > 0 && !strings.HasPrefix(dstPath, pending[len(pending)-1].dstPath+string(os.PathSeparator)) {
+			pending = pending[:len(pending)-1] // left that subtree
+		}
+		if rel != "." && opt.filter.Excluded(rel, d.IsDir()) {
+			lopt.emit(Event{Type: EventExclude, Path: rel, Dir: d.IsDir()})
+			out.done(mySeq, buf.events)
+			if !d.IsDir() {
+				return nil
+			}
+			if !opt.filter.Descend(rel) {
+				return fs.SkipDir
+			}
+			dm, err := newDirMeta(srcPath, dstPath, d, opt)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, dm)
+			return nil
+		}
+		if rel != "." && isBackupName(d.Name(), opt) {
+			out.done(mySeq, buf.events)
+			return wrapf(ErrInvalidOption, "SRC entry %s ends in the backup suffix %q; choose another BackupSuffix, a BackupDir or exclude it", rel, opt.backupSuffix())
+		}
+		for _, dm := range pending {
+			if err := mkdir(dm, lopt); err != nil {
+				pending = pending[:0]
+				err = lopt.keepGoing(OpMkdir, opt.relPath(dm.dstPath), true, err)
+				out.done(mySeq, buf.events)
+				return err
+			}
+		}
+		pending = pending[:0]
+		if d.IsDir() {
+			dm, err := newDirMeta(srcPath, dstPath, d, opt)
+			if err == nil {
+				err = mkdir(dm, lopt)
+			}
+			if err != nil {
+				if err = lopt.keepGoing(OpMkdir, rel, true, err); err == nil {
+					err = fs.SkipDir // nothing below it could be written
+				}
+			}
+			out.done(mySeq, buf.events)
+			return err
+		}
+		opt.stats.scan()
+		var info fs.FileInfo
+		var err error
+		if isSymlink(d) {
+			info, err = handleLink(srcPath, dstPath, lopt)
+		} else {
+			info, err = d.Info()
+		}
+		if err != nil {
+			op := OpScan
+			if isSymlink(d) {
+				op = OpLink
+			}
+			err = lopt.keepGoing(op, rel, false, err)
+		}
+		if err != nil || info == nil {
+			out.done(mySeq, buf.events)
+			return err
+		}
+		jobs <- job{seq: mySeq, srcPath: srcPath, dstPath: dstPath, info: info}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if walkErr != nil && walkErr != errStopWalk {
+		return nil, walkErr
+	}
+	return dirs, nil
+}
+
+func ensureDir(path string, opt options) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		if opt.DryRun {
+			return nil
+		}
+		return os.MkdirAll(path, 0o755) // no-op for an existing dir, error for a file
+	}
+	if !opt.DryRun {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return err
+		}
+	}
+	opt.emit(Event{Type: EventMkdir, Dst: path, Dir: true})
+	return nil
+}
+
+func syncFile(srcPath, dstPath string, srcInfo fs.FileInfo, opt options) error {
+	opt, done := opt.track(dstPath, srcInfo.Size())
+	defer done()
+	reason := "new"
+	var changes Change
+	// Lstat: a link left at dstPath by --links=preserve gets replaced, not followed
+	if dstInfo, err := os.Lstat(dstPath); err == nil && dstInfo.Mode().IsRegular() {
+		changes, err = sameFile(srcPath, dstPath, srcInfo, dstInfo, opt)
+		if err != nil {
+			return err
+		}
+		if changes == 0 {
+			if err := syncMeta(srcPath, dstPath, srcInfo, dstInfo, opt); err != nil {
+				return err
+			}
+			opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Size: srcInfo.Size(), Reason: "same"})
+			return nil
+		}
+		reason = "changed"
+	}
+	return copyAndReport(srcPath, dstPath, srcInfo, reason, changes, opt)
+}
+
+// copyAndReport copies one file (unless dry-run) and emits its copy event,
+// which carries changes (what differed in an existing DST file). A changed
+// file goes through deltaCopy when Options.Delta is set; large files go
+// through copyResumable when Options.Partial is set.
+func copyAndReport(srcPath, dstPath string, srcInfo fs.FileInfo, reason string, changes Change, opt options) error {
+	start := time.Now()
+	ev := Event{Type: EventCopy, Src: srcPath, Dst: dstPath, Size: srcInfo.Size(), Reason: reason, Changes: changes}
+	if opt.Backup && reason == "changed" {
+		if err := backupFile(dstPath, opt.Delta, opt); err != nil {
+			return err
+		}
+	}
+	if !opt.DryRun {
+		full := true
+		if opt.Delta && reason == "changed" {
+			n, err := deltaCopy(srcPath, dstPath, srcInfo, opt)
+			switch {
+			case err == nil:
+				full = false
+				ev.Reason, ev.Written = "changed (delta)", n
+			case !errors.Is(err, errDeltaVerify) && !errors.Is(err, errDeltaOpen):
+				return err
+			}
+			// DST not writable or verification failed: fall through to a
+			// full atomic copy
+		}
+		switch {
+		case !full:
+		case opt.Partial && srcInfo.Size() > partialCheckpoint:
+			off, err := copyResumable(srcPath, dstPath, opt)
+			if err != nil {
+				return err
+			}
+			ev.Resumed, ev.Written = off, srcInfo.Size()-off
+			if off > 0 {
+				ev.Reason += " (resumed)"
+			}
+		default:
+			if err := copyOneFile(srcPath, dstPath, opt); err != nil {
+				return err
+			}
+			ev.Written = srcInfo.Size()
+		}
+	}
+	ev.ElapsedMs = msSince(start)
+	opt.emit(ev)
+	return nil
+}
+
+func copyOneFile(srcPath, dstPath string, opt options) error {
+	if opt.DryRun {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+
+	sf, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	si, err := sf.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 一時ファイルに書いてから rename で置き換える（途中で落ちても DST は壊れない）
+	df, err := os.CreateTemp(filepath.Dir(dstPath), tempPattern(dstPath))
+	if err != nil {
+		return err
+	}
+	tmpPath := df.Name()
+	ok := false
+	defer func() {
+		if !ok {
+			_ = df.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	buf := bufio.NewWriterSize(df, 2<<20)
+	n, err := io.Copy(opt.copyWriter(buf), sf)
+	opt.stats.transfer(n)
+	if err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := preserveOnTemp(srcPath, tmpPath, dstPath, si, opt); err != nil {
+		return err
+	}
+	mode := si.Mode().Perm()
+	if opt.Preserve&PreserveMode != 0 {
+		mode = si.Mode() & modeMask
+	}
+	if err := df.Chmod(mode); err != nil {
+		return err
+	}
+	if err := df.Sync(); err != nil {
+		return err
+	}
+	if err := df.Close(); err != nil {
+		return err
+	}
+
+	mt := si.ModTime()
+	if err := os.Chtimes(tmpPath, mt, mt); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
+
+// Temp files are named ".<base>.<random>.syncdir-tmp" next to the target so
+// the rename never crosses a filesystem and leftovers are easy to recognize.
+const tempSuffix = ".syncdir-tmp"
+
+func tempPattern(dstPath string) string {
+	return "." + filepath.Base(dstPath) + ".*" + tempSuffix
+}
+
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempSuffix)
+}
+
+// cleanupStaleTemps removes temp files for dstPath left behind by a crashed
+// run. syncDir sweeps the whole DST up front instead; this is for single-file
+// copies, where globbing the parent directory once is cheap.
+func cleanupStaleTemps(dstPath string, opt options) {
+	glob := "." + globEscape(filepath.Base(dstPath)) + ".*" + tempSuffix
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dstPath), glob))
+	for _, m := range matches {
+		removeStaleTemp(m, opt)
+	}
+}
+
+func removeStaleTemp(path string, opt options) {
+	if !opt.DryRun {
+		if err := os.Remove(path); err != nil {
+			return
+		}
+	}
+	opt.emit(Event{Type: EventCleanup, Dst: path, Reason: "stale temp"})
+}
+
+// sweepStaleTemps walks DST once and removes every leftover temp file.
+func sweepStaleTemps(dst string, opt options) error {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(dst, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !d.IsDir() && isTempName(d.Name()) {
+			removeStaleTemp(path, opt)
+		}
+		return nil
+	})
+}
+
+// globEscape quotes glob metacharacters in a literal file name.
+func globEscape(name string) string {
+	if runtime.GOOS == "windows" {
+		// '\' is the separator there, so filepath.Match has no escape character;
+		// '[' is the only metacharacter allowed in Windows file names.
+		return strings.ReplaceAll(name, "[", "[[]")
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func removePath(path string, isDir bool, opt options) error {
+	ev := Event{Type: EventDelete, Dst: path, Dir: isDir, Reason: "not in source"}
+	if opt.trash != nil {
+		to, err := trashRemoved(path, isDir, opt)
+		if err != nil {
+			return err
+		}
+		ev.Backup = to
+	} else if opt.Backup {
+		if err := backupRemoved(path, isDir, opt); err != nil {
+			return err
+		}
+	} else if !opt.DryRun {
+		rm := os.Remove
+		if isDir {
+			rm = os.RemoveAll
+		}
+		if err := rm(path); err != nil {
+			return err
+		}
+	}
+	opt.emit(ev)
+	return nil
+}
+
+// sameFile returns the attributes that make dstPath out of date; none
+// means it is the same as srcPath. Size and mtime (within a second) decide,
+// unless Options.Checksum is set: then the hashes do, and size and mtime
+// are only reported alongside a differing hash.
+func sameFile(srcPath, dstPath string, si, di fs.FileInfo, opt options) (Change, error) {
+	var c Change
+	if si.Size() != di.Size() {
+		c |= ChangeSize
+	}
+	if absDuration(si.ModTime().Sub(di.ModTime())) > time.Second {
+		c |= ChangeTime
+	}
+	if !opt.Checksum {
+		return c, nil
+	}
+	same, err := sameSum(srcPath, dstPath, si, di, opt)
+	if err != nil || same {
+		return 0, err
+	}
+	return c | ChangeChecksum, nil
+}
+
+// sameSum compares the hashes of both files. When they differ one of them
+// is about to be replaced, so neither cached hash is kept.
+func sameSum(srcPath, dstPath string, si, di fs.FileInfo, opt options) (bool, error) {
+	h := opt.hasher()
+	ssum, err := opt.srcSums.sum(srcPath, si, h, opt)
+	if err != nil {
+		return false, err
+	}
+	dsum, err := opt.dstSums.sum(dstPath, di, h, opt)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(ssum, dsum) {
+		opt.srcSums.forget(srcPath)
+		opt.dstSums.forget(dstPath)
+		return false, nil
+	}
+	return true, nil
+}
+
+/* =========================
+        HELPERS/UTIL
+========================= */
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// shouldExclude compiles patterns and checks one path; d may be nil for a
+// file. The sync passes use the Filter compiled once in syncDir instead.
+func shouldExclude(rel string, d fs.DirEntry, patterns []string) bool {
+	f, err := CompileFilter(patterns)
+	if err != nil {
+		return false
+	}
+	return f.Excluded(rel, d != nil && d.IsDir())
+}
+
+func isSubpath(child, parent string) bool {
+	c := strings.ToLower(filepath.Clean(child))
+	p := strings.ToLower(filepath.Clean(parent))
+	if c == p {
+		return false
+	}
+	rel, err := filepath.Rel(p, c)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+func samePath(a, b string) bool {
+	return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+}
+
+func wrapf(base error, format string, a ...any) error {
+	return fmt.Errorf("%w: %s", base, fmt.Sprintf(format, a...))
+}
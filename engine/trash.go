@@ -0,0 +1,364 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* =========================
+            TRASH
+========================= */
+
+// With Options.Trash, the mirror pass moves entries into a per-run trash
+// directory instead of deleting them: TrashDir/<run id>/files/<path>, with
+// TrashDir relative to the DST root unless absolute (default
+// ".syncdir-trash"). Each move is appended to TrashDir/<run id>/manifest.jsonl
+// before the next one starts, so an interrupted run can still be restored.
+// Restore puts a run back; PurgeTrash drops runs older than a given age.
+// Trash directories inside SRC or DST are excluded from the sync.
+
+const (
+	defaultTrashDir   = ".syncdir-trash"
+	trashManifest     = "manifest.jsonl"
+	trashFiles        = "files"
+	trashIDFormat     = "20060102-150405"
+	trashManifestPerm = 0o600
+)
+
+// EventTrash is reported once a mirror pass has moved entries to the
+// trash: Dst is the run's trash directory, Size the number of entries and
+// Reason the run id. Restore reports it per restored entry with Reason
+// "restored".
+const EventTrash = "trash"
+
+// ErrRestoreConflict is returned by Restore when some entries could not be
+// put back because their original path is taken again.
+var ErrRestoreConflict = errors.New("some trashed entries were not restored")
+
+// TrashEntry is one line of a trash manifest.
+type TrashEntry struct {
+	Path     string    `json:"path"`     // relative to the run's files directory
+	Original string    `json:"original"` // absolute DST path it was moved from
+	Dir      bool      `json:"dir,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Mtime    time.Time `json:"mtime"`
+	Trashed  time.Time `json:"trashed"`
+}
+
+// TrashRun is one run's trash directory and its manifest.
+type TrashRun struct {
+	ID      string
+	Dir     string
+	Created time.Time // time of the first trashed entry
+	Entries []TrashEntry
+}
+
+// trashRun is the trash of the current run; its directory is created with
+// the first entry.
+type trashRun struct {
+	base  string // TrashDir
+	start time.Time
+
+	mu    sync.Mutex
+	dir   string // base/<id>, once chosen
+	count int
+}
+
+func newTrashRun(dst string, o Options) *trashRun {
+	if !o.Trash || dst == "" {
+		return nil
+	}
+	return &trashRun{base: trashBase(dst, o), start: time.Now()}
+}
+
+// trashBase is the directory TrashDir stands for.
+func trashBase(dst string, o Options) string {
+	dir := o.TrashDir
+	if dir == "" {
+		dir = defaultTrashDir
+	}
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(dst, dir)
+}
+
+// runDir picks the run's directory: the start time, plus "-2", "-3"... if
+// an earlier run in the same second already used it.
+func (t *trashRun) runDir(dryRun bool) (string, error) {
+	if t.dir != "" {
+		return t.dir, nil
+	}
+	id := t.start.Format(trashIDFormat)
+	dir := filepath.Join(t.base, id)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			break
+		}
+		dir = filepath.Join(t.base, id+"-"+strconv.Itoa(n))
+	}
+	if !dryRun {
+		if err := os.MkdirAll(filepath.Join(dir, trashFiles), 0o755); err != nil {
+			return "", err
+		}
+	}
+	t.dir = dir
+	return dir, nil
+}
+
+// trashRemoved moves path, which the mirror pass is deleting, into the
+// run's trash and records it in the manifest.
+func trashRemoved(path string, isDir bool, opt options) (string, error) {
+	t := opt.trash
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dir, err := t.runDir(opt.DryRun)
+	if err != nil {
+		return "", err
+	}
+	rel := opt.relPath(path)
+	target := filepath.Join(dir, trashFiles, rel)
+	if !opt.DryRun {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		abs, _ := filepath.Abs(path)
+		if err := moveAside(path, target, isDir); err != nil {
+			return "", err
+		}
+		e := TrashEntry{Path: filepath.ToSlash(rel), Original: abs, Dir: isDir, Mtime: fi.ModTime(), Trashed: time.Now()}
+		if !isDir {
+			e.Size = fi.Size()
+		}
+		if err := appendManifest(dir, e); err != nil {
+			return "", err
+		}
+	}
+	t.count++
+	return target, nil
+}
+
+// reportTrash emits EventTrash when the trash has grown since before.
+func reportTrash(before int, opt options) {
+	t := opt.trash
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	n, dir := t.count-before, t.dir
+	t.mu.Unlock()
+	if n > 0 {
+		opt.emit(Event{Type: EventTrash, Path: filepath.Base(dir), Dst: dir, Size: int64(n), Reason: filepath.Base(dir)})
+	}
+}
+
+func (t *trashRun) entries() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+// moveAside renames from to to, creating to's parent; across filesystems
+// it copies and then removes from.
+func moveAside(from, to string, isDir bool) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	err := os.Rename(from, to)
+	var le *os.LinkError
+	if err == nil || !errors.As(err, &le) {
+		return err
+	}
+	if err := copyAside(from, to, isDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func appendManifest(dir string, e TrashEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, trashManifest), os.O_WRONLY|os.O_CREATE|os.O_APPEND, trashManifestPerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadTrashRun reads the manifest of the run directory dir.
+func ReadTrashRun(dir string) (*TrashRun, error) {
+	f, err := os.Open(filepath.Join(dir, trashManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	run := &TrashRun{ID: filepath.Base(dir), Dir: dir}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e TrashEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", f.Name(), line, err)
+		}
+		if run.Created.IsZero() || e.Trashed.Before(run.Created) {
+			run.Created = e.Trashed
+		}
+		run.Entries = append(run.Entries, e)
+	}
+	return run, sc.Err()
+}
+
+// ListTrash returns the runs in trashDir, oldest first. Directories without
+// a readable manifest are left out.
+func ListTrash(trashDir string) ([]TrashRun, error) {
+	des, err := os.ReadDir(trashDir)
+	if err != nil {
+		return nil, err
+	}
+	var runs []TrashRun
+	for _, d := range des {
+		if !d.IsDir() {
+			continue
+		}
+		run, err := ReadTrashRun(filepath.Join(trashDir, d.Name()))
+		if err != nil {
+			continue
+		}
+		if run.Created.IsZero() { // empty manifest: fall back to the directory's time
+			if fi, err := d.Info(); err == nil {
+				run.Created = fi.ModTime()
+			}
+		}
+		runs = append(runs, *run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Created.Before(runs[j].Created) })
+	return runs, nil
+}
+
+// Restore moves every entry of the trash run in runDir back to its original
+// path. An entry whose original path exists again is refused (EventRefuse)
+// and kept in the trash; Restore then returns an error wrapping
+// ErrRestoreConflict. Restored entries are dropped from the manifest, and
+// the run directory is removed once it is empty. Only Options.DryRun and
+// Reporter are used.
+func (s *Syncer) Restore(runDir string) (Result, error) {
+	t := newTally(s.reporter())
+	opt := options{Options: Options{DryRun: s.opt.DryRun}, rep: t, stats: &t.data}
+
+	run, err := ReadTrashRun(runDir)
+	var left []TrashEntry
+	if err == nil {
+		for i, e := range run.Entries {
+			from := filepath.Join(runDir, trashFiles, filepath.FromSlash(e.Path))
+			ev := Event{Type: EventTrash, Path: e.Path, Src: from, Dst: e.Original, Dir: e.Dir, Size: e.Size, Reason: "restored"}
+			if _, serr := os.Lstat(e.Original); serr == nil {
+				opt.emit(Event{Type: EventRefuse, Path: e.Path, Dst: e.Original, Dir: e.Dir, Reason: "original path exists"})
+				left = append(left, e)
+				continue
+			}
+			if _, serr := os.Lstat(from); serr != nil {
+				opt.emit(Event{Type: EventRefuse, Path: e.Path, Dst: e.Original, Dir: e.Dir, Reason: "missing from trash"})
+				left = append(left, e)
+				continue
+			}
+			if !opt.DryRun {
+				if err = moveAside(from, e.Original, e.Dir); err != nil {
+					left = append(left, run.Entries[i:]...)
+					break
+				}
+			}
+			opt.emit(ev)
+		}
+		if !opt.DryRun {
+			if werr := rewriteManifest(runDir, left); err == nil {
+				err = werr
+			}
+		}
+	}
+	if err != nil {
+		opt.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	} else if len(left) > 0 {
+		err = fmt.Errorf("%w: %d of %d kept in %s", ErrRestoreConflict, len(left), len(run.Entries), runDir)
+	}
+	sum := t.summary(opt.DryRun)
+	t.next.Report(sum)
+	return Result{Counts: sum.Counts, Bytes: sum.Size, Elapsed: time.Since(t.start), DryRun: opt.DryRun, Stats: *sum.Stats}, err
+}
+
+// rewriteManifest keeps only the entries still in the trash, or removes
+// the run directory when there are none.
+func rewriteManifest(runDir string, left []TrashEntry) error {
+	if len(left) == 0 {
+		return os.RemoveAll(runDir)
+	}
+	tmp := filepath.Join(runDir, trashManifest+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, trashManifestPerm)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range left {
+		if err := enc.Encode(e); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(runDir, trashManifest))
+}
+
+// PurgeTrash deletes the runs in trashDir created more than olderThan ago,
+// reporting each as an EventDelete. Only Options.DryRun and Reporter are
+// used.
+func (s *Syncer) PurgeTrash(trashDir string, olderThan time.Duration) (Result, error) {
+	t := newTally(s.reporter())
+	opt := options{Options: Options{DryRun: s.opt.DryRun}, rep: t, stats: &t.data, dstRoot: trashDir}
+
+	runs, err := ListTrash(trashDir)
+	cutoff := time.Now().Add(-olderThan)
+	for i := 0; err == nil && i < len(runs); i++ {
+		run := runs[i]
+		if !run.Created.Before(cutoff) {
+			continue
+		}
+		if !opt.DryRun {
+			if err = os.RemoveAll(run.Dir); err != nil {
+				break
+			}
+		}
+		opt.emit(Event{Type: EventDelete, Dst: run.Dir, Dir: true, Reason: "trash older than " + olderThan.String()})
+	}
+	if err != nil {
+		opt.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	}
+	sum := t.summary(opt.DryRun)
+	t.next.Report(sum)
+	return Result{Counts: sum.Counts, Bytes: sum.Size, Elapsed: time.Since(t.start), DryRun: opt.DryRun, Stats: *sum.Stats}, err
+}
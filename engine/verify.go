@@ -0,0 +1,411 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* =========================
+           VERIFY
+========================= */
+
+// Verify compares a DST tree with its SRC and changes nothing: every entry
+// that differs is reported as an EventDiff whose Reason says how. Entries
+// are compared the way cp -r would decide them (size, then mtime within a
+// second), by content hash under Options.Checksum, and by the metadata
+// kinds in Options.Preserve. Rules, Excludes and Links apply as for Sync;
+// temp and partial files and the default trash directory are never
+// reported. Neither are backups left by earlier Backup runs, whether or not
+// Options.Backup is set: DST entries ending in BackupSuffix ("~" if empty)
+// and, with BackupDir, that directory. With Options.Repair, missing and
+// differing entries are copied again (honoring DryRun, Backup and Delta);
+// entries only in DST and directories standing where a file belongs are
+// reported but left alone.
+
+// EventDiff is reported by Verify for an entry in which DST differs from
+// SRC; Reason is one of the Diff* kinds and Detail says what differs.
+const EventDiff = "diff"
+
+// Kinds of difference, reported as the Reason of an EventDiff.
+const (
+	DiffMissing = "missing" // in SRC, not in DST
+	DiffExtra   = "extra"   // in DST, not in SRC
+	DiffType    = "type"    // e.g. a file in SRC, a directory in DST
+	DiffSize    = "size"
+	DiffContent = "content" // hashes (or symlink targets) differ
+	DiffMeta    = "meta"    // Detail lists the kinds, e.g. "mode,times"
+)
+
+// ErrMismatch is returned by Verify when differences remain.
+var ErrMismatch = errors.New("DST does not match SRC")
+
+// Verify compares the directory trees src and dst. The error wraps
+// ErrMismatch when DST differs (after Repair, when something could not be
+// repaired); validation errors are those of Sync.
+func (s *Syncer) Verify(src, dst string) (Result, error) {
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	vopt := s.opt
+	vopt.Recursive = true
+	srcInfo, err := New(vopt).validate(src, dst)
+	if err == nil && !srcInfo.IsDir() {
+		err = wrapf(ErrInvalidOption, "verify needs a directory SRC: %s", src)
+	}
+	if err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+
+	t := newTally(s.reporter())
+	opt := options{Options: vopt, rep: t, stats: &t.data, limit: newLimiter(s.opt.BwLimit)}
+	// trash and backup directories from earlier runs are not part of the tree
+	fo := opt.Options
+	fo.Trash = true
+	fo.Backup = true
+	fo.Rules = append(reservedRules(src, dst, fo), fo.Rules...)
+	if opt.filter, err = compileFilter(fo); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+	if opt, err = opt.withRoots(src, dst); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+	if opt, err = opt.withHashCaches(src, dst); err != nil {
+		return Result{DryRun: s.opt.DryRun}, err
+	}
+
+	v := &verifier{opt: opt, src: src, dst: dst}
+	err = v.forward()
+	if err == nil {
+		err = v.extras()
+	}
+	if err == nil && opt.Repair {
+		err = finishDirs(v.dirs, opt)
+	}
+	if serr := opt.saveHashCaches(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		opt.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	} else if left := v.diffs - v.repaired; left > 0 {
+		if opt.Repair {
+			err = wrapf(ErrMismatch, "%d of %d difference(s) not repaired", left, v.diffs)
+		} else {
+			err = wrapf(ErrMismatch, "%d difference(s)", left)
+		}
+	}
+	sum := t.summary(opt.DryRun)
+	t.next.Report(sum)
+	return Result{
+		Counts:  sum.Counts,
+		Bytes:   sum.Size,
+		Elapsed: time.Since(t.start),
+		DryRun:  opt.DryRun,
+		Stats:   *sum.Stats,
+	}, err
+}
+
+// verifier holds the state of one Verify run.
+type verifier struct {
+	opt      options
+	src, dst string
+	diffs    int       // differences found
+	repaired int       // ... and repaired (never under DryRun)
+	dirs     []dirMeta // Repair with Preserve: directories for finishDirs
+}
+
+func (v *verifier) diff(kind, srcPath, dstPath string, dir bool, detail string) {
+	v.diffs++
+	v.opt.emit(Event{Type: EventDiff, Src: srcPath, Dst: dstPath, Dir: dir, Reason: kind, Detail: detail})
+}
+
+// repaired counts a repair that did not fail; under DryRun nothing is.
+func (v *verifier) repair(err error) error {
+	if err == nil && !v.opt.DryRun {
+		v.repaired++
+	}
+	return err
+}
+
+// forward walks SRC and checks each entry against DST.
+func (v *verifier) forward() error {
+	opt := v.opt
+	return walkSrc(v.src, "", opt, func(srcPath, rel string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if rel == "." || (!d.IsDir() && (isTempName(d.Name()) || isPartialName(d.Name()))) {
+			return nil
+		}
+		if isPartialDir(d, opt) {
+			return fs.SkipDir
+		}
+		if opt.filter.Excluded(rel, d.IsDir()) {
+			opt.emit(Event{Type: EventExclude, Path: rel, Dir: d.IsDir()})
+			if d.IsDir() && !opt.filter.Descend(rel) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			opt.stats.scan()
+		}
+		dstPath := filepath.Join(v.dst, rel)
+		switch {
+		case d.IsDir():
+			return v.dir(srcPath, dstPath, d)
+		case isSymlink(d):
+			return v.link(srcPath, dstPath)
+		}
+		si, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return v.file(srcPath, dstPath, si)
+	})
+}
+
+func (v *verifier) dir(srcPath, dstPath string, d fs.DirEntry) error {
+	opt := v.opt
+	di, err := os.Lstat(dstPath)
+	switch {
+	case os.IsNotExist(err):
+		v.diff(DiffMissing, srcPath, dstPath, true, "")
+		if !opt.Repair {
+			return fs.SkipDir // everything below is missing too
+		}
+		if err := v.repair(ensureDir(dstPath, opt)); err != nil {
+			return err
+		}
+		return v.keepDir(srcPath, dstPath, d)
+	case err != nil:
+		return err
+	case !di.IsDir():
+		v.diff(DiffType, srcPath, dstPath, true, "directory in SRC, "+kindOf(di)+" in DST")
+		return fs.SkipDir
+	}
+	si, err := d.Info()
+	if err != nil {
+		return err
+	}
+	kinds, _, err := v.metaDiff(srcPath, dstPath, si, di)
+	if err != nil {
+		return err
+	}
+	if len(kinds) > 0 {
+		v.diff(DiffMeta, srcPath, dstPath, true, strings.Join(kinds, ","))
+		if opt.Repair && !opt.DryRun {
+			v.repaired++ // by finishDirs, once everything inside is done
+		}
+	} else {
+		opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Dir: true, Reason: "same"})
+	}
+	return v.keepDir(srcPath, dstPath, d)
+}
+
+// keepDir remembers a directory whose metadata Repair brings in line last.
+func (v *verifier) keepDir(srcPath, dstPath string, d fs.DirEntry) error {
+	if !v.opt.Repair || v.opt.Preserve == 0 {
+		return nil
+	}
+	dm, err := newDirMeta(srcPath, dstPath, d, v.opt)
+	if err != nil {
+		return err
+	}
+	v.dirs = append(v.dirs, dm)
+	return nil
+}
+
+// link checks a symlink in SRC: as a link under LinksPreserve, otherwise
+// as the file it points to, as cp would copy it.
+func (v *verifier) link(srcPath, dstPath string) error {
+	opt := v.opt
+	switch opt.Links {
+	case LinksSkip:
+		return nil
+	case LinksPreserve:
+	default:
+		ti, err := os.Stat(srcPath)
+		if os.IsNotExist(err) {
+			return nil // dangling: cp skips it too
+		}
+		if err != nil {
+			return err
+		}
+		if ti.IsDir() {
+			return nil // not copied (or, under LinksFollow, walked already)
+		}
+		return v.file(srcPath, dstPath, ti)
+	}
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+	target = opt.linkTarget(target)
+	di, err := os.Lstat(dstPath)
+	switch {
+	case os.IsNotExist(err):
+		v.diff(DiffMissing, srcPath, dstPath, false, "symlink")
+	case err != nil:
+		return err
+	case di.Mode()&fs.ModeSymlink == 0:
+		v.diff(DiffType, srcPath, dstPath, di.IsDir(), "symlink in SRC, "+kindOf(di)+" in DST")
+		if di.IsDir() {
+			return nil
+		}
+	default:
+		cur, err := os.Readlink(dstPath)
+		if err != nil {
+			return err
+		}
+		if cur == target {
+			opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Target: target, Reason: "same"})
+			return nil
+		}
+		v.diff(DiffContent, srcPath, dstPath, false, fmt.Sprintf("link target %q, want %q", cur, target))
+	}
+	if !opt.Repair {
+		return nil
+	}
+	return v.repair(syncLink(srcPath, dstPath, opt))
+}
+
+func (v *verifier) file(srcPath, dstPath string, si fs.FileInfo) error {
+	opt := v.opt
+	reason := "changed"
+	var changes Change
+	di, err := os.Lstat(dstPath)
+	switch {
+	case os.IsNotExist(err):
+		v.diff(DiffMissing, srcPath, dstPath, false, "")
+		reason = "new"
+	case err != nil:
+		return err
+	case !di.Mode().IsRegular():
+		v.diff(DiffType, srcPath, dstPath, di.IsDir(), "file in SRC, "+kindOf(di)+" in DST")
+		if di.IsDir() {
+			return nil
+		}
+	case si.Size() != di.Size():
+		v.diff(DiffSize, srcPath, dstPath, false, fmt.Sprintf("%d bytes in SRC, %d in DST", si.Size(), di.Size()))
+		changes = ChangeSize
+	default:
+		if opt.Checksum {
+			same, err := sameSum(srcPath, dstPath, si, di, opt)
+			if err != nil {
+				return err
+			}
+			if !same {
+				v.diff(DiffContent, srcPath, dstPath, false, opt.hasher().Name()+" differs")
+				changes = ChangeChecksum
+				break
+			}
+		}
+		var kinds []string
+		kinds, changes, err = v.metaDiff(srcPath, dstPath, si, di)
+		if err != nil {
+			return err
+		}
+		if len(kinds) == 0 {
+			opt.emit(Event{Type: EventSkip, Src: srcPath, Dst: dstPath, Size: si.Size(), Reason: "same"})
+			return nil
+		}
+		v.diff(DiffMeta, srcPath, dstPath, false, strings.Join(kinds, ","))
+	}
+	if !opt.Repair {
+		return nil
+	}
+	return v.repair(copyAndReport(srcPath, dstPath, si, reason, changes, opt))
+}
+
+// metaDiff lists the metadata kinds in which dstPath differs: those of
+// Options.Preserve, and "times" whenever the mtimes are more than a second
+// apart (which makes cp copy a file again).
+func (v *verifier) metaDiff(srcPath, dstPath string, si, di fs.FileInfo) ([]string, Change, error) {
+	var kinds []string
+	var changes Change
+	if v.opt.Preserve != 0 {
+		var buf eventBuf
+		mopt := v.opt
+		mopt.DryRun = true // syncMeta only reports what it would change
+		mopt.rep = &buf
+		if err := syncMeta(srcPath, dstPath, si, di, mopt); err != nil {
+			return nil, 0, err
+		}
+		for _, ev := range buf.events {
+			kinds = append(kinds, strings.Split(ev.Reason, ",")...)
+			changes |= ev.Changes
+		}
+	}
+	if !si.IsDir() && absDuration(si.ModTime().Sub(di.ModTime())) > time.Second && v.opt.Preserve&PreserveTimes == 0 {
+		kinds = append(kinds, "times")
+		changes |= ChangeTime
+	}
+	return kinds, changes, nil
+}
+
+// isBackup matches the suffixed backups of earlier Backup runs.
+func (v *verifier) isBackup(name string) bool {
+	suffix := v.opt.BackupSuffix
+	if suffix == "" {
+		suffix = defaultBackupSuffix
+	}
+	return strings.HasSuffix(name, suffix)
+}
+
+// extras walks DST for entries that are not in SRC.
+func (v *verifier) extras() error {
+	opt := v.opt
+	if _, err := os.Lstat(v.dst); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(v.dst, func(dstPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, _ := filepath.Rel(v.dst, dstPath)
+		if rel == "." || (!d.IsDir() && (isTempName(d.Name()) || isPartialName(d.Name()))) {
+			return nil
+		}
+		if v.isBackup(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if isPartialDir(d, opt) {
+			return fs.SkipDir
+		}
+		if opt.filter.Excluded(rel, d.IsDir()) {
+			if d.IsDir() && !opt.filter.Descend(rel) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(v.src, rel)); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		v.diff(DiffExtra, "", dstPath, d.IsDir(), "")
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// kindOf names the type of an entry for EventDiff details.
+func kindOf(fi fs.FileInfo) string {
+	switch {
+	case fi.IsDir():
+		return "directory"
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return "symlink"
+	case fi.Mode().IsRegular():
+		return "file"
+	}
+	return "special file"
+}
@@ -0,0 +1,356 @@
+package engine
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* =========================
+           WATCH
+========================= */
+
+// Watch does one full Sync, then keeps DST up to date from filesystem
+// notifications on SRC (inotify on Linux, polling elsewhere). Changed paths
+// are collected until no new change has arrived for Options.Debounce and
+// then synced as one batch; only the affected files and directories are
+// visited. Every Options.Rescan a full Sync catches anything the watcher
+// missed. Watch returns nil when ctx is cancelled.
+
+// EventWatch marks watch milestones. Reason is "ready", "batch" (Size is
+// then the number of changed paths) or "rescan".
+const EventWatch = "watch"
+
+const (
+	defaultDebounce = 500 * time.Millisecond
+	maxBatchDelay   = 10 // × Debounce: a constant stream of changes still syncs
+	pollInterval    = 2 * time.Second
+)
+
+// watcher reports paths below SRC that may have changed, relative to SRC.
+// An empty path means "lost track; rescan everything".
+type watcher interface {
+	Changes() <-chan string
+	Errors() <-chan error
+	Close() error
+}
+
+// Watch syncs src to dst until ctx is cancelled. src must be a directory.
+func (s *Syncer) Watch(ctx context.Context, src, dst string) error {
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	if fi, err := os.Stat(src); err == nil && !fi.IsDir() {
+		return wrapf(ErrInvalidOption, "watch needs a directory SRC: %s", src)
+	}
+	opt := s.opt
+	opt.Recursive = true
+	full := New(opt)
+	if _, err := full.Sync(src, dst); err != nil {
+		return err
+	}
+
+	o, err := options{Options: opt, limit: newLimiter(opt.BwLimit)}.withRoots(src, dst)
+	if err != nil {
+		return err
+	}
+	w, err := newWatcher(src, o)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	o.emit(Event{Type: EventWatch, Src: src, Dst: dst, Reason: "ready"})
+
+	debounce := opt.Debounce
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+	var rescan <-chan time.Time
+	if opt.Rescan > 0 {
+		t := time.NewTicker(opt.Rescan)
+		defer t.Stop()
+		rescan = t.C
+	}
+
+	pending := map[string]bool{}
+	var first time.Time
+	quiet := time.NewTimer(debounce)
+	quiet.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-w.Errors():
+			return err
+
+		case rel := <-w.Changes():
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending[rel] = true
+			wait := debounce
+			if over := time.Since(first) + debounce - maxBatchDelay*debounce; over > 0 {
+				wait -= over
+			}
+			quiet.Reset(max(wait, 0))
+
+		case <-quiet.C:
+			if pending[""] {
+				if err := s.rescan(full, src, dst, o); err != nil {
+					return err
+				}
+			} else if err := s.syncBatch(src, dst, pending, o); err != nil {
+				return err
+			}
+			pending = map[string]bool{}
+
+		case <-rescan:
+			if err := s.rescan(full, src, dst, o); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Syncer) rescan(full *Syncer, src, dst string, o options) error {
+	o.emit(Event{Type: EventWatch, Src: src, Dst: dst, Reason: "rescan"})
+	_, err := full.Sync(src, dst)
+	return err
+}
+
+// syncBatch syncs the changed paths with their own tally and summary, as
+// if each batch were a small Sync.
+func (s *Syncer) syncBatch(src, dst string, changed map[string]bool, o options) error {
+	t := newTally(s.reporter())
+	o.rep, o.stats = t, &t.data
+	rels := topLevel(changed)
+	o.emit(Event{Type: EventWatch, Src: src, Dst: dst, Reason: "batch", Size: int64(len(rels))})
+
+	err := checkBatchDeletes(src, dst, rels, o)
+	for i := 0; err == nil && i < len(rels); i++ {
+		if err = syncPath(src, dst, rels[i], o); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		o.emit(Event{Type: EventError, Path: errPath(err), Error: err.Error()})
+	}
+	t.next.Report(t.summary(o.DryRun))
+	return err
+}
+
+// checkBatchDeletes applies MaxDelete and MaxDeletePercent to the paths of
+// a batch that syncPath would remove. For the percentage DST is counted the
+// way the mirror pass counts it, but only when the batch deletes anything.
+func checkBatchDeletes(src, dst string, rels []string, o options) error {
+	if !o.Mirror || o.ForceDelete || (o.MaxDelete <= 0 && o.MaxDeletePercent <= 0) {
+		return nil
+	}
+	var dels []pendingDelete
+	var count deleteCount
+	for _, rel := range rels {
+		dstPath := filepath.Join(dst, rel)
+		di, err := os.Lstat(dstPath)
+		if err != nil || o.filter.Excluded(rel, di.IsDir()) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); !os.IsNotExist(err) {
+			continue
+		}
+		n, size, err := treeSize(dstPath, fs.FileInfoToDirEntry(di))
+		if err != nil {
+			return err
+		}
+		dels = append(dels, pendingDelete{path: dstPath, dir: di.IsDir()})
+		count.entries += n
+		count.bytes += size
+	}
+	if len(dels) > 0 && o.MaxDeletePercent > 0 {
+		var err error
+		if count.total, err = dstEntries(dst, o); err != nil {
+			return err
+		}
+	}
+	return checkDeleteLimit(dels, count, o)
+}
+
+// dstEntries counts the entries of DST the mirror pass would see: not
+// excluded, and no temp, partial or backup files.
+func dstEntries(dst string, o options) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dst, func(dstPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dst, dstPath)
+		switch {
+		case rel == ".", !d.IsDir() && (isTempName(d.Name()) || isPartialName(d.Name())):
+			return nil
+		case isBackupName(d.Name(), o), isPartialDir(d, o):
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		case o.filter.Excluded(rel, d.IsDir()):
+			if d.IsDir() && !o.filter.Descend(rel) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// syncPath brings DST/rel in line with SRC/rel: the subtree is synced if
+// it exists in SRC, and removed from DST (under Mirror) if it does not.
+func syncPath(src, dst, rel string, o options) error {
+	name := filepath.Base(rel)
+	if isTempName(name) || isPartialName(name) || (o.PartialDir != "" && name == o.PartialDir) {
+		return nil
+	}
+	si, err := os.Lstat(filepath.Join(src, rel))
+	if err == nil {
+		if o.filter.Excluded(rel, si.IsDir()) && !(si.IsDir() && o.filter.Descend(rel)) {
+			return nil
+		}
+		return syncSubtree(src, dst, rel, o)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if !o.Mirror {
+		return nil
+	}
+	dstPath := filepath.Join(dst, rel)
+	di, err := os.Lstat(dstPath)
+	if err != nil || o.filter.Excluded(rel, di.IsDir()) {
+		return nil
+	}
+	trashed := o.trash.entries()
+	err = removePath(dstPath, di.IsDir(), o)
+	reportTrash(trashed, o)
+	return err
+}
+
+// topLevel sorts the changed paths and drops those inside another changed
+// directory, which syncing that directory covers.
+func topLevel(changed map[string]bool) []string {
+	rels := make([]string, 0, len(changed))
+	for rel := range changed {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var out []string
+	for _, rel := range rels {
+		if n := len(out); n > 0 && strings.HasPrefix(rel, out[n-1]+string(os.PathSeparator)) {
+			continue
+		}
+		out = append(out, rel)
+	}
+	return out
+}
+
+/* ---------- polling fallback ---------- */
+
+type pollState struct {
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+// pollWatcher rewalks SRC every interval and reports what differs from the
+// previous walk. It is the fallback where no notification API is used.
+type pollWatcher struct {
+	src     string
+	opt     options
+	changes chan string
+	errs    chan error
+	done    chan struct{}
+}
+
+func newPollWatcher(src string, opt options, interval time.Duration) (*pollWatcher, error) {
+	w := &pollWatcher{src: src, opt: opt, changes: make(chan string, 256), errs: make(chan error, 1), done: make(chan struct{})}
+	snap, err := w.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	go w.loop(snap, interval)
+	return w, nil
+}
+
+func (w *pollWatcher) Changes() <-chan string { return w.changes }
+func (w *pollWatcher) Errors() <-chan error   { return w.errs }
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *pollWatcher) loop(prev map[string]pollState, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+		cur, err := w.snapshot()
+		if err != nil {
+			select {
+			case w.errs <- err:
+			default:
+			}
+			return
+		}
+		for rel, st := range cur {
+			if p, ok := prev[rel]; !ok || p.dir != st.dir || (!st.dir && (p.size != st.size || !p.mtime.Equal(st.mtime))) {
+				w.send(rel)
+			}
+		}
+		for rel := range prev {
+			if _, ok := cur[rel]; !ok {
+				w.send(rel)
+			}
+		}
+		prev = cur
+	}
+}
+
+func (w *pollWatcher) send(rel string) {
+	select {
+	case w.changes <- rel:
+	case <-w.done:
+	}
+}
+
+func (w *pollWatcher) snapshot() (map[string]pollState, error) {
+	snap := map[string]pollState{}
+	err := walkSrc(w.src, "", w.opt, func(_, rel string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if w.opt.filter.Excluded(rel, d.IsDir()) {
+			if !d.IsDir() {
+				return nil
+			}
+			if !w.opt.filter.Descend(rel) {
+				return filepath.SkipDir
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // vanished meanwhile; the next walk sees it
+		}
+		snap[rel] = pollState{size: info.Size(), mtime: info.ModTime(), dir: d.IsDir()}
+		return nil
+	})
+	return snap, err
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package engine
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyWatcher watches every (non-excluded) directory below SRC. New
+// directories are added as they appear; a queue overflow asks for a rescan.
+type inotifyWatcher struct {
+	src     string
+	opt     options
+	f       *os.File
+	fd      int
+	mu      sync.Mutex
+	dirs    map[int32]string // watch descriptor -> rel dir ("" for SRC)
+	changes chan string
+	errs    chan error
+	done    chan struct{}
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+func newWatcher(src string, opt options) (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		src:     src,
+		opt:     opt,
+		f:       os.NewFile(uintptr(fd), "inotify"), // non-blocking: Close unblocks Read
+		fd:      fd,
+		dirs:    map[int32]string{},
+		changes: make(chan string, 256),
+		errs:    make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+	if err := w.addTree(""); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string { return w.changes }
+func (w *inotifyWatcher) Errors() <-chan error   { return w.errs }
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.f.Close()
+}
+
+// addTree adds watches for rel and every directory below it.
+func (w *inotifyWatcher) addTree(rel string) error {
+	return walkSrc(w.src, rel, w.opt, func(p, r string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // gone before we got to it
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if r == "." {
+			r = ""
+		}
+		if r != "" && (isPartialDir(d, w.opt) || (w.opt.filter.Excluded(r, true) && !w.opt.filter.Descend(r))) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			if err == syscall.ENOENT || err == syscall.ENOTDIR {
+				return nil
+			}
+			return os.NewSyscallError("inotify_add_watch "+p, err)
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = r
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.fail(err)
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.handle(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.send("")
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		return // events on the watched directory itself
+	}
+	rel := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := w.addTree(rel); err != nil {
+			w.fail(err)
+		}
+	}
+	w.send(rel)
+}
+
+func (w *inotifyWatcher) send(rel string) {
+	select {
+	case w.changes <- rel:
+	case <-w.done:
+	}
+}
+
+func (w *inotifyWatcher) fail(err error) {
+	select {
+	case w.errs <- err:
+	default:
+	}
+}
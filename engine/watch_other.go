@@ -0,0 +1,8 @@
+//go:build !linux
+
+package engine
+
+// newWatcher falls back to polling where inotify is not available.
+func newWatcher(src string, opt options) (watcher, error) {
+	return newPollWatcher(src, opt, pollInterval)
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+)
+
+const xattrSupported = true
+
+// readXattrs returns every extended attribute of path. Filesystems without
+// xattr support yield an empty map.
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrGet(func(buf []byte) (int, error) { return syscall.Listxattr(path, buf) })
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n := string(name)
+		val, err := xattrGet(func(buf []byte) (int, error) { return syscall.Getxattr(path, n, buf) })
+		if err != nil {
+			return nil, err
+		}
+		attrs[n] = val
+	}
+	return attrs, nil
+}
+
+// xattrGet runs a size probe (get with a nil buffer), then the real read.
+// A value that grows in between makes the read fail with ERANGE; the probe
+// is then repeated.
+func xattrGet(get func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = get(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+func xattrsDiffer(srcPath, dstPath string) (bool, error) {
+	sa, err := readXattrs(srcPath)
+	if err != nil {
+		return false, err
+	}
+	da, err := readXattrs(dstPath)
+	if err != nil {
+		return false, err
+	}
+	if len(sa) != len(da) {
+		return true, nil
+	}
+	for k, v := range sa {
+		if dv, ok := da[k]; !ok || !bytes.Equal(v, dv) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// copyXattrs makes dstPath's attributes an exact copy of srcPath's.
+func copyXattrs(srcPath, dstPath string) error {
+	sa, err := readXattrs(srcPath)
+	if err != nil {
+		return err
+	}
+	da, err := readXattrs(dstPath)
+	if err != nil {
+		return err
+	}
+	for k := range da {
+		if _, ok := sa[k]; !ok {
+			if err := syscall.Removexattr(dstPath, k); err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range sa {
+		if err := syscall.Setxattr(dstPath, k, v, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"syscall"
+	"testing"
+)
+
+func setXattrForTest(path, name string, val []byte) error {
+	return syscall.Setxattr(path, name, val, 0)
+}
+
+func TestXattrGet_Grows(t *testing.T) {
+	val := []byte("v1")
+	calls := 0
+	get := func(buf []byte) (int, error) {
+		calls++
+		if buf == nil {
+			return len(val), nil
+		}
+		if calls == 2 {
+			val = []byte("longer value") // 探査と読み取りの間に値が伸びた
+		}
+		if len(buf) < len(val) {
+			return 0, syscall.ERANGE
+		}
+		return copy(buf, val), nil
+	}
+	got, err := xattrGet(get)
+	if err != nil || string(got) != "longer value" || calls != 4 {
+		t.Fatalf("xattrGet = %q, %v after %d calls", got, err, calls)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package engine
+
+const xattrSupported = false
+
+func xattrsDiffer(string, string) (bool, error) { return false, nil }
+
+func copyXattrs(string, string) error { return nil }
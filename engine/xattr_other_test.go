@@ -0,0 +1,7 @@
+//go:build !linux
+
+package engine
+
+import "errors"
+
+func setXattrForTest(string, string, []byte) error { return errors.ErrUnsupported }
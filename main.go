@@ -1,17 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha1"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
+
+	"syncdir/engine"
 )
 
 /*
@@ -22,16 +21,18 @@ Highlights:
 - cp subcommand with --help
 - Strong validations (args, path relationships, src existence, recursion safety)
 - Proper exit codes, stderr usage, and consistent usage printing
+
+The copy/sync engine lives in syncdir/engine; this file is the CLI only.
 */
 
 var (
-    exitFn = func(code int) { os.Exit(code) }
-    stderr io.Writer = os.Stderr   // ★ io.Writer にする（重要）
+	exitFn           = func(code int) { os.Exit(code) }
+	stderr io.Writer = os.Stderr // ★ io.Writer にする（重要）
+	stdout io.Writer = os.Stdout
 )
 
 func printErr(s string) { _, _ = fmt.Fprint(stderr, s) }
 
-
 const (
 	appName    = "syncdir"
 	appVersion = "0.2.0"
@@ -39,22 +40,43 @@ const (
 	exitOK           = 0
 	exitUsage        = 2
 	exitRuntimeError = 1
+	exitDeleteLimit  = 3 // mirror pass refused by --max-delete / --max-delete-percent
+	exitMismatch     = 4 // verify found differences
+	exitPartial      = 5 // --keep-going finished, but some entries failed
 )
 
-type options struct {
-	recursive bool
-	mirror    bool
-	dryRun    bool
-	excludes  []string
-	verbose   bool
-	checksum  bool
+// ruleFlag appends to a shared rule list, so --include, --exclude and
+// --exclude-from keep their command-line order. A file becomes one rule.
+type ruleFlag struct {
+	rules   *[]engine.Rule
+	include bool
+	file    bool
 }
 
-type multiFlag []string
+func (r ruleFlag) String() string { return "" }
+func (r ruleFlag) Set(v string) error {
+	patterns := []string{v}
+	if r.file {
+		lines, err := engine.ReadExcludeFile(v)
+		if err != nil {
+			return err
+		}
+		patterns = lines
+	}
+	*r.rules = append(*r.rules, engine.Rule{Include: r.include, Patterns: patterns})
+	return nil
+}
 
-func (m *multiFlag) String() string { return strings.Join(*m, ",") }
-func (m *multiFlag) Set(v string) error {
-	*m = append(*m, v)
+// bwLimitFlag parses --bwlimit into a schedule: "10M" or "08:00,2M 18:00,off".
+type bwLimitFlag struct{ limit *engine.BwLimit }
+
+func (b bwLimitFlag) String() string { return "" }
+func (b bwLimitFlag) Set(v string) error {
+	l, err := engine.ParseBwLimit(v)
+	if err != nil {
+		return err
+	}
+	*b.limit = l
 	return nil
 }
 
@@ -70,6 +92,16 @@ Usage:
 
 Commands:
   cp           Copy/sync files and directories
+  plan         Record a reviewed dry-run of cp as a plan file
+  apply        Execute a plan file, refusing stale operations
+  bisync       Two-way sync with persistent state and conflict handling
+  watch        Keep DST in sync with SRC as files change
+  restore      Put back entries a --trash mirror run moved aside
+  trash        List or purge trash runs
+  run          Run a named sync job from a profile file
+  profiles     List the named sync jobs
+  cache        Rebuild the --checksum hash cache of a tree
+  verify       Check that DST matches SRC, optionally repairing it
   help         Show help (alias: -h, --help)
   version      Show version
 
@@ -79,35 +111,116 @@ Global Options:
 
 See:
   %s help cp
-`, appName, appName, appName)
+  %s help plan
+`, appName, appName, appName, appName)
 }
 
 func cpUsage() string {
 	return fmt.Sprintf(`%s cp - copy/sync
 
 Usage:
-  %s cp -r [--mirror] [--dry-run] [--exclude PATTERN ...] [--verbose] [--checksum] SRC DST
+  %s cp -r [--mirror] [--dry-run] [--include PATTERN ...] [--exclude PATTERN ...] [--exclude-from FILE ...] [--verbose] [--checksum] [--parallel N] [--output text|json]
+                [--itemize-changes] [--stats] [--keep-going]
+                [--checksum-algo ALGO] [--checksum-cache DIR] [--no-checksum-cache]
+                [--links MODE] [--abs-links keep|rewrite] [--preserve LIST]
+                [--delta [--delta-block SIZE]] [--partial] [--partial-dir NAME]
+                [--backup] [--backup-dir DIR] [--suffix S] [--trash] [--trash-dir DIR]
+                [--bwlimit RATE] [--progress]
+                [--max-delete N] [--max-delete-percent P] [--force-delete] SRC DST
 
 Options:
   -r             Recursive (required when SRC is a directory)
   --mirror       Mirror mode (delete files/dirs not present in SRC)
   --dry-run      Show actions without changing anything
-  --exclude X    Exclude pattern (can repeat) e.g. ".git", "*.tmp", "node_modules"
+  --include X    Include pattern (can repeat); see --exclude
+  --exclude X    Exclude pattern, .gitignore syntax (can repeat) e.g. ".git", "*.tmp",
+                 "/build/", "**/cache"; --include/--exclude/--exclude-from are checked
+                 in command-line order and the first match wins
+  --exclude-from F  Read exclude patterns from a .gitignore-style file (can repeat);
+                 inside the file the last matching pattern wins, as in git
   --verbose      Verbose logging
-  --checksum     Use SHA1 to decide copy (slower, safer)
+  -i, --itemize-changes  Print every change as an rsync-style code and path:
+                 ">f.st.... a.txt" (copied: size and mtime differed), ">f+++++++"
+                 (new file), "cd+++++++" (new dir), ".f...p..." (metadata only),
+                 "cL+++++++" (new symlink), "*deleting"; columns are checksum, size,
+                 time, perms, owner, group, xattr (text output; JSON events carry
+                 "changes")
+  --stats        At the end, print files scanned, copied, skipped, excluded and deleted,
+                 directories created, bytes read, written and hashed, errors, elapsed
+                 time and throughput (text output; JSON summaries carry "stats")
+  --keep-going   Log a failing entry (with its path and operation) and carry on with
+                 the rest; --mirror deletes nothing at or below a path that failed;
+                 ends with the failures grouped by operation and exit status 5
+  --checksum     Compare file hashes to decide copy (slower, safer); hashes are cached
+                 per tree and reused while size, mtime and inode are unchanged
+  --checksum-algo A  Hash for --checksum, its cache and --delta verification: sha1
+                 (default), sha256, crc32c or xxh64 (fastest, non-cryptographic)
+  --checksum-cache D  Keep the hash caches in D (default: syncdir\checksums in the
+                 user cache directory, e.g. %%LocalAppData%%\syncdir\checksums)
+  --no-checksum-cache Hash every file on every --checksum run
+  --parallel N   Copy up to N files concurrently (default 1)
+  --output F     Output format: text (default) or json (one event per line)
+  --links MODE   Symlinks inside SRC: copy (default; copy file targets, skip dir links),
+                 preserve (recreate as links), skip, or follow (also descend into dir links)
+  --abs-links X  With --links=preserve: keep (default) or rewrite absolute targets
+                 that point inside SRC so they point inside DST
+  --preserve L   Also sync metadata of unchanged files and of directories:
+                 comma list of mode, owner, times, xattr, or all
+  --delta        Update changed files in place, rewriting only differing blocks
+                 (verified afterwards; not atomic)
+  --delta-block  Block size for --delta, e.g. 64K, 1M (default 1M)
+  --partial      Keep interrupted copies of large files (over 8M) and resume
+                 them on the next run if the source is unchanged
+  --partial-dir  Keep partial files in this directory (a plain name, created
+                 inside each DST directory) instead of next to the target; implies --partial
+  --backup       Before overwriting or mirror-deleting an entry, keep the old version
+                 as NAME~ next to it
+  --backup-dir D Keep backups under D/YYYYMMDD-HHMMSS/ in the tree layout instead
+                 (D relative to DST; excluded from the sync); implies --backup
+  --suffix S     Backup name suffix (default "~", or none with --backup-dir)
+  --trash        With --mirror: move deleted entries to a per-run trash directory
+                 with a manifest instead of deleting them (see 'help restore')
+  --trash-dir D  Trash location (default .syncdir-trash, relative to DST; excluded
+                 from the sync); implies --trash
+  --bwlimit R    Limit file data read and written to R bytes/s across all workers,
+                 e.g. 10M; or a timetable "08:00,2M 18:00,off" (local time)
+  --progress     Count the work first, then show files and bytes done, throughput,
+                 ETA and the current file on stderr (redrawn in place on a terminal)
+  --max-delete N With --mirror: refuse to delete more than N entries (a directory
+                 counts with everything in it); nothing is deleted and the exit
+                 status is 3
+  --max-delete-percent P  Likewise for more than P%% of the entries in DST
+  --force-delete Ignore --max-delete and --max-delete-percent for this run
   --help         Show this help for 'cp'
 
 Examples:
   %s cp -r "E:\dotinstall" "C:\Users\ckklu\dotinstall"
   %s cp -r --mirror "E:\dotinstall" "C:\Users\ckklu\dotinstall"
   %s cp -r --dry-run --exclude ".git" --exclude "*.tmp" "E:\src" "E:\dst"
-`, appName, appName, appName, appName, appName)
+  %s cp -r --parallel 8 "E:\src" "E:\dst"
+  %s cp -r --include "build/release/**" --exclude "build/" "E:\src" "E:\dst"
+  %s cp -r --bwlimit "08:00,5M 19:00,off" "E:\src" "\\nas\share\dst"
+`, appName, appName, appName, appName, appName, appName, appName, appName)
 }
 
 /* =========================
           MAIN
 ========================= */
 
+var helpTopics = map[string]func() string{
+	"cp":       cpUsage,
+	"plan":     planUsage,
+	"apply":    applyUsage,
+	"bisync":   bisyncUsage,
+	"watch":    watchUsage,
+	"restore":  restoreUsage,
+	"trash":    trashUsage,
+	"run":      runUsage,
+	"profiles": profilesUsage,
+	"cache":    cacheUsage,
+	"verify":   verifyUsage,
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		printErr(globalUsage())
@@ -117,10 +230,9 @@ func main() {
 	switch os.Args[1] {
 	case "-h", "--help", "help":
 		if len(os.Args) >= 3 {
-			switch os.Args[2] {
-			case "cp":
-				printErr(cpUsage())
-			default:
+			if usage, ok := helpTopics[os.Args[2]]; ok {
+				printErr(usage())
+			} else {
 				printErr(globalUsage())
 				printErr(fmt.Sprintf("Unknown topic for help: %q\n", os.Args[2]))
 			}
@@ -137,6 +249,46 @@ func main() {
 		runCp(os.Args[2:])
 		exitFn(exitOK)
 
+	case "plan":
+		runPlan(os.Args[2:])
+		exitFn(exitOK)
+
+	case "apply":
+		runApply(os.Args[2:])
+		exitFn(exitOK)
+
+	case "bisync":
+		runBisync(os.Args[2:])
+		exitFn(exitOK)
+
+	case "watch":
+		runWatch(os.Args[2:])
+		exitFn(exitOK)
+
+	case "restore":
+		runRestore(os.Args[2:])
+		exitFn(exitOK)
+
+	case "trash":
+		runTrash(os.Args[2:])
+		exitFn(exitOK)
+
+	case "run":
+		runRun(os.Args[2:])
+		exitFn(exitOK)
+
+	case "profiles":
+		runProfiles(os.Args[2:])
+		exitFn(exitOK)
+
+	case "cache":
+		runCache(os.Args[2:])
+		exitFn(exitOK)
+
+	case "verify":
+		runVerify(os.Args[2:])
+		exitFn(exitOK)
+
 	default:
 		// fallback: honor --help / --version anywhere
 		for _, a := range os.Args[1:] {
@@ -160,32 +312,9 @@ func main() {
 ========================= */
 
 func runCp(args []string) {
-	fs := flag.NewFlagSet("cp", flag.ContinueOnError)
-	fs.SetOutput(io.Discard) // suppress default prints; we print our own
-
-	var opt options
-	var wantHelp bool
-
-	fs.BoolVar(&opt.recursive, "r", false, "recursive copy for directories (required if SRC is dir)")
-	fs.BoolVar(&opt.mirror, "mirror", false, "mirror mode (delete files/dirs not present in SRC)")
-	fs.BoolVar(&opt.dryRun, "dry-run", false, "show actions without changing anything")
-	fs.BoolVar(&opt.verbose, "verbose", false, "verbose logging")
-	fs.BoolVar(&opt.checksum, "checksum", false, "use SHA1 checksum to decide copy (slower, safer)")
-	exc := multiFlag{}
-	fs.Var(&exc, "exclude", "exclude pattern (repeatable)")
-	fs.BoolVar(&wantHelp, "help", false, "show help for cp")
-
-	if err := fs.Parse(args); err != nil {
-		printErr(cpUsage())
-		printErr(fmt.Sprintf("Argument error: %v\n", err))
-		exitFn(exitUsage)
-	}
-	opt.excludes = exc
-
-	if wantHelp {
-		printErr(cpUsage())
-		exitFn(exitUsage)
-	}
+	var sf syncFlags
+	fs := newCpFlags(&sf)
+	sf.parse(fs, args, cpUsage)
 
 	rest := fs.Args()
 	if len(rest) != 2 {
@@ -195,307 +324,311 @@ func runCp(args []string) {
 	}
 	src, dst := filepath.Clean(rest[0]), filepath.Clean(rest[1])
 
-	srcInfo, err := os.Stat(src)
+	res, err := engine.New(sf.opt).Sync(src, dst)
+	sf.printStats(res)
 	if err != nil {
-		if os.IsNotExist(err) {
-			dieUsagef("error: SRC does not exist: %s\n", src)
-		}
-		dieRuntime(err)
-	}
-	if srcInfo.IsDir() && !opt.recursive {
-		dieUsagef("error: SRC is a directory; specify -r for recursive copy\n")
+		dieSync(err, src, dst, cpUsage)
 	}
+}
 
-	absSrc, _ := filepath.Abs(src)
-	absDst, _ := filepath.Abs(dst)
+// newCpFlags returns the flag set of 'cp', which 'run' reuses for profiles.
+func newCpFlags(sf *syncFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("cp", flag.ContinueOnError)
+	sf.register(fs)
+	fs.BoolVar(&sf.opt.Recursive, "r", false, "recursive copy for directories (required if SRC is dir)")
+	fs.BoolVar(&sf.opt.DryRun, "dry-run", false, "show actions without changing anything")
+	fs.BoolVar(&sf.stats, "stats", false, "print transfer statistics at the end")
+	fs.BoolVar(&sf.opt.KeepGoing, "keep-going", false, "log failing entries and carry on")
+	return fs
+}
 
-	if samePath(absSrc, absDst) {
-		dieUsagef("error: SRC and DST are the same path:\n  %s\n", absSrc)
-	}
-	if isSubpath(absDst, absSrc) {
-		dieUsagef("error: DST is inside SRC; refused to prevent recursion:\n  DST=%s inside SRC=%s\n", absDst, absSrc)
+// treeFlags holds the options shared by every command that compares a SRC
+// tree with a DST tree: what to look at, how to compare it and how to log.
+type treeFlags struct {
+	opt        engine.Options
+	rules      []engine.Rule
+	verbose    bool
+	output     string
+	links      string
+	absLinks   string
+	preserve   string
+	sumCache   string
+	noSumCache bool
+	help       bool
+}
+
+func (tf *treeFlags) register(fs *flag.FlagSet) {
+	fs.SetOutput(io.Discard) // suppress default prints; we print our own
+	fs.BoolVar(&tf.verbose, "verbose", false, "verbose logging")
+	fs.BoolVar(&tf.opt.Checksum, "checksum", false, "compare file hashes (slower, safer)")
+	fs.StringVar(&tf.opt.ChecksumAlgo, "checksum-algo", engine.DefaultChecksumAlgo, "hash algorithm for --checksum and --delta")
+	fs.StringVar(&tf.sumCache, "checksum-cache", "", "directory of the --checksum hash caches")
+	fs.BoolVar(&tf.noSumCache, "no-checksum-cache", false, "hash every file on every --checksum run")
+	fs.StringVar(&tf.output, "output", outputText, "output format: text or json")
+	fs.Var(ruleFlag{rules: &tf.rules}, "exclude", "exclude pattern (repeatable)")
+	fs.Var(ruleFlag{rules: &tf.rules, include: true}, "include", "include pattern (repeatable)")
+	fs.Var(ruleFlag{rules: &tf.rules, file: true}, "exclude-from", "read exclude patterns from FILE (repeatable)")
+	fs.StringVar(&tf.links, "links", string(engine.LinksCopy), "symlink handling: copy, preserve, skip or follow")
+	fs.StringVar(&tf.absLinks, "abs-links", "keep", "with --links=preserve: keep or rewrite absolute targets inside SRC")
+	fs.StringVar(&tf.preserve, "preserve", "", "metadata kinds: mode,owner,times,xattr or all")
+	fs.StringVar(&tf.opt.BackupDir, "backup-dir", "", "where backups are kept")
+	fs.StringVar(&tf.opt.BackupSuffix, "suffix", "", "backup suffix (default \"~\" without --backup-dir)")
+	fs.Var(bwLimitFlag{&tf.opt.BwLimit}, "bwlimit", "byte-rate limit, e.g. 10M or \"08:00,2M 18:00,off\"")
+	fs.BoolVar(&tf.help, "help", false, "show help")
+}
+
+// parse parses args, handles --help and validates the shared options.
+func (tf *treeFlags) parse(fs *flag.FlagSet, args []string, usage func() string) {
+	if err := fs.Parse(args); err != nil {
+		dieUsage(usage, "Argument error: %v\n", err)
 	}
-	if isSubpath(absSrc, absDst) {
-		dieUsagef("error: SRC is inside DST; refused to prevent recursion:\n  SRC=%s inside DST=%s\n", absSrc, absDst)
+	tf.opt.Rules = tf.rules
+	if _, err := engine.NewFilter(tf.opt.Rules); err != nil {
+		dieUsage(usage, "error: %v\n", err)
 	}
 
-	if srcInfo.IsDir() {
-		if err := syncDir(src, dst, opt); err != nil {
-			dieRuntime(err)
-		}
-	} else {
-		if err := copyOneFile(src, dst, opt); err != nil {
-			dieRuntime(err)
-		}
+	if tf.help {
+		printErr(usage())
+		exitFn(exitUsage)
 	}
 
-	if opt.dryRun {
-		logAlways("[DRY-RUN] no changes were made.")
+	if tf.output != outputText && tf.output != outputJSON {
+		dieUsage(usage, "error: --output must be %q or %q (got %q)\n", outputText, outputJSON, tf.output)
 	}
-}
-
-/* =========================
-         CORE LOGIC
-========================= */
-
-func syncDir(src, dst string, opt options) error {
-	src = filepath.Clean(src)
-	dst = filepath.Clean(dst)
-
-	// forward pass
-	err := filepath.WalkDir(src, func(srcPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		rel, _ := filepath.Rel(src, srcPath)
-		if rel == "." {
-			return ensureDir(dst, opt)
-		}
-		if shouldExclude(rel, d, opt.excludes) {
-			if opt.verbose {
-				logf("exclude: %s", rel)
-			}
-			if d.IsDir() {
-				return fs.SkipDir
-			}
-			return nil
-		}
-
-		dstPath := filepath.Join(dst, rel)
-		info, err := d.Info()
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return ensureDir(dstPath, opt)
-		}
-		return syncFile(srcPath, dstPath, info, opt)
-	})
+	switch engine.LinkMode(tf.links) {
+	case engine.LinksCopy, engine.LinksPreserve, engine.LinksSkip, engine.LinksFollow:
+		tf.opt.Links = engine.LinkMode(tf.links)
+	default:
+		dieUsage(usage, "error: --links must be copy, preserve, skip or follow (got %q)\n", tf.links)
+	}
+	switch tf.absLinks {
+	case "keep":
+	case "rewrite":
+		tf.opt.RewriteAbsLinks = true
+	default:
+		dieUsage(usage, "error: --abs-links must be keep or rewrite (got %q)\n", tf.absLinks)
+	}
+	p, err := engine.ParsePreserve(tf.preserve)
 	if err != nil {
-		return err
+		dieUsage(usage, "error: %v\n", err)
 	}
-
-	// mirror pass
-	if opt.mirror {
-		err = filepath.WalkDir(dst, func(dstPath string, d fs.DirEntry, walkErr error) error {
-			if walkErr != nil {
-				return walkErr
-			}
-			rel, _ := filepath.Rel(dst, dstPath)
-			if rel == "." {
-				return nil
-			}
-			if shouldExclude(rel, d, opt.excludes) {
-				if opt.verbose {
-					logf("mirror-skip (excluded): %s", rel)
-				}
-				if d.IsDir() {
-					return fs.SkipDir
-				}
-				return nil
-			}
-			srcPath := filepath.Join(src, rel)
-			_, err := os.Lstat(srcPath)
-			if err == nil {
-				return nil
-			}
-			if d.IsDir() {
-				// 親ディレクトリを削除した場合、WalkDir がその配下に降りようとして失敗するのを防ぐ
-				if rmErr := removePath(dstPath, true, opt); rmErr != nil {
-					return rmErr
-				}
-				return fs.SkipDir
-			}
-			return removePath(dstPath, false, opt)
-		})
-		if err != nil {
-			return err
-		}
+	tf.opt.Preserve = p
+	if strings.ContainsAny(tf.opt.BackupSuffix, `/\`) {
+		dieUsage(usage, "error: --suffix must not contain a path separator (got %q)\n", tf.opt.BackupSuffix)
 	}
-	return nil
+	if _, err := engine.LookupHasher(tf.opt.ChecksumAlgo); err != nil {
+		dieUsage(usage, "error: --checksum-algo: %v\n", err)
+	}
+	tf.opt.ChecksumCache = checksumCacheDir(tf.sumCache, tf.noSumCache)
+	tf.opt.Reporter = newReporter(tf.output, tf.verbose)
 }
 
-func ensureDir(path string, opt options) error {
-	if opt.dryRun {
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			logf("[DRY] MKDIR %s", path)
-		}
-		return nil
-	}
-	return os.MkdirAll(path, 0o755)
+// syncFlags holds the options shared by every command that syncs a tree.
+type syncFlags struct {
+	treeFlags
+	itemize    bool
+	stats      bool // cp and run only
+	deltaBlock string
+	partialDir string
+	progress   bool
 }
 
-func syncFile(srcPath, dstPath string, srcInfo fs.FileInfo, opt options) error {
-	if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Mode().IsRegular() {
-		same, err := sameFile(srcPath, dstPath, srcInfo, dstInfo, opt)
-		if err != nil {
-			return err
-		}
-		if same {
-			if opt.verbose {
-				logf("skip (same): %s", dstPath)
-			}
-			return nil
-		}
-	}
-	return copyOneFile(srcPath, dstPath, opt)
+func (sf *syncFlags) register(fs *flag.FlagSet) {
+	sf.treeFlags.register(fs)
+	fs.BoolVar(&sf.opt.Mirror, "mirror", false, "mirror mode (delete files/dirs not present in SRC)")
+	fs.BoolVar(&sf.itemize, "itemize-changes", false, "print a change code for every changed entry")
+	fs.BoolVar(&sf.itemize, "i", false, "short for --itemize-changes")
+	fs.IntVar(&sf.opt.Parallel, "parallel", 1, "number of concurrent file copies")
+	fs.BoolVar(&sf.opt.Delta, "delta", false, "update changed files in place, block by block")
+	fs.StringVar(&sf.deltaBlock, "delta-block", "1M", "block size for --delta")
+	fs.BoolVar(&sf.opt.Partial, "partial", false, "keep and resume interrupted large copies")
+	fs.StringVar(&sf.partialDir, "partial-dir", "", "directory name for partial files (implies --partial)")
+	fs.BoolVar(&sf.opt.Backup, "backup", false, "keep overwritten and mirror-deleted files")
+	fs.BoolVar(&sf.opt.Trash, "trash", false, "move mirror deletions to a restorable trash")
+	fs.StringVar(&sf.opt.TrashDir, "trash-dir", "", "trash location (implies --trash)")
+	fs.BoolVar(&sf.progress, "progress", false, "show files/bytes done, throughput and ETA on stderr")
+	fs.IntVar(&sf.opt.MaxDelete, "max-delete", 0, "refuse mirror passes deleting more than N entries")
+	fs.Float64Var(&sf.opt.MaxDeletePercent, "max-delete-percent", 0, "refuse mirror passes deleting more than P% of DST")
+	fs.BoolVar(&sf.opt.ForceDelete, "force-delete", false, "ignore --max-delete and --max-delete-percent")
 }
 
-func copyOneFile(srcPath, dstPath string, opt options) error {
-	if opt.dryRun {
-		logf("[DRY] COPY %s -> %s", srcPath, dstPath)
-		return nil
-	}
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
-		return err
-	}
+// parse parses args, handles --help and validates the options.
+func (sf *syncFlags) parse(fs *flag.FlagSet, args []string, usage func() string) {
+	sf.treeFlags.parse(fs, args, usage)
 
-	sf, err := os.Open(srcPath)
-	if err != nil {
-		return err
+	if sf.opt.Parallel < 1 {
+		dieUsage(usage, "error: --parallel must be at least 1 (got %d)\n", sf.opt.Parallel)
 	}
-	defer sf.Close()
-
-	si, err := sf.Stat()
-	if err != nil {
-		return err
+	var err error
+	if sf.opt.DeltaBlock, err = engine.ParseSize(sf.deltaBlock); err != nil || sf.opt.DeltaBlock == 0 {
+		dieUsage(usage, "error: --delta-block must be a positive size such as 64K or 1M (got %q)\n", sf.deltaBlock)
 	}
-
-	df, err := os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, si.Mode())
-	if err != nil {
-		return err
+	if sf.partialDir != "" {
+		if strings.ContainsAny(sf.partialDir, `/\`) || sf.partialDir == "." || sf.partialDir == ".." {
+			dieUsage(usage, "error: --partial-dir must be a plain directory name (got %q)\n", sf.partialDir)
+		}
+		sf.opt.Partial, sf.opt.PartialDir = true, sf.partialDir
 	}
-	buf := bufio.NewWriterSize(df, 2<<20)
-	if _, err := io.Copy(buf, sf); err != nil {
-		_ = df.Close()
-		return err
+	if sf.opt.BackupDir != "" {
+		sf.opt.Backup = true
 	}
-	if err := buf.Flush(); err != nil {
-		_ = df.Close()
-		return err
+	if sf.opt.TrashDir != "" {
+		sf.opt.Trash = true
 	}
-	if err := df.Close(); err != nil {
-		return err
+	if sf.opt.MaxDelete < 0 {
+		dieUsage(usage, "error: --max-delete must not be negative (got %d)\n", sf.opt.MaxDelete)
 	}
-
-	mt := si.ModTime()
-	return os.Chtimes(dstPath, mt, mt)
-}
-
-func removePath(path string, isDir bool, opt options) error {
-	if opt.dryRun {
-		if isDir {
-			logf("[DRY] RMDIR %s", path)
-		} else {
-			logf("[DRY] DEL   %s", path)
-		}
-		return nil
+	if sf.opt.MaxDeletePercent < 0 || sf.opt.MaxDeletePercent > 100 {
+		dieUsage(usage, "error: --max-delete-percent must be between 0 and 100 (got %g)\n", sf.opt.MaxDeletePercent)
+	}
+	if sf.progress {
+		sf.opt.Progress = newProgressPrinter(stderr).print
 	}
-	if isDir {
-		return os.RemoveAll(path)
+	if sf.itemize && sf.output == outputText {
+		sf.opt.Reporter = engine.NewItemizeReporter(stdout, sf.verbose)
 	}
-	return os.Remove(path)
 }
 
-func sameFile(srcPath, dstPath string, si, di fs.FileInfo, opt options) (bool, error) {
-	if si.Size() == di.Size() && absDuration(si.ModTime().Sub(di.ModTime())) <= time.Second {
-		if !opt.checksum {
-			return true, nil
-		}
-		sh1, err := sha1sum(srcPath)
-		if err != nil {
-			return false, err
-		}
-		dh1, err := sha1sum(dstPath)
-		if err != nil {
-			return false, err
-		}
-		return sh1 == dh1, nil
+// checksumCacheDir picks the --checksum cache: dir, or the default
+// location unless disabled. Without a user cache directory there is none.
+func checksumCacheDir(dir string, disabled bool) string {
+	if disabled {
+		return ""
 	}
-	if opt.checksum {
-		sh1, err := sha1sum(srcPath)
-		if err != nil {
-			return false, err
-		}
-		dh1, err := sha1sum(dstPath)
-		if err != nil {
-			return false, err
-		}
-		return sh1 == dh1, nil
+	if dir == "" {
+		dir, _ = engine.DefaultChecksumCache()
 	}
-	return false, nil
+	return dir
 }
 
-func sha1sum(path string) ([20]byte, error) {
-	var zero [20]byte
-	f, err := os.Open(path)
-	if err != nil {
-		return zero, err
-	}
-	defer f.Close()
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return zero, err
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+func newReporter(output string, verbose bool) engine.Reporter {
+	if output == outputJSON {
+		return engine.NewJSONReporter(stdout)
 	}
-	var out [20]byte
-	copy(out[:], h.Sum(nil))
-	return out, nil
+	return engine.NewTextReporter(stdout, verbose)
 }
 
-/* =========================
-        HELPERS/UTIL
-========================= */
+// dieSync maps engine validation errors to usage errors with the classic
+// messages; anything else is a runtime failure.
+func dieSync(err error, src, dst string, usage func() string) {
+	absSrc, _ := filepath.Abs(src)
+	absDst, _ := filepath.Abs(dst)
+	switch {
+	case errors.Is(err, engine.ErrSrcNotExist):
+		dieUsage(usage, "error: SRC does not exist: %s\n", src)
+	case errors.Is(err, engine.ErrNotRecursive):
+		dieUsage(usage, "error: SRC is a directory; specify -r for recursive copy\n")
+	case errors.Is(err, engine.ErrSamePath):
+		dieUsage(usage, "error: SRC and DST are the same path:\n  %s\n", absSrc)
+	case errors.Is(err, engine.ErrDstInsideSrc):
+		dieUsage(usage, "error: DST is inside SRC; refused to prevent recursion:\n  DST=%s inside SRC=%s\n", absDst, absSrc)
+	case errors.Is(err, engine.ErrSrcInsideDst):
+		dieUsage(usage, "error: SRC is inside DST; refused to prevent recursion:\n  SRC=%s inside DST=%s\n", absSrc, absDst)
+	case errors.Is(err, engine.ErrInvalidOption):
+		dieUsage(usage, "error: %v\n", err)
+	case errors.Is(err, engine.ErrDeleteLimit):
+		dieDeleteLimit(err)
+	case errors.Is(err, engine.ErrPartial):
+		diePartial(err)
+	}
+	dieRuntime(err)
+}
 
-func absDuration(d time.Duration) time.Duration {
-	if d < 0 {
-		return -d
+// dieDeleteLimit reports a mirror pass stopped by --max-delete or
+// --max-delete-percent.
+func dieDeleteLimit(err error) {
+	var le *engine.DeleteLimitError
+	if !errors.As(err, &le) {
+		dieRuntime(err)
 	}
-	return d
+	printErr(deleteLimitReport(le))
+	exitFn(exitDeleteLimit)
 }
 
-func shouldExclude(rel string, d fs.DirEntry, patterns []string) bool {
-	base := filepath.Base(rel)
-	for _, p := range patterns {
-		if match, _ := filepath.Match(p, base); match {
-			return true
-		}
-		if p == rel || strings.Contains(rel, string(os.PathSeparator)+p+string(os.PathSeparator)) {
-			return true
-		}
-		if strings.HasPrefix(rel, p+string(os.PathSeparator)) {
-			return true
-		}
+func deleteLimitReport(le *engine.DeleteLimitError) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "error: mirror pass refused: would delete %d of %d entries in DST (%.1f%%, size %s)\n",
+		le.Entries, le.Total, le.Percent(), formatSize(le.Bytes))
+	if le.MaxDelete > 0 {
+		fmt.Fprintf(&b, "  --max-delete %d\n", le.MaxDelete)
 	}
-	return false
+	if le.MaxPercent > 0 {
+		fmt.Fprintf(&b, "  --max-delete-percent %g\n", le.MaxPercent)
+	}
+	b.WriteString("would delete:\n")
+	for _, p := range le.Sample {
+		fmt.Fprintf(&b, "  %s\n", p)
+	}
+	if le.More > 0 {
+		fmt.Fprintf(&b, "  ... and %d more\n", le.More)
+	}
+	b.WriteString("Nothing was deleted. Check that SRC is complete (mounted, not emptied), or re-run with --force-delete.\n")
+	return b.String()
 }
 
-func isSubpath(child, parent string) bool {
-	c := strings.ToLower(filepath.Clean(child))
-	p := strings.ToLower(filepath.Clean(parent))
-	if c == p {
-		return false
-	}
-	rel, err := filepath.Rel(p, c)
-	if err != nil {
-		return false
+// diePartial reports a --keep-going run that finished with failures.
+func diePartial(err error) {
+	var pe *engine.PartialError
+	if !errors.As(err, &pe) {
+		dieRuntime(err)
 	}
-	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+	printErr(partialReport(pe))
+	exitFn(exitPartial)
 }
 
-func samePath(a, b string) bool {
-	return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+// partialFailuresShown caps the failures listed per operation.
+const partialFailuresShown = 10
+
+// partialReport lists the failures of pe grouped by operation, in the
+// order each operation first failed.
+func partialReport(pe *engine.PartialError) string {
+	var ops []string
+	groups := map[string][]engine.Failure{}
+	for _, f := range pe.Failures {
+		if _, ok := groups[f.Op]; !ok {
+			ops = append(ops, f.Op)
+		}
+		groups[f.Op] = append(groups[f.Op], f)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "error: %v\n", pe)
+	for _, op := range ops {
+		fs := groups[op]
+		fmt.Fprintf(&b, "  %s (%d):\n", op, len(fs))
+		for i, f := range fs {
+			if i == partialFailuresShown {
+				fmt.Fprintf(&b, "    ... and %d more\n", len(fs)-i)
+				break
+			}
+			path := f.Path
+			if f.Dir {
+				path += string(filepath.Separator)
+			}
+			fmt.Fprintf(&b, "    %s: %s\n", path, f.Reason())
+		}
+	}
+	b.WriteString("Everything else was synced. Fix the causes above and re-run to finish the transfer.\n")
+	return b.String()
 }
 
-func logf(format string, args ...any) { fmt.Printf(format+"\n", args...) }
-func logAlways(msg string)           { fmt.Println(msg) }
+/* =========================
+        HELPERS/UTIL
+========================= */
 
 func dieRuntime(err error) {
 	printErr(fmt.Sprintf("error: %v\n", err))
 	exitFn(exitRuntimeError)
 }
 
-func dieUsagef(format string, a ...any) {
-	printErr(cpUsage())
+func dieUsagef(format string, a ...any) { dieUsage(cpUsage, format, a...) }
+
+func dieUsage(usage func() string, format string, a ...any) {
+	printErr(usage())
 	printErr(fmt.Sprintf(format, a...))
 	exitFn(exitUsage)
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"syncdir/engine"
+)
+
+func planUsage() string {
+	return fmt.Sprintf(`%s plan - record what cp -r would do
+
+Usage:
+  %s plan [--mirror] [--include PATTERN ...] [--exclude PATTERN ...] [--exclude-from FILE ...] [--checksum] [--parallel N] [--links MODE] [--verbose] [--output text|json] [-o FILE] SRC DST
+
+Writes every mkdir/copy/delete (and, with --preserve, metadata update) that
+'cp -r' would perform, together with the SRC/DST sizes and mtimes it saw, to
+FILE (or to stdout when -o is omitted). Review it, then run '%s apply
+FILE'. The cp options --delta, --partial and --progress are not recorded in
+a plan and are refused.
+
+Options:
+  -o FILE        Write the plan to FILE and print the dry-run log
+  --mirror       Plan deletions of files/dirs not present in SRC
+  --include X    Include pattern (can repeat); first matching rule wins
+  --exclude X    Exclude pattern, .gitignore syntax (can repeat)
+  --exclude-from F  Read exclude patterns from a .gitignore-style file (can repeat)
+  --checksum     Compare file hashes to decide copy (--checksum-algo; see 'help cp')
+  --parallel N   Compare up to N files concurrently (default 1)
+  --links MODE   Symlinks inside SRC: copy, preserve, skip or follow (see 'help cp')
+  --abs-links X  With --links=preserve: keep or rewrite absolute targets inside SRC
+  --preserve L   Metadata kinds to sync; recorded in the plan and applied by
+                 'apply', which also runs the planned metadata-only updates
+  --backup       Apply keeps the old version of overwritten and deleted entries
+                 (--backup-dir D and --suffix S as for 'cp'; recorded in the plan)
+  --trash        With --mirror: apply moves the planned deletions to the trash (see
+                 'help restore'); --trash-dir D picks its location
+  --verbose      Verbose logging
+  -i, --itemize-changes  Log planned changes as change codes (see 'help cp')
+  --output F     Log format: text (default) or json
+  --help         Show this help for 'plan'
+
+Examples:
+  %s plan --mirror -o plan.json "E:\src" "\\nas\share\dst"
+  %s apply plan.json
+`, appName, appName, appName, appName, appName)
+}
+
+func applyUsage() string {
+	return fmt.Sprintf(`%s apply - execute a plan file
+
+Usage:
+  %s apply [--dry-run] [--partial] [--bwlimit RATE] [--verbose] [--output text|json] PLAN
+
+Runs the operations in PLAN in order. Before each one, the SRC/DST state is
+compared with what the plan recorded; operations whose preconditions no
+longer hold are refused (reported as "refuse: ...") and skipped, and apply
+exits with status 1.
+
+Options:
+  --dry-run      Check preconditions without changing anything
+  --partial      Keep interrupted copies of large files and resume them (see 'help cp')
+  --bwlimit R    Limit copy throughput, e.g. 10M or "08:00,2M 18:00,off" (see 'help cp')
+  --verbose      Verbose logging
+  --output F     Log format: text (default) or json
+  --help         Show this help for 'apply'
+`, appName, appName)
+}
+
+/* =========================
+       SUBCOMMAND: plan
+========================= */
+
+func runPlan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	var sf syncFlags
+	sf.register(fs)
+	var outFile string
+	fs.StringVar(&outFile, "o", "", "write the plan to FILE")
+	sf.parse(fs, args, planUsage)
+	// cp options a plan does not record, so apply would silently drop them
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "delta", "delta-block":
+			dieUsage(planUsage, "error: --%s is not recorded in a plan; apply copies changed files in full\n", f.Name)
+		case "partial", "partial-dir":
+			dieUsage(planUsage, "error: --%s is not recorded in a plan; give --partial to 'apply' instead\n", f.Name)
+		case "progress":
+			dieUsage(planUsage, "error: --progress is not supported by 'plan'\n")
+		}
+	})
+
+	rest := fs.Args()
+	if len(rest) != 2 {
+		dieUsage(planUsage, "error: need SRC and DST\n")
+	}
+	src, dst := filepath.Clean(rest[0]), filepath.Clean(rest[1])
+
+	if outFile == "" {
+		// stdout carries the plan itself; keep it clean
+		sf.opt.Reporter = engine.NewTextReporter(io.Discard, false)
+	}
+	p, err := engine.New(sf.opt).Plan(src, dst)
+	if err != nil {
+		dieSync(err, src, dst, planUsage)
+	}
+
+	if outFile == "" {
+		if err := engine.WritePlan(stdout, p); err != nil {
+			dieRuntime(err)
+		}
+		return
+	}
+	if err := writePlanFile(outFile, p); err != nil {
+		dieRuntime(err)
+	}
+	if sf.output == outputText {
+		_, _ = fmt.Fprintf(stdout, "plan: %d operations written to %s\n", len(p.Ops), outFile)
+	}
+}
+
+func writePlanFile(path string, p *engine.Plan) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := engine.WritePlan(f, p); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/* =========================
+       SUBCOMMAND: apply
+========================= */
+
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var opt engine.Options
+	var verbose, wantHelp bool
+	var output string
+	fs.BoolVar(&opt.DryRun, "dry-run", false, "check preconditions without changing anything")
+	fs.BoolVar(&opt.Partial, "partial", false, "keep and resume interrupted large copies")
+	fs.Var(bwLimitFlag{&opt.BwLimit}, "bwlimit", "byte-rate limit, e.g. 10M")
+	fs.BoolVar(&verbose, "verbose", false, "verbose logging")
+	fs.StringVar(&output, "output", outputText, "output format: text or json")
+	fs.BoolVar(&wantHelp, "help", false, "show help")
+
+	if err := fs.Parse(args); err != nil {
+		dieUsage(applyUsage, "Argument error: %v\n", err)
+	}
+	if wantHelp {
+		printErr(applyUsage())
+		exitFn(exitUsage)
+	}
+	if output != outputText && output != outputJSON {
+		dieUsage(applyUsage, "error: --output must be %q or %q (got %q)\n", outputText, outputJSON, output)
+	}
+	if fs.NArg() != 1 {
+		dieUsage(applyUsage, "error: need exactly one PLAN file\n")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		dieRuntime(err)
+	}
+	p, err := engine.ReadPlan(f)
+	_ = f.Close()
+	if err != nil {
+		dieUsage(applyUsage, "error: %s: %v\n", fs.Arg(0), err)
+	}
+
+	opt.Reporter = newReporter(output, verbose)
+	if _, err := engine.New(opt).Apply(p); err != nil {
+		if errors.Is(err, engine.ErrPlanStale) {
+			printErr("error: " + err.Error() + "; re-run 'plan' and review again\n")
+			exitFn(exitRuntimeError)
+		}
+		dieRuntime(err)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"syncdir/engine"
+)
+
+func runUsage() string {
+	return fmt.Sprintf(`%s run - run named sync jobs from a profile file
+
+Usage:
+  %s run [--config FILE] NAME [cp options]
+  %s run [--config FILE] --all [cp options]
+
+Runs the profile NAME like 'cp -r' with the profile's SRC, DST and options.
+Options given on the command line come after the profile's: they override
+its single-valued options (--parallel 1, --mirror=false) and add to its
+--include/--exclude rules. With --all every profile runs in file order; a
+failing job is reported and the others still run.
+
+Profiles are read from (a project profile replaces a user one of the same name):
+  user       %s
+  project    %s in the current directory or the nearest parent
+--config FILE reads FILE instead of both.
+
+Profile file:
+  {
+    "profiles": {
+      "photos": {
+        "src": "E:\\photos",
+        "dst": "\\\\nas\\share\\photos",
+        "mirror": true,
+        "exclude": [".git", "*.tmp"],
+        "parallel": 8,
+        "max-delete-percent": 10
+      }
+    }
+  }
+Every key besides "src" and "dst" is a 'cp' option without the dashes: true
+or false for switches, a number or string for values, a list for options that
+can repeat. Relative "src", "dst", "exclude-from" and "checksum-cache" paths
+are relative to the profile file; "backup-dir" and "trash-dir" are relative
+to DST, as for 'cp'.
+
+Options:
+  --config F     Read profiles from F only
+  --all          Run every profile
+  --help         Show this help for 'run'
+
+Examples:
+  %s profiles
+  %s run photos
+  %s run photos --dry-run --verbose
+  %s run --all --output json
+`, appName, appName, appName, userProfilesPath(), projectProfilesName, appName, appName, appName, appName)
+}
+
+func profilesUsage() string {
+	return fmt.Sprintf(`%s profiles - list the sync jobs 'run' knows
+
+Usage:
+  %s profiles [--config FILE]
+
+Prints each profile's name, SRC, DST and the file it comes from. See
+'help run' for where profiles are read from and the file format.
+
+Examples:
+  %s profiles
+  %s profiles --config "D:\jobs\nightly.json"
+`, appName, appName, appName, appName)
+}
+
+const projectProfilesName = ".syncdir.json"
+
+// profile is one named job of a profile file.
+type profile struct {
+	Name string
+	Src  string
+	Dst  string
+	Args []string // cp options in file order, as "--name=value"
+	File string
+}
+
+// userProfilesPath is the user-level profile file.
+func userProfilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, appName, "profiles.json")
+}
+
+// projectProfilesPath finds .syncdir.json in the working directory or the
+// nearest parent; "" when there is none.
+func projectProfilesPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		p := filepath.Join(dir, projectProfilesName)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadProfiles reads config, or else the user and project files. A project
+// profile takes the place of a user profile with the same name.
+func loadProfiles(config string) ([]profile, error) {
+	if config != "" {
+		return readProfiles(config)
+	}
+	var all []profile
+	for _, path := range []string{userProfilesPath(), projectProfilesPath()} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		ps, err := readProfiles(path)
+		if err != nil {
+			return nil, err
+		}
+	next:
+		for _, p := range ps {
+			for i := range all {
+				if all[i].Name == p.Name {
+					all[i] = p
+					continue next
+				}
+			}
+			all = append(all, p)
+		}
+	}
+	return all, nil
+}
+
+// readProfiles parses a profile file, keeping the order of profiles and of
+// their options (rules are order-sensitive).
+func readProfiles(path string) ([]profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var ps []profile
+	err = jsonObject(dec, func(key string) error {
+		if key != "profiles" {
+			return fmt.Errorf("unknown key %q (want \"profiles\")", key)
+		}
+		return jsonObject(dec, func(name string) error {
+			for _, p := range ps {
+				if p.Name == name {
+					return fmt.Errorf("profile %q is defined twice", name)
+				}
+			}
+			p, err := readProfile(dec, name, path)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", name, err)
+			}
+			ps = append(ps, p)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ps, nil
+}
+
+func readProfile(dec *json.Decoder, name, path string) (profile, error) {
+	p := profile{Name: name, File: path}
+	err := jsonObject(dec, func(key string) error {
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		switch key {
+		case "src", "dst":
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return fmt.Errorf("%q must be a path", key)
+			}
+			if !filepath.IsAbs(s) {
+				s = filepath.Join(filepath.Dir(path), s)
+			}
+			if key == "src" {
+				p.Src = s
+			} else {
+				p.Dst = s
+			}
+			return nil
+		}
+		if profilePathOptions[key] {
+			v = relativeTo(filepath.Dir(path), v)
+		}
+		args, err := optionArgs(key, v)
+		p.Args = append(p.Args, args...)
+		return err
+	})
+	if err == nil && (p.Src == "" || p.Dst == "") {
+		err = errors.New(`needs "src" and "dst"`)
+	}
+	return p, err
+}
+
+// profilePathOptions are the options whose relative paths readProfile takes
+// relative to the profile file, like "src" and "dst". On the command line
+// they are relative to the working directory; backup-dir and trash-dir are
+// relative to DST either way.
+var profilePathOptions = map[string]bool{"exclude-from": true, "checksum-cache": true}
+
+// relativeTo joins the relative paths in v, a string or a list, to dir.
+func relativeTo(dir string, v any) any {
+	switch v := v.(type) {
+	case string:
+		if v != "" && !filepath.IsAbs(v) {
+			return filepath.Join(dir, v)
+		}
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = relativeTo(dir, e)
+		}
+		return out
+	}
+	return v
+}
+
+// optionArgs turns one profile option into command-line arguments.
+func optionArgs(key string, v any) ([]string, error) {
+	if key == "" || strings.HasPrefix(key, "-") {
+		return nil, fmt.Errorf("option %q: write option names without dashes", key)
+	}
+	switch v := v.(type) {
+	case bool:
+		return []string{fmt.Sprintf("--%s=%t", key, v)}, nil
+	case json.Number:
+		return []string{"--" + key + "=" + v.String()}, nil
+	case string:
+		return []string{"--" + key + "=" + v}, nil
+	case []any:
+		var args []string
+		for _, e := range v {
+			switch e.(type) {
+			case string, json.Number:
+				args = append(args, fmt.Sprintf("--%s=%v", key, e))
+			default:
+				return nil, fmt.Errorf("option %q: list entries must be strings", key)
+			}
+		}
+		return args, nil
+	}
+	return nil, fmt.Errorf("option %q: want true/false, a number, a string or a list", key)
+}
+
+// jsonObject reads a JSON object from dec, calling each with every key
+// while dec is positioned at its value.
+func jsonObject(dec *json.Decoder, each func(key string) error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("expected an object, got %v", t)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := each(t.(string)); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+/* =========================
+       SUBCOMMAND: run
+========================= */
+
+func runRun(args []string) {
+	var config string
+	var all bool
+flags:
+	for len(args) > 0 {
+		a := args[0]
+		switch {
+		case a == "-h" || a == "--help":
+			printErr(runUsage())
+			exitFn(exitUsage)
+		case a == "--all" || a == "-all":
+			all = true
+		case a == "--config" || a == "-config":
+			if len(args) < 2 {
+				dieUsage(runUsage, "error: --config needs a FILE\n")
+			}
+			config, args = args[1], args[1:]
+		case strings.HasPrefix(a, "--config="):
+			config = strings.TrimPrefix(a, "--config=")
+		default:
+			break flags
+		}
+		args = args[1:]
+	}
+	var name string
+	if !all {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			dieUsage(runUsage, "error: need a profile NAME or --all\n")
+		}
+		name, args = args[0], args[1:]
+	}
+
+	profiles, err := loadProfiles(config)
+	if err != nil {
+		dieUsage(runUsage, "error: %v\n", err)
+	}
+	var jobs []profile
+	for _, p := range profiles {
+		if all || p.Name == name {
+			jobs = append(jobs, p)
+		}
+	}
+	if len(jobs) == 0 {
+		if all {
+			dieUsage(runUsage, "error: no profiles found (see 'help run')\n")
+		}
+		dieUsage(runUsage, "error: no profile named %q (see '%s profiles')\n", name, appName)
+	}
+
+	// parse every job first, so a typo fails before anything runs
+	flags := make([]syncFlags, len(jobs))
+	for i, p := range jobs {
+		sf := &flags[i]
+		fs := newCpFlags(sf)
+		sf.opt.Recursive = true
+		if err := fs.Parse(p.Args); err != nil {
+			dieUsage(runUsage, "error: %s: profile %q: %v\n", p.File, p.Name, err)
+		}
+		sf.parse(fs, args, runUsage)
+		if fs.NArg() != 0 {
+			dieUsage(runUsage, "error: unexpected argument %q; SRC and DST come from the profile\n", fs.Arg(0))
+		}
+	}
+
+	if !all {
+		res, err := engine.New(flags[0].opt).Sync(jobs[0].Src, jobs[0].Dst)
+		flags[0].printStats(res)
+		if err != nil {
+			dieSync(err, jobs[0].Src, jobs[0].Dst, runUsage)
+		}
+		return
+	}
+	failed, code := 0, exitOK
+	for i, p := range jobs {
+		if flags[i].output == outputText {
+			_, _ = fmt.Fprintf(stdout, "run: %s: %s -> %s\n", p.Name, p.Src, p.Dst)
+		}
+		res, err := engine.New(flags[i].opt).Sync(p.Src, p.Dst)
+		flags[i].printStats(res)
+		if err != nil {
+			failed++
+			c := exitRuntimeError
+			if errors.Is(err, engine.ErrDeleteLimit) {
+				c = exitDeleteLimit
+			} else if errors.Is(err, engine.ErrPartial) {
+				c = exitPartial
+			}
+			if code == exitOK {
+				code = c
+			}
+			var le *engine.DeleteLimitError
+			var pe *engine.PartialError
+			if errors.As(err, &le) {
+				printErr(fmt.Sprintf("profile %q: %s", p.Name, deleteLimitReport(le)))
+			} else if errors.As(err, &pe) {
+				printErr(fmt.Sprintf("profile %q: %s", p.Name, partialReport(pe)))
+			} else {
+				printErr(fmt.Sprintf("error: profile %q: %v\n", p.Name, err))
+			}
+		}
+	}
+	if failed > 0 {
+		printErr(fmt.Sprintf("run: %d of %d profile(s) failed\n", failed, len(jobs)))
+		exitFn(code)
+	}
+}
+
+/* =========================
+     SUBCOMMAND: profiles
+========================= */
+
+func runProfiles(args []string) {
+	fs := flag.NewFlagSet("profiles", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var config string
+	var wantHelp bool
+	fs.StringVar(&config, "config", "", "profile file")
+	fs.BoolVar(&wantHelp, "help", false, "show help")
+	if err := fs.Parse(args); err != nil {
+		dieUsage(profilesUsage, "Argument error: %v\n", err)
+	}
+	if wantHelp {
+		printErr(profilesUsage())
+		exitFn(exitUsage)
+	}
+	if fs.NArg() != 0 {
+		dieUsage(profilesUsage, "error: unexpected argument %q\n", fs.Arg(0))
+	}
+	profiles, err := loadProfiles(config)
+	if err != nil {
+		dieUsage(profilesUsage, "error: %v\n", err)
+	}
+	width := 0
+	for _, p := range profiles {
+		width = max(width, len(p.Name))
+	}
+	for _, p := range profiles {
+		_, _ = fmt.Fprintf(stdout, "%-*s  %s -> %s  (%s)\n", width, p.Name, p.Src, p.Dst, p.File)
+	}
+}
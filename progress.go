@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"syncdir/engine"
+)
+
+/* =========================
+          PROGRESS
+========================= */
+
+// progressLineEvery is how often a plain progress line is printed when
+// stderr is not a terminal (logs, CI); a terminal is redrawn on every update.
+const progressLineEvery = 5 * time.Second
+
+// progressPrinter renders engine.Progress snapshots to w.
+type progressPrinter struct {
+	w     io.Writer
+	tty   bool
+	last  time.Time
+	width int // of the line on the terminal, which a shorter one must cover
+}
+
+func newProgressPrinter(w io.Writer) *progressPrinter {
+	return &progressPrinter{w: w, tty: isTerminal(w)}
+}
+
+func (p *progressPrinter) print(pr engine.Progress) {
+	line := progressLine(pr)
+	if p.tty {
+		// \r and redraw in place, padding over the rest of a longer line:
+		// no escape sequences, which a Windows console without VT mode
+		// prints as they are; the final line is kept
+		n := utf8.RuneCountInString(line)
+		_, _ = fmt.Fprint(p.w, "\r"+line+strings.Repeat(" ", max(p.width-n, 0)))
+		p.width = n
+		if pr.Done {
+			_, _ = fmt.Fprintln(p.w)
+		}
+		return
+	}
+	if !pr.Done && time.Since(p.last) < progressLineEvery {
+		return
+	}
+	p.last = time.Now()
+	_, _ = fmt.Fprintln(p.w, line)
+}
+
+// progressLine formats one snapshot, e.g.
+// "12/340 files  1.2G/5.0G  24%  38.1M/s  ETA 1m52s  dir/file.bin".
+func progressLine(pr engine.Progress) string {
+	// with no bytes to copy (empty files only, or nothing yet counted) the
+	// share of files finished stands in; 100% only once the run is done
+	pct := 0
+	switch {
+	case pr.BytesTotal > 0:
+		pct = int(min(pr.Bytes*100/pr.BytesTotal, 100))
+	case pr.Done:
+		pct = 100
+	case pr.FilesTotal > 0:
+		pct = min(pr.Files*100/pr.FilesTotal, 100)
+	}
+	parts := []string{
+		fmt.Sprintf("%d/%d files", pr.Files, pr.FilesTotal),
+		fmt.Sprintf("%s/%s", formatSize(pr.Bytes), formatSize(pr.BytesTotal)),
+		fmt.Sprintf("%3d%%", pct),
+		formatSize(int64(pr.Rate)) + "/s",
+	}
+	switch {
+	case pr.Done:
+		parts = append(parts, "done in "+pr.Elapsed.Round(time.Second).String())
+	case pr.ETA > 0:
+		parts = append(parts, "ETA "+pr.ETA.Round(time.Second).String())
+	default:
+		parts = append(parts, "ETA -")
+	}
+	if !pr.Done && pr.Current != "" {
+		parts = append(parts, pr.Current)
+	}
+	return strings.Join(parts, "  ")
+}
+
+// formatSize prints a byte count with a binary suffix, the inverse of
+// engine.ParseSize: 512, 1.5K, 38.1M, 2.0G.
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
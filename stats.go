@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"syncdir/engine"
+)
+
+/* =========================
+          STATISTICS
+========================= */
+
+// printStats writes the --stats table of res to stdout after a text-mode
+// run. A run that failed validation did nothing and gets no table; with
+// --output json the numbers are in the summary event instead.
+func (sf *syncFlags) printStats(res engine.Result) {
+	if !sf.stats || sf.output != outputText || res.Counts == nil {
+		return
+	}
+	_, _ = fmt.Fprint(stdout, statsTable(res.Stats))
+}
+
+// statsTable formats st as aligned "label  value" rows; byte counts are
+// given exactly and in binary units.
+func statsTable(st engine.Stats) string {
+	bytes := func(n int64) string {
+		if n < 1024 {
+			return fmt.Sprintf("%d", n)
+		}
+		return fmt.Sprintf("%s (%d)", formatSize(n), n)
+	}
+	rows := [][2]string{
+		{"Files scanned", fmt.Sprint(st.FilesScanned)},
+		{"Files copied", fmt.Sprint(st.FilesCopied)},
+		{"Files skipped", fmt.Sprint(st.FilesSkipped)},
+		{"Excluded", fmt.Sprint(st.Excluded)},
+		{"Deleted", fmt.Sprint(st.Deleted)},
+		{"Directories created", fmt.Sprint(st.DirsCreated)},
+		{"Bytes read", bytes(st.BytesRead)},
+		{"Bytes written", bytes(st.BytesWritten)},
+		{"Bytes hashed", bytes(st.BytesHashed)},
+		{"Errors", fmt.Sprint(st.Errors)},
+		{"Elapsed", st.Elapsed.Round(time.Millisecond).String()},
+		{"Throughput", formatSize(int64(st.Throughput())) + "/s"},
+	}
+	var b strings.Builder
+	b.WriteString("Statistics:\n")
+	for _, r := range rows {
+		fmt.Fprintf(&b, "  %-20s %s\n", r[0]+":", r[1])
+	}
+	return b.String()
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"crypto/sha1"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"testing"
 	"time"
-	"errors"
+
+	"syncdir/engine"
 )
 
 // ---------- helpers ----------
@@ -24,364 +25,622 @@ func writeFile(t *testing.T, path string, data []byte) {
 	}
 }
 
-func readFile(t *testing.T, path string) []byte {
-	t.Helper()
-	b, err := os.ReadFile(path)
-	if err != nil {
-		t.Fatalf("read %s: %v", path, err)
+// ---------- CLI ----------
+
+func TestMain_HelpAndVersion(t *testing.T) {
+	// --help は usage を出して exit 2
+	code, errOut := runWithIntercept(t, []string{"--help"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "Usage:") {
+		t.Fatalf("--help: want code=%d and usage in stderr, got code=%d, stderr=%q", exitUsage, code, errOut)
+	}
+
+	// version は exit 0（stderr ではなく stdout に出るのでコードのみ検査）
+	code, _ = runWithIntercept(t, []string{"version"}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("version: want code=%d, got %d", exitOK, code)
+	}
+
+	// 未知コマンドは usage + Unknown command で exit 2
+	code, errOut = runWithIntercept(t, []string{"wat"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "Unknown command") {
+		t.Fatalf("wat: want code=%d and 'Unknown command', got code=%d, stderr=%q", exitUsage, code, errOut)
 	}
-	return b
 }
 
-// ---------- unit: path relations ----------
+func TestRunCp_Errors_ShowUsage(t *testing.T) {
+	// 引数不足
+	code, errOut := runWithIntercept(t, nil, func() { runCp([]string{}) })
+	if code != exitUsage || !strings.Contains(errOut, "need SRC and DST") {
+		t.Fatalf("need SRC/DST: code=%d stderr=%q", code, errOut)
+	}
 
-func TestIsSubpathAndSamePath(t *testing.T) {
-	root := t.TempDir()
-	child := filepath.Join(root, "child")
-	sibling := filepath.Join(root, "sibling")
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "srcdir")
+	dst := filepath.Join(tmp, "dstdir")
+	_ = os.MkdirAll(src, 0o755)
 
-	if err := os.MkdirAll(child, 0o755); err != nil {
-		t.Fatal(err)
+	// -r なしでディレクトリ
+	code, errOut = runWithIntercept(t, nil, func() { runCp([]string{src, dst}) })
+	if code != exitUsage || !strings.Contains(errOut, "specify -r") {
+		t.Fatalf("dir without -r: code=%d stderr=%q", code, errOut)
 	}
-	if err := os.MkdirAll(sibling, 0o755); err != nil {
-		t.Fatal(err)
+
+	// 同一パス
+	code, errOut = runWithIntercept(t, nil, func() { runCp([]string{"-r", src, src}) })
+	if code != exitUsage || !strings.Contains(errOut, "same path") {
+		t.Fatalf("same path: code=%d stderr=%q", code, errOut)
 	}
 
-	absRoot, _ := filepath.Abs(root)
-	absChild, _ := filepath.Abs(child)
-	absSibling, _ := filepath.Abs(sibling)
+	// 入れ子（DSTがSRCの内側）
+	inner := filepath.Join(src, "inner")
+	code, errOut = runWithIntercept(t, nil, func() { runCp([]string{"-r", src, inner}) })
+	if code != exitUsage || !strings.Contains(errOut, "DST is inside SRC") {
+		t.Fatalf("nest: code=%d stderr=%q", code, errOut)
+	}
+}
+func runWithIntercept(t *testing.T, args []string, f func()) (code int, errOut string) {
+	t.Helper()
+
+	oldExit, oldErr, oldArgs := exitFn, stderr, os.Args
+	defer func() { exitFn, stderr, os.Args = oldExit, oldErr, oldArgs }()
+
+	var buf bytes.Buffer
+	stderr = &buf
+	exitFn = func(c int) { panic(c) }
+	os.Args = append([]string{appName}, args...)
+
+	defer func() {
+		if r := recover(); r != nil {
+			if c, ok := r.(int); ok {
+				code = c
+			} else {
+				t.Fatalf("unexpected panic: %#v", r)
+			}
+		}
+		errOut = buf.String()
+	}()
+
+	f() // ここで main() や runCp(...) を直接呼ぶ
+	return
+}
+func TestHelp_TopicCp(t *testing.T) {
+	code, errOut := runWithIntercept(t, []string{"help", "cp"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "cp - copy/sync") {
+		t.Fatalf("help cp: code=%d stderr=%q", code, errOut)
+	}
+}
+func TestCp_HelpFlag(t *testing.T) {
+	code, errOut := runWithIntercept(t, nil, func() { runCp([]string{"--help"}) })
+	if code != exitUsage || !strings.Contains(errOut, "cp - copy/sync") {
+		t.Fatalf("cp --help: code=%d stderr=%q", code, errOut)
+	}
+}
+func TestDieHelpers(t *testing.T) {
+	code, errOut := runWithIntercept(t, nil, func() { dieUsagef("oops %d", 1) })
+	if code != exitUsage || !strings.Contains(errOut, "cp - copy/sync") || !strings.Contains(errOut, "oops 1") {
+		t.Fatalf("dieUsagef: code=%d stderr=%q", code, errOut)
+	}
 
-	if !isSubpath(absChild, absRoot) {
-		t.Fatalf("expected %q to be subpath of %q", absChild, absRoot)
+	code, errOut = runWithIntercept(t, nil, func() { dieRuntime(errors.New("boom")) })
+	if code != exitRuntimeError || !strings.Contains(errOut, "boom") {
+		t.Fatalf("dieRuntime: code=%d stderr=%q", code, errOut)
 	}
-	if isSubpath(absSibling, absChild) {
-		t.Fatalf("did not expect %q to be subpath of %q", absSibling, absChild)
+}
+func TestRunCp_ParallelInvalid(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "out")
+	code, errOut := runWithIntercept(t, nil, func() { runCp([]string{"-r", "--parallel", "0", src, dst}) })
+	if code != exitUsage || !strings.Contains(errOut, "--parallel") {
+		t.Fatalf("--parallel 0: code=%d stderr=%q", code, errOut)
 	}
-	if samePath(absRoot, strings.Clone(absRoot)) != true {
-		t.Fatalf("samePath should be true for identical paths")
+}
+
+func TestRunCp_OutputJSON(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "out")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(src, "skip.tmp"), []byte("x"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, nil, func() {
+		runCp([]string{"-r", "--output", "json", "--exclude", "*.tmp", src, dst})
+		exitFn(exitOK)
+	})
+	if code != exitOK {
+		t.Fatalf("cp --output json: code=%d stderr=%q", code, errOut)
 	}
 
-	// Case-insensitive check (Windows前提だが、関数は小文字化して比較している)
-	if runtime.GOOS == "windows" {
-		upper := strings.ToUpper(absRoot)
-		if !samePath(absRoot, upper) {
-			t.Fatalf("samePath should treat case-insensitively on Windows")
+	var evs []engine.Event
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var ev engine.Event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("decode: %v\n%s", err, out.String())
 		}
+		evs = append(evs, ev)
+	}
+	types := map[string]engine.Event{}
+	for _, ev := range evs {
+		types[ev.Type] = ev
+	}
+	if ev := types[engine.EventCopy]; ev.Path != "a.txt" || ev.Size != 5 || ev.Reason != "new" {
+		t.Fatalf("copy event = %+v", ev)
+	}
+	if ev := types[engine.EventExclude]; ev.Path != "skip.tmp" {
+		t.Fatalf("exclude event = %+v", ev)
+	}
+	if _, ok := types[engine.EventMkdir]; !ok {
+		t.Fatalf("missing mkdir event: %+v", evs)
+	}
+	last := evs[len(evs)-1]
+	if last.Type != engine.EventSummary || last.Counts[engine.EventCopy] != 1 || last.Size != 5 {
+		t.Fatalf("last event should be summary, got %+v", last)
 	}
 }
 
-func TestShouldExclude(t *testing.T) {
-	patterns := []string{".git", "*.tmp", "node_modules"}
+func TestRunCp_OutputInvalid(t *testing.T) {
+	src := t.TempDir()
+	code, errOut := runWithIntercept(t, nil, func() { runCp([]string{"-r", "--output", "xml", src, src + "-out"}) })
+	if code != exitUsage || !strings.Contains(errOut, "--output") {
+		t.Fatalf("--output xml: code=%d stderr=%q", code, errOut)
+	}
+}
 
-	yes := []string{
-		filepath.Join("foo", ".git"),
-		filepath.Join("foo", "node_modules", "pkg", "index.js"),
-		filepath.Join("foo", "bar.tmp"),
+func TestPlanAndApplyCommands(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "out")
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, []string{"plan", "-o", planFile, src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "operations written") {
+		t.Fatalf("plan: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
 	}
-	no := []string{
-		filepath.Join("foo", ".gitignore"),
-		filepath.Join("foo", "bar.txt"),
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("plan must not create DST")
 	}
 
-	for _, rel := range yes {
-		if !shouldExclude(rel, nil, patterns) {
-			t.Fatalf("shouldExclude(%q) = false, want true", rel)
-		}
+	code, errOut = runWithIntercept(t, []string{"apply", planFile}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("apply: code=%d stderr=%q", code, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil {
+		t.Fatalf("apply did not copy: %v", err)
+	}
+
+	// 同じ plan をもう一度 → DST が既にあるので refuse
+	code, errOut = runWithIntercept(t, []string{"apply", planFile}, func() { main() })
+	if code != exitRuntimeError || !strings.Contains(errOut, "plan is stale") {
+		t.Fatalf("re-apply: code=%d stderr=%q", code, errOut)
 	}
-	for _, rel := range no {
-		if shouldExclude(rel, nil, patterns) {
-			t.Fatalf("shouldExclude(%q) = true, want false", rel)
+
+	// cp options a plan cannot carry are refused, not dropped
+	for _, flag := range []string{"--delta", "--delta-block=64K", "--partial", "--partial-dir=.p", "--progress"} {
+		code, errOut = runWithIntercept(t, []string{"plan", flag, "-o", planFile, src, dst}, func() { main() })
+		if code != exitUsage || !strings.Contains(errOut, "not") {
+			t.Errorf("plan %s: code=%d stderr=%q", flag, code, errOut)
 		}
 	}
 }
 
-// ---------- unit: primitives ----------
+func TestBisyncCommand(t *testing.T) {
+	a := t.TempDir()
+	b := t.TempDir()
+	state := filepath.Join(t.TempDir(), "state.json")
+	writeFile(t, filepath.Join(a, "x.txt"), []byte("a"))
+	writeFile(t, filepath.Join(b, "y.txt"), []byte("b"))
+
+	code, errOut := runWithIntercept(t, []string{"bisync", "--state", state, a, b}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("bisync: code=%d stderr=%q", code, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(b, "x.txt")); err != nil {
+		t.Fatalf("x.txt not copied to B: %v", err)
+	}
 
-func TestAbsDuration(t *testing.T) {
-	if absDuration(-5*time.Second) != 5*time.Second {
-		t.Fatal("absDuration failed for negative duration")
+	// prompt: 標準入力の答え "b" で B 側を採用
+	writeFile(t, filepath.Join(a, "y.txt"), []byte("edited in A"))
+	writeFile(t, filepath.Join(b, "y.txt"), []byte("edited in B!"))
+	oldIn := stdin
+	stdin = strings.NewReader("?\nb\n")
+	defer func() { stdin = oldIn }()
+	code, errOut = runWithIntercept(t, []string{"bisync", "--state", state, "--conflict", "prompt", a, b}, func() { main() })
+	if code != exitOK || !strings.Contains(errOut, "[k] keep both") {
+		t.Fatalf("bisync prompt: code=%d stderr=%q", code, errOut)
 	}
-	if absDuration(3*time.Second) != 3*time.Second {
-		t.Fatal("absDuration failed for positive duration")
+	if got, _ := os.ReadFile(filepath.Join(a, "y.txt")); string(got) != "edited in B!" {
+		t.Fatalf("A/y.txt = %q, want B's version", got)
+	}
+
+	code, errOut = runWithIntercept(t, []string{"bisync", "--conflict", "coin-flip", a, b}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "--conflict must be") {
+		t.Fatalf("bad policy: code=%d stderr=%q", code, errOut)
 	}
 }
 
-func TestSha1sum(t *testing.T) {
-	dir := t.TempDir()
-	f := filepath.Join(dir, "x.txt")
-	data := []byte("hello syncdir")
-	writeFile(t, f, data)
+func TestWatchCommand_Usage(t *testing.T) {
+	code, errOut := runWithIntercept(t, []string{"help", "watch"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "watch - keep DST in sync") {
+		t.Fatalf("help watch: code=%d stderr=%q", code, errOut)
+	}
+	code, errOut = runWithIntercept(t, []string{"watch", "--debounce", "0s", "a", "b"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "--debounce must be positive") {
+		t.Fatalf("bad debounce: code=%d stderr=%q", code, errOut)
+	}
+	src := filepath.Join(t.TempDir(), "file.txt")
+	writeFile(t, src, []byte("x"))
+	code, errOut = runWithIntercept(t, []string{"watch", src, t.TempDir()}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "directory SRC") {
+		t.Fatalf("file SRC: code=%d stderr=%q", code, errOut)
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	for n, want := range map[int64]string{0: "0", 1023: "1023", 1536: "1.5K", 40 << 20: "40.0M", 3 << 30: "3.0G"} {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+	got := progressLine(engine.Progress{Files: 1, FilesTotal: 4, Bytes: 1 << 20, BytesTotal: 4 << 20, Rate: 1 << 20, ETA: 3 * time.Second, Current: "a/b.bin"})
+	if want := "1/4 files  1.0M/4.0M   25%  1.0M/s  ETA 3s  a/b.bin"; got != want {
+		t.Fatalf("progressLine = %q, want %q", got, want)
+	}
+	for _, c := range []struct {
+		pr   engine.Progress
+		want string
+	}{
+		{engine.Progress{}, "0/0 files  0/0    0%"},
+		{engine.Progress{Files: 1, FilesTotal: 4}, "1/4 files  0/0   25%"},
+		{engine.Progress{Files: 4, FilesTotal: 4, Done: true}, "4/4 files  0/0  100%"},
+	} {
+		if got := progressLine(c.pr); !strings.HasPrefix(got, c.want) {
+			t.Errorf("progressLine(%+v) = %q, want prefix %q", c.pr, got, c.want)
+		}
+	}
 
-	got, err := sha1sum(f)
-	if err != nil {
-		t.Fatalf("sha1sum: %v", err)
+	// not a terminal: the first line, then nothing until the final one
+	var buf bytes.Buffer
+	p := newProgressPrinter(&buf)
+	p.print(engine.Progress{FilesTotal: 1, BytesTotal: 1})
+	p.print(engine.Progress{Files: 1, FilesTotal: 1, Bytes: 1, BytesTotal: 1, Done: true})
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "done in") {
+		t.Fatalf("printer output = %q", buf.String())
 	}
-	want := sha1.Sum(data)
-	if got != want {
-		t.Fatalf("sha1 mismatch: got %x want %x", got, want)
+
+	// a terminal: redrawn with \r, a shorter line padded over the longer one
+	buf.Reset()
+	p = &progressPrinter{w: &buf, tty: true}
+	p.print(engine.Progress{FilesTotal: 1, BytesTotal: 1, Current: "long/name.bin"})
+	first := buf.String()
+	p.print(engine.Progress{FilesTotal: 1, BytesTotal: 1})
+	second := strings.TrimPrefix(buf.String(), first)
+	if strings.Contains(buf.String(), "\033") || !strings.HasPrefix(second, "\r") || len(second) != len(first) {
+		t.Fatalf("terminal output = %q", buf.String())
 	}
 }
 
-// ---------- unit/integration: file equality & copy ----------
+func TestTrashCommands(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(dst, "old.txt"), []byte("old"))
 
-func TestSameFileAndCopyOneFile(t *testing.T) {
-	dir := t.TempDir()
-	src := filepath.Join(dir, "src.txt")
-	dst := filepath.Join(dir, "dst.txt")
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
 
-	writeFile(t, src, []byte("abc"))
-	// 初回コピー
-	if err := copyOneFile(src, dst, options{}); err != nil {
-		t.Fatalf("copyOneFile: %v", err)
+	code, errOut := runWithIntercept(t, []string{"cp", "-r", "--mirror", "--trash", src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "trash: 1 item(s) moved to") {
+		t.Fatalf("cp --trash: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
 	}
-	// 同一判定（サイズ＆mtime）
-	si, _ := os.Stat(src)
-	di, _ := os.Stat(dst)
-	same, err := sameFile(src, dst, si, di, options{})
-	if err != nil {
-		t.Fatalf("sameFile: %v", err)
+	trashDir := filepath.Join(dst, ".syncdir-trash")
+	runs, err := engine.ListTrash(trashDir)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("ListTrash = %v, %v", runs, err)
 	}
-	if !same {
-		t.Fatalf("sameFile should be true right after copy")
+
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"trash", "list", trashDir}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), runs[0].ID+"  ") {
+		t.Fatalf("trash list: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
 	}
 
-	// 中身を更新 → same=false
-	time.Sleep(2 * time.Second) // CIでの時間解像度/負荷に余裕を持たせる
-	writeFile(t, src, []byte("abcd"))
-	si, _ = os.Stat(src)
-	di, _ = os.Stat(dst)
-	same, _ = sameFile(src, dst, si, di, options{})
-	if same {
-		t.Fatalf("sameFile should be false after content change")
+	code, errOut = runWithIntercept(t, []string{"restore", runs[0].ID}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "needs --dst DST or --trash-dir DIR") {
+		t.Fatalf("restore bare id: code=%d stderr=%q", code, errOut)
+	}
+	code, errOut = runWithIntercept(t, []string{"restore", "--dry-run", "--trash-dir", trashDir, runs[0].ID}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("restore --trash-dir: code=%d stderr=%q", code, errOut)
+	}
+	code, errOut = runWithIntercept(t, []string{"restore", "--dst", dst, runs[0].ID}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("restore --dst: code=%d stderr=%q", code, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old.txt")); err != nil {
+		t.Fatalf("old.txt not restored: %v", err)
 	}
 
-	// checksum オプションでも検証
-	same, _ = sameFile(src, dst, si, di, options{checksum: true})
-	if same {
-		t.Fatalf("sameFile(checksum) should be false after content change")
+	code, errOut = runWithIntercept(t, []string{"trash", "purge", trashDir}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "--older-than") {
+		t.Fatalf("purge without age: code=%d stderr=%q", code, errOut)
+	}
+	for in, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "1d12h": 36 * time.Hour, "90m": 90 * time.Minute} {
+		if got, err := parseAge(in); err != nil || got != want {
+			t.Errorf("parseAge(%q) = %v, %v", in, got, err)
+		}
 	}
 }
 
-// ---------- integration: syncDir copy & mirror ----------
-
-func TestSyncDir_CopyAndMirror(t *testing.T) {
+func TestCp_MaxDelete(t *testing.T) {
 	src := t.TempDir()
-	dst := t.TempDir()
-
-	// SRCにファイル群を作成
-	writeFile(t, filepath.Join(src, "a.txt"), []byte("hello"))
-	writeFile(t, filepath.Join(src, "dir1", "b.txt"), []byte("world"))
-	writeFile(t, filepath.Join(src, "node_modules", "skip.txt"), []byte("skip me"))
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(dst, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(dst, "b.txt"), []byte("b"))
 
-	// 1回目：差分コピー + 除外
-	opt := options{recursive: true, mirror: false, dryRun: false, excludes: []string{"node_modules"}}
-	if err := syncDir(src, dst, opt); err != nil {
-		t.Fatalf("syncDir(copy): %v", err)
+	code, errOut := runWithIntercept(t, []string{"cp", "-r", "--mirror", "--max-delete", "1", src, dst}, func() { main() })
+	if code != exitDeleteLimit || !strings.Contains(errOut, "would delete 2 of 2 entries") || !strings.Contains(errOut, "--force-delete") {
+		t.Fatalf("code=%d stderr=%q", code, errOut)
 	}
 	if _, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil {
+		t.Fatalf("a.txt deleted: %v", err)
+	}
+
+	code, errOut = runWithIntercept(t, []string{"cp", "-r", "--mirror", "--max-delete-percent", "150", src, dst}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "between 0 and 100") {
+		t.Fatalf("code=%d stderr=%q", code, errOut)
+	}
+
+	code, errOut = runWithIntercept(t, []string{"cp", "-r", "--mirror", "--max-delete", "1", "--force-delete", src, dst}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("--force-delete: code=%d stderr=%q", code, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); !os.IsNotExist(err) {
+		t.Fatal("a.txt not deleted with --force-delete")
+	}
+}
+
+func TestRunProfiles(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	t.Setenv("AppData", filepath.Join(root, "config"))
+	writeFile(t, filepath.Join(root, "src", "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(root, "src", "b.tmp"), []byte("b"))
+	writeFile(t, filepath.Join(root, "config", appName, "profiles.json"), []byte(`{"profiles": {
+		"docs": {"src": "/nonexistent", "dst": "/nonexistent"},
+		"home": {"src": "../../src", "dst": "../../home"}
+	}}`))
+	writeFile(t, filepath.Join(root, "proj", projectProfilesName), []byte(`{"profiles": {
+		"docs": {"src": "../src", "dst": "out", "mirror": true, "exclude": ["*.tmp"], "parallel": 2,
+			"exclude-from": ["ignore.txt"], "checksum": true, "checksum-cache": "cache"}
+	}}`))
+	writeFile(t, filepath.Join(root, "proj", "ignore.txt"), []byte("*.log\n"))
+	writeFile(t, filepath.Join(root, "src", "c.log"), []byte("c"))
+	if err := os.MkdirAll(filepath.Join(root, "proj", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(filepath.Join(root, "proj", "sub"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, []string{"profiles"}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "docs  "+filepath.Join(root, "src")) || !strings.Contains(out.String(), "home  ") {
+		t.Fatalf("profiles: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
+
+	// the project's "docs" replaced the user's; profile rules apply
+	code, errOut = runWithIntercept(t, []string{"run", "docs"}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("run docs: code=%d stderr=%q", code, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(root, "proj", "out", "a.txt")); err != nil {
 		t.Fatalf("a.txt not copied: %v", err)
 	}
-	if _, err := os.Stat(filepath.Join(dst, "dir1", "b.txt")); err != nil {
-		t.Fatalf("dir1/b.txt not copied: %v", err)
+	if _, err := os.Stat(filepath.Join(root, "proj", "out", "b.tmp")); !os.IsNotExist(err) {
+		t.Fatal("b.tmp copied despite the profile's exclude")
 	}
-	if _, err := os.Stat(filepath.Join(dst, "node_modules", "skip.txt")); !os.IsNotExist(err) {
-		t.Fatalf("excluded file should not exist in dst")
+	// exclude-from and checksum-cache (below) are relative to the profile file
+	if _, err := os.Stat(filepath.Join(root, "proj", "out", "c.log")); !os.IsNotExist(err) {
+		t.Fatal("c.log copied despite the profile's exclude-from")
 	}
 
-	// DSTだけに余分を作っておく
-	writeFile(t, filepath.Join(dst, "extra.txt"), []byte("remove me"))
+	// command-line options come after the profile's
+	writeFile(t, filepath.Join(root, "proj", "out", "extra.txt"), []byte("x"))
+	code, errOut = runWithIntercept(t, []string{"run", "docs", "--mirror=false"}, func() { main() })
+	if _, err := os.Stat(filepath.Join(root, "proj", "out", "extra.txt")); code != exitOK || err != nil {
+		t.Fatalf("--mirror=false: code=%d stderr=%q err=%v", code, errOut, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "proj", "cache")); err != nil {
+		t.Fatalf("checksum cache not next to the profile: %v", err)
+	}
 
-	// 2回目：ミラーで余分削除（除外は尊重）
-	opt = options{recursive: true, mirror: true, dryRun: false, excludes: []string{"node_modules"}}
-	if err := syncDir(src, dst, opt); err != nil {
-		t.Fatalf("syncDir(mirror): %v", err)
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"run", "--all"}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "run: home: ") {
+		t.Fatalf("run --all: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
 	}
-	if _, err := os.Stat(filepath.Join(dst, "extra.txt")); !os.IsNotExist(err) {
-		t.Fatalf("extra.txt should be removed in mirror mode")
+
+	code, errOut = runWithIntercept(t, []string{"run", "nope"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, `no profile named "nope"`) {
+		t.Fatalf("run nope: code=%d stderr=%q", code, errOut)
+	}
+	bad := filepath.Join(root, "bad.json")
+	writeFile(t, bad, []byte(`{"profiles": {"x": {"src": "a", "dst": "b", "paralel": 2}}}`))
+	code, errOut = runWithIntercept(t, []string{"run", "--config", bad, "x"}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "paralel") {
+		t.Fatalf("unknown option: code=%d stderr=%q", code, errOut)
 	}
 }
 
-// ---------- unit: ensureDir dry-run ----------
+func TestCacheRebuildCommand(t *testing.T) {
+	tree := t.TempDir()
+	cache := t.TempDir()
+	writeFile(t, filepath.Join(tree, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(tree, "sub", "b.txt"), []byte("b"))
 
-func TestEnsureDir_DryRun(t *testing.T) {
-	parent := t.TempDir()
-	target := filepath.Join(parent, "newdir")
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
 
-	// dry-runなら作られない
-	if err := ensureDir(target, options{dryRun: true}); err != nil {
-		t.Fatalf("ensureDir(dry-run) error: %v", err)
+	code, errOut := runWithIntercept(t, []string{"cache", "rebuild", "--checksum-cache", cache, tree}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "cache: 2 file(s) hashed") {
+		t.Fatalf("code=%d stdout=%q stderr=%q", code, out.String(), errOut)
 	}
-	if _, err := os.Stat(target); !os.IsNotExist(err) {
-		t.Fatalf("directory should not be created in dry-run")
+	if des, _ := os.ReadDir(cache); len(des) != 1 {
+		t.Fatalf("cache dir holds %d entries", len(des))
+	}
+	code, errOut = runWithIntercept(t, []string{"cache", "rebuild", "--checksum-cache", cache, filepath.Join(tree, "missing")}, func() { main() })
+	if code != exitUsage {
+		t.Fatalf("missing tree: code=%d stderr=%q", code, errOut)
 	}
 }
 
-func TestMain_HelpAndVersion(t *testing.T) {
-    // --help は usage を出して exit 2
-    code, errOut := runWithIntercept(t, []string{"--help"}, func() { main() })
-    if code != exitUsage || !strings.Contains(errOut, "Usage:") {
-        t.Fatalf("--help: want code=%d and usage in stderr, got code=%d, stderr=%q", exitUsage, code, errOut)
-    }
-
-    // version は exit 0（stderr ではなく stdout に出るのでコードのみ検査）
-    code, _ = runWithIntercept(t, []string{"version"}, func() { main() })
-    if code != exitOK {
-        t.Fatalf("version: want code=%d, got %d", exitOK, code)
-    }
-
-    // 未知コマンドは usage + Unknown command で exit 2
-    code, errOut = runWithIntercept(t, []string{"wat"}, func() { main() })
-    if code != exitUsage || !strings.Contains(errOut, "Unknown command") {
-        t.Fatalf("wat: want code=%d and 'Unknown command', got code=%d, stderr=%q", exitUsage, code, errOut)
-    }
-}
+func TestCp_ChecksumAlgo(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
 
-func TestRunCp_Errors_ShowUsage(t *testing.T) {
-    // 引数不足
-    code, errOut := runWithIntercept(t, nil, func() { runCp([]string{}) })
-    if code != exitUsage || !strings.Contains(errOut, "need SRC and DST") {
-        t.Fatalf("need SRC/DST: code=%d stderr=%q", code, errOut)
-    }
-
-    tmp := t.TempDir()
-    src := filepath.Join(tmp, "srcdir")
-    dst := filepath.Join(tmp, "dstdir")
-    _ = os.MkdirAll(src, 0o755)
-
-    // -r なしでディレクトリ
-    code, errOut = runWithIntercept(t, nil, func() { runCp([]string{src, dst}) })
-    if code != exitUsage || !strings.Contains(errOut, "specify -r") {
-        t.Fatalf("dir without -r: code=%d stderr=%q", code, errOut)
-    }
-
-    // 同一パス
-    code, errOut = runWithIntercept(t, nil, func() { runCp([]string{"-r", src, src}) })
-    if code != exitUsage || !strings.Contains(errOut, "same path") {
-        t.Fatalf("same path: code=%d stderr=%q", code, errOut)
-    }
-
-    // 入れ子（DSTがSRCの内側）
-    inner := filepath.Join(src, "inner")
-    code, errOut = runWithIntercept(t, nil, func() { runCp([]string{"-r", src, inner}) })
-    if code != exitUsage || !strings.Contains(errOut, "DST is inside SRC") {
-        t.Fatalf("nest: code=%d stderr=%q", code, errOut)
-    }
-}
-func TestSameFile_ChecksumEqual(t *testing.T) {
-	dir := t.TempDir()
-	a := filepath.Join(dir,"a.txt")
-	b := filepath.Join(dir,"b.txt")
-	os.WriteFile(a, []byte("same"), 0o644)
-	os.WriteFile(b, []byte("same"), 0o644)
-
-	si,_ := os.Stat(a); bi,_ := os.Stat(b)
-	// 時刻がズレていても checksum なら true を期待
-	same, err := sameFile(a, b, si, bi, options{checksum:true})
-	if err != nil || !same {
-		t.Fatalf("checksum equal should be true, err=%v", err)
+	code, errOut := runWithIntercept(t, []string{"cp", "-r", "--checksum", "--checksum-algo", "md5", src, dst}, func() { main() })
+	if code != exitUsage || !strings.Contains(errOut, "sha256") {
+		t.Fatalf("code=%d stderr=%q", code, errOut)
+	}
+	code, errOut = runWithIntercept(t, []string{"cp", "-r", "--checksum", "--checksum-algo", "sha256", "--no-checksum-cache", src, dst}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("sha256: code=%d stderr=%q", code, errOut)
 	}
 }
-func runWithIntercept(t *testing.T, args []string, f func()) (code int, errOut string) {
-    t.Helper()
-
-    oldExit, oldErr, oldArgs := exitFn, stderr, os.Args
-    defer func() { exitFn, stderr, os.Args = oldExit, oldErr, oldArgs }()
-
-    var buf bytes.Buffer
-    stderr = &buf
-    exitFn = func(c int) { panic(c) }
-    os.Args = append([]string{appName}, args...)
-
-    defer func() {
-        if r := recover(); r != nil {
-            if c, ok := r.(int); ok {
-                code = c
-            } else {
-                t.Fatalf("unexpected panic: %#v", r)
-            }
-        }
-        errOut = buf.String()
-    }()
-
-    f() // ここで main() や runCp(...) を直接呼ぶ
-    return
-}
-func TestHelp_TopicCp(t *testing.T) {
-    code, errOut := runWithIntercept(t, []string{"help", "cp"}, func() { main() })
-    if code != exitUsage || !strings.Contains(errOut, "cp - copy/sync") {
-        t.Fatalf("help cp: code=%d stderr=%q", code, errOut)
-    }
+
+func TestVerifyCommand(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, []string{"verify", src, dst}, func() { main() })
+	if code != exitMismatch || !strings.Contains(out.String(), "missing: a.txt") {
+		t.Fatalf("code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"verify", "--repair", src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "repaired") {
+		t.Fatalf("--repair: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"verify", "--checksum", "--no-checksum-cache", src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "DST matches SRC") {
+		t.Fatalf("after repair: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
+	code, errOut = runWithIntercept(t, []string{"verify", "--dry-run", src, dst}, func() { main() })
+	if code != exitUsage {
+		t.Fatalf("--dry-run without --repair: code=%d stderr=%q", code, errOut)
+	}
+
+	// backups of cp --backup are not extra entries
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a2"))
+	if code, errOut = runWithIntercept(t, []string{"cp", "-r", "--backup", "--checksum", src, dst}, func() { main() }); code != exitOK {
+		t.Fatalf("cp --backup: code=%d stderr=%q", code, errOut)
+	}
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a3"))
+	if code, errOut = runWithIntercept(t, []string{"cp", "-r", "--backup-dir", ".bk", "--checksum", src, dst}, func() { main() }); code != exitOK {
+		t.Fatalf("cp --backup-dir: code=%d stderr=%q", code, errOut)
+	}
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"verify", "--backup-dir", ".bk", src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), "DST matches SRC") {
+		t.Fatalf("after backups: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
 }
-func TestCp_HelpFlag(t *testing.T) {
-    code, errOut := runWithIntercept(t, nil, func() { runCp([]string{"--help"}) })
-    if code != exitUsage || !strings.Contains(errOut, "cp - copy/sync") {
-        t.Fatalf("cp --help: code=%d stderr=%q", code, errOut)
-    }
+
+func TestCp_ItemizeChanges(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, []string{"cp", "-r", "-i", src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), ">f+++++++ a.txt") {
+		t.Fatalf("code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"cp", "-r", "--itemize-changes", "--verbose", src, dst}, func() { main() })
+	if code != exitOK || !strings.Contains(out.String(), ".f        a.txt") {
+		t.Fatalf("unchanged: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
 }
-func TestMirror_RemoveDir_And_SkipExcludedVerbose(t *testing.T) {
-    src := t.TempDir()
-    dst := t.TempDir()
-
-    // SRC: a/keep.txt のみ
-    writeFile(t, filepath.Join(src, "a", "keep.txt"), []byte("k"))
-
-    // DST: 余分な dir を用意（mirror で消えることを期待）
-    writeFile(t, filepath.Join(dst, "b", "extra.txt"), []byte("x"))
-
-    // DST: 除外対象も用意（node_modules）→ mirror時に "mirror-skip (excluded)" の行が実行される
-    writeFile(t, filepath.Join(dst, "node_modules", "stay.txt"), []byte("s"))
-
-    opt := options{
-        recursive: true,
-        mirror:    true,
-        dryRun:    false,
-        verbose:   true,                      // ← logf の行を実行させる
-        excludes:  []string{"node_modules"},  // ← mirror-skip (excluded) を踏む
-    }
-    if err := syncDir(src, dst, opt); err != nil {
-        t.Fatalf("syncDir mirror: %v", err)
-    }
-
-    // b/ は削除される
-    if _, err := os.Stat(filepath.Join(dst, "b")); !os.IsNotExist(err) {
-        t.Fatalf("mirror should remove extra dir 'b'")
-    }
-    // 除外は残る
-    if _, err := os.Stat(filepath.Join(dst, "node_modules", "stay.txt")); err != nil {
-        t.Fatalf("excluded path should remain: %v", err)
-    }
+
+func TestCp_Stats(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("hello"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, []string{"cp", "-r", "--stats", src, dst}, func() { main() })
+	if code != exitOK {
+		t.Fatalf("code=%d stderr=%q", code, errOut)
+	}
+	for _, want := range []string{"Statistics:\n", "  Files copied:        1\n", "  Bytes written:       5\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+	out.Reset()
+	code, errOut = runWithIntercept(t, []string{"cp", "-r", "--stats", "--output", "json", src, dst}, func() { main() })
+	if code != exitOK || strings.Contains(out.String(), "Statistics:") || !strings.Contains(out.String(), `"stats":{"files_scanned":1,`) {
+		t.Fatalf("json: code=%d stdout=%q stderr=%q", code, out.String(), errOut)
+	}
 }
-func TestRemovePath_FileAndDir_RealDelete(t *testing.T) {
-    base := t.TempDir()
-
-    // file
-    f := filepath.Join(base, "x.txt")
-    writeFile(t, f, []byte("x"))
-    if err := removePath(f, false, options{dryRun: false}); err != nil {
-        t.Fatalf("remove file: %v", err)
-    }
-    if _, err := os.Stat(f); !os.IsNotExist(err) {
-        t.Fatalf("file should be removed")
-    }
-
-    // dir
-    d := filepath.Join(base, "d")
-    writeFile(t, filepath.Join(d, "y.txt"), []byte("y"))
-    if err := removePath(d, true, options{dryRun: false}); err != nil {
-        t.Fatalf("remove dir: %v", err)
-    }
-    if _, err := os.Stat(d); !os.IsNotExist(err) {
-        t.Fatalf("dir should be removed")
-    }
+
+func TestCp_KeepGoing(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(src, "blk", "f.txt"), []byte("f"))
+	writeFile(t, filepath.Join(dst, "blk"), []byte("a file where SRC has a dir"))
+
+	var out bytes.Buffer
+	oldOut := stdout
+	stdout = &out
+	defer func() { stdout = oldOut }()
+
+	code, errOut := runWithIntercept(t, []string{"cp", "-r", "--keep-going", src, dst}, func() { main() })
+	sep := string(filepath.Separator)
+	if code != exitPartial || !strings.Contains(errOut, "partial transfer: 1 failure(s)") || !strings.Contains(errOut, "  mkdir (1):\n    blk"+sep+": mkdir: ") {
+		t.Fatalf("code=%d stderr=%q", code, errOut)
+	}
+	if !strings.Contains(out.String(), "error (mkdir): blk"+sep+": ") {
+		t.Fatalf("stdout=%q", out.String())
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "a.txt")); string(got) != "a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+
+	code, errOut = runWithIntercept(t, []string{"cp", "-r", src, dst}, func() { main() })
+	if code != exitRuntimeError {
+		t.Fatalf("without --keep-going: code=%d stderr=%q", code, errOut)
+	}
 }
-func TestDieHelpers(t *testing.T) {
-    code, errOut := runWithIntercept(t, nil, func() { dieUsagef("oops %d", 1) })
-    if code != exitUsage || !strings.Contains(errOut, "cp - copy/sync") || !strings.Contains(errOut, "oops 1") {
-        t.Fatalf("dieUsagef: code=%d stderr=%q", code, errOut)
-    }
-
-    code, errOut = runWithIntercept(t, nil, func() { dieRuntime(errors.New("boom")) })
-    if code != exitRuntimeError || !strings.Contains(errOut, "boom") {
-        t.Fatalf("dieRuntime: code=%d stderr=%q", code, errOut)
-    }
-}
\ No newline at end of file
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"syncdir/engine"
+)
+
+// defaultTrashDir is where --trash puts its runs when --trash-dir is not
+// given, relative to DST.
+const defaultTrashDir = ".syncdir-trash"
+
+func restoreUsage() string {
+	return fmt.Sprintf(`%s restore - put back entries a mirror run moved to the trash
+
+Usage:
+  %s restore [--dst DST] [--trash-dir DIR] [--dry-run] [--verbose] [--output text|json] RUN
+
+RUN is the trash directory a 'cp --mirror --trash' run printed
+("trash: N item(s) moved to RUN"), or a run id such as 20260116-120000. A
+run id is looked up in --trash-dir, or in DST/.syncdir-trash with --dst
+(a relative --trash-dir is then taken relative to DST). Every entry in the run's manifest is moved back to its original
+path. Entries whose path exists again are refused (reported as "refuse: ...")
+and stay in the trash; restore then exits with status 1.
+
+Options:
+  --dst DST      Mirror destination whose trash holds the run
+  --trash-dir D  Trash directory holding the run (e.g. "E:\dst\.syncdir-trash")
+  --dry-run      Show what would be restored without changing anything
+  --verbose      Verbose logging
+  --output F     Log format: text (default) or json
+  --help         Show this help for 'restore'
+
+Examples:
+  %s restore "E:\dst\.syncdir-trash\20260116-120000"
+  %s restore --dst "E:\dst" 20260116-120000
+  %s trash list "E:\dst\.syncdir-trash"
+`, appName, appName, appName, appName, appName)
+}
+
+func trashUsage() string {
+	return fmt.Sprintf(`%s trash - inspect and clean the trash of mirror runs
+
+Usage:
+  %s trash list DIR
+  %s trash purge --older-than AGE [--dry-run] [--verbose] [--output text|json] DIR
+
+DIR is a trash directory (by default .syncdir-trash inside DST).
+
+Commands:
+  list           Show each run: id, time, number of entries
+  purge          Delete the runs older than AGE
+
+Options:
+  --older-than A Age such as 36h, 30d or 90m (required for purge)
+  --dry-run      Show what would be deleted without changing anything
+  --verbose      Verbose logging
+  --output F     Log format: text (default) or json
+  --help         Show this help for 'trash'
+
+Examples:
+  %s trash purge --older-than 30d "E:\dst\.syncdir-trash"
+`, appName, appName, appName, appName)
+}
+
+/* =========================
+      SUBCOMMAND: restore
+========================= */
+
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var opt engine.Options
+	var verbose, wantHelp bool
+	var output, trashDir, dst string
+	fs.StringVar(&dst, "dst", "", "mirror destination whose trash holds the run")
+	fs.StringVar(&trashDir, "trash-dir", "", "trash directory holding the run")
+	fs.BoolVar(&opt.DryRun, "dry-run", false, "show actions without changing anything")
+	fs.BoolVar(&verbose, "verbose", false, "verbose logging")
+	fs.StringVar(&output, "output", outputText, "output format: text or json")
+	fs.BoolVar(&wantHelp, "help", false, "show help")
+
+	if err := fs.Parse(args); err != nil {
+		dieUsage(restoreUsage, "Argument error: %v\n", err)
+	}
+	if wantHelp {
+		printErr(restoreUsage())
+		exitFn(exitUsage)
+	}
+	if output != outputText && output != outputJSON {
+		dieUsage(restoreUsage, "error: --output must be %q or %q (got %q)\n", outputText, outputJSON, output)
+	}
+	if fs.NArg() != 1 {
+		dieUsage(restoreUsage, "error: need exactly one RUN\n")
+	}
+	run := fs.Arg(0)
+	bare := !strings.ContainsAny(run, `/\`)
+	if dst != "" && (trashDir == "" || !filepath.IsAbs(trashDir)) {
+		if trashDir == "" {
+			trashDir = defaultTrashDir
+		}
+		trashDir = filepath.Join(dst, trashDir)
+	}
+	if trashDir != "" && bare {
+		run = filepath.Join(trashDir, run)
+	}
+	if _, err := os.Stat(run); err != nil {
+		if bare && trashDir == "" {
+			dieUsage(restoreUsage, "error: no such trash run: %s (a run id needs --dst DST or --trash-dir DIR)\n", run)
+		}
+		dieUsage(restoreUsage, "error: no such trash run: %s\n", run)
+	}
+
+	opt.Reporter = newReporter(output, verbose)
+	if _, err := engine.New(opt).Restore(filepath.Clean(run)); err != nil {
+		if errors.Is(err, engine.ErrRestoreConflict) {
+			printErr("error: " + err.Error() + "; move the new entries away and run restore again\n")
+			exitFn(exitRuntimeError)
+		}
+		dieRuntime(err)
+	}
+}
+
+/* =========================
+       SUBCOMMAND: trash
+========================= */
+
+func runTrash(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "purge") {
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+			printErr(trashUsage())
+			exitFn(exitUsage)
+		}
+		dieUsage(trashUsage, "error: need 'list' or 'purge'\n")
+	}
+	fs := flag.NewFlagSet("trash "+args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var opt engine.Options
+	var verbose, wantHelp bool
+	var output, olderThan string
+	fs.StringVar(&olderThan, "older-than", "", "age of the runs to delete")
+	fs.BoolVar(&opt.DryRun, "dry-run", false, "show actions without changing anything")
+	fs.BoolVar(&verbose, "verbose", false, "verbose logging")
+	fs.StringVar(&output, "output", outputText, "output format: text or json")
+	fs.BoolVar(&wantHelp, "help", false, "show help")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		dieUsage(trashUsage, "Argument error: %v\n", err)
+	}
+	if wantHelp {
+		printErr(trashUsage())
+		exitFn(exitUsage)
+	}
+	if output != outputText && output != outputJSON {
+		dieUsage(trashUsage, "error: --output must be %q or %q (got %q)\n", outputText, outputJSON, output)
+	}
+	if fs.NArg() != 1 {
+		dieUsage(trashUsage, "error: need exactly one trash DIR\n")
+	}
+	dir := filepath.Clean(fs.Arg(0))
+
+	if args[0] == "list" {
+		runs, err := engine.ListTrash(dir)
+		if err != nil {
+			dieRuntime(err)
+		}
+		for _, r := range runs {
+			_, _ = fmt.Fprintf(stdout, "%s  %s  %d entries\n", r.ID, r.Created.Local().Format("2006-01-02 15:04:05"), len(r.Entries))
+		}
+		return
+	}
+
+	if olderThan == "" {
+		dieUsage(trashUsage, "error: purge needs --older-than\n")
+	}
+	age, err := parseAge(olderThan)
+	if err != nil || age < 0 {
+		dieUsage(trashUsage, "error: --older-than must be an age such as 36h or 30d (got %q)\n", olderThan)
+	}
+	opt.Reporter = newReporter(output, verbose)
+	res, err := engine.New(opt).PurgeTrash(dir, age)
+	if err != nil {
+		dieRuntime(err)
+	}
+	if output == outputText && !opt.DryRun {
+		_, _ = fmt.Fprintf(stdout, "trash: %d run(s) purged from %s\n", res.Counts[engine.EventDelete], dir)
+	}
+}
+
+// parseAge is time.ParseDuration plus a "d" (24h) suffix: "30d", "1d12h".
+func parseAge(s string) (time.Duration, error) {
+	days := time.Duration(0)
+	if i := strings.IndexByte(s, 'd'); i >= 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, err
+		}
+		days, s = time.Duration(n)*24*time.Hour, s[i+1:]
+		if s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	return days + d, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"syncdir/engine"
+)
+
+func verifyUsage() string {
+	return fmt.Sprintf(`%s verify - check that DST matches SRC
+
+Usage:
+  %s verify [--checksum] [--checksum-algo ALGO] [--checksum-cache DIR] [--no-checksum-cache]
+                [--include PATTERN ...] [--exclude PATTERN ...] [--exclude-from FILE ...]
+                [--links MODE] [--abs-links keep|rewrite] [--preserve LIST]
+                [--backup-dir DIR] [--suffix SUFFIX]
+                [--repair [--dry-run]] [--bwlimit RATE] [--verbose] [--output text|json] SRC DST
+
+Compares the two trees without changing anything and prints one line per
+difference:
+  missing        in SRC, not in DST
+  extra          in DST, not in SRC
+  type           e.g. a file in SRC, a directory in DST
+  size           sizes differ
+  content        hashes differ (--checksum), or symlink targets (--links=preserve)
+  meta           mtimes more than 1s apart, or a --preserve kind differs
+Files are compared the way 'cp -r' decides whether to copy them; with
+--checksum every file of equal size is hashed as well. Excluded entries,
+temp and partial files, the .syncdir-trash directory and the backups of
+'cp --backup' (NAME~, or as set by --suffix and --backup-dir) are not
+checked.
+Exits with status 4 if DST differs.
+
+Options:
+  --checksum     Also compare file hashes (slower; hashes are cached, see 'help cp')
+  --checksum-algo A  sha1 (default), sha256, crc32c or xxh64
+  --checksum-cache D  Directory of the hash caches
+  --no-checksum-cache Hash every file on every --checksum run
+  --include X    Include pattern (can repeat; see 'help cp')
+  --exclude X    Exclude pattern (can repeat; see 'help cp')
+  --exclude-from F  Read exclude patterns from a .gitignore-style file
+  --links MODE   Symlinks inside SRC: copy (default), preserve, skip or follow (see 'help cp')
+  --abs-links X  With --links=preserve: keep or rewrite absolute targets inside SRC
+  --preserve L   Also compare these metadata kinds: mode, owner, times (exact), xattr, or all
+  --backup-dir D The --backup-dir of earlier 'cp --backup' runs; it is not checked
+  --suffix S     The backup suffix of earlier 'cp --backup' runs (default "~");
+                 DST entries ending in it are not checked
+  --repair       Copy missing and differing entries again (extra entries and
+                 directories where SRC has a file are left alone); exits with
+                 status 4 only if something could not be repaired
+  --dry-run      With --repair: show the repairs without making them
+  --bwlimit R    Limit hashing and repair throughput, e.g. 10M (see 'help cp')
+  --verbose      Also list matching and excluded entries
+  --output F     Output format: text (default) or json
+  --help         Show this help for 'verify'
+
+Examples:
+  %s verify "E:\src" "\\nas\share\dst"
+  %s verify --checksum --checksum-algo xxh64 --exclude ".git" "E:\src" "E:\dst"
+  %s verify --repair "E:\src" "\\nas\share\dst"
+`, appName, appName, appName, appName, appName)
+}
+
+/* =========================
+      SUBCOMMAND: verify
+========================= */
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var tf treeFlags
+	tf.register(fs)
+	fs.BoolVar(&tf.opt.Repair, "repair", false, "copy missing and differing entries again")
+	fs.BoolVar(&tf.opt.DryRun, "dry-run", false, "with --repair: show the repairs without making them")
+	tf.parse(fs, args, verifyUsage)
+	opt := tf.opt
+
+	if opt.DryRun && !opt.Repair {
+		dieUsage(verifyUsage, "error: --dry-run only applies to --repair; verify never changes anything by itself\n")
+	}
+	if fs.NArg() != 2 {
+		dieUsage(verifyUsage, "error: need SRC and DST\n")
+	}
+	src, dst := filepath.Clean(fs.Arg(0)), filepath.Clean(fs.Arg(1))
+
+	res, err := engine.New(opt).Verify(src, dst)
+	if err != nil {
+		if errors.Is(err, engine.ErrMismatch) {
+			printErr("error: " + err.Error() + "\n")
+			exitFn(exitMismatch)
+		}
+		dieSync(err, src, dst, verifyUsage)
+	}
+	if tf.output != outputText {
+		return
+	}
+	if n := res.Counts[engine.EventDiff]; n > 0 {
+		_, _ = fmt.Fprintf(stdout, "verify: %d difference(s) repaired\n", n)
+	} else {
+		_, _ = fmt.Fprintln(stdout, "verify: DST matches SRC")
+	}
+}
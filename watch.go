@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"syncdir/engine"
+)
+
+func watchUsage() string {
+	return fmt.Sprintf(`%s watch - keep DST in sync with SRC continuously
+
+Usage:
+  %s watch [--mirror] [--debounce DUR] [--rescan DUR] [--include PATTERN ...] [--exclude PATTERN ...]
+                [--exclude-from FILE ...] [--verbose] [--checksum] [--parallel N] [--output text|json]
+                [--links MODE] [--preserve LIST] [--delta] [--partial] SRC DST
+
+Does one full sync like 'cp -r', then waits for changes under SRC and syncs
+only the changed files and directories. Changes are gathered until nothing
+has happened for --debounce, so an editor's save or a build's burst of
+writes is synced once. On Linux inotify is used; elsewhere SRC is polled
+every 2s. A full rescan runs every --rescan in case a change was missed.
+Stop with Ctrl+C.
+
+Options:
+  --debounce D   Quiet time before a batch of changes is synced (default 500ms)
+  --rescan D     Full rescan interval, e.g. 10m, 1h; 0 disables (default 10m)
+  (all options of 'cp' except -r and --dry-run; see 'help cp')
+  --help         Show this help for 'watch'
+
+Examples:
+  %s watch --mirror --exclude ".git" "C:\work" "E:\backup\work"
+  %s watch --debounce 2s --rescan 0 "C:\work" "\\nas\share\work"
+`, appName, appName, appName, appName)
+}
+
+/* =========================
+      SUBCOMMAND: watch
+========================= */
+
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	var sf syncFlags
+	sf.register(fs)
+	fs.DurationVar(&sf.opt.Debounce, "debounce", 500*time.Millisecond, "quiet time before syncing a batch")
+	fs.DurationVar(&sf.opt.Rescan, "rescan", 10*time.Minute, "full rescan interval (0 disables)")
+	sf.parse(fs, args, watchUsage)
+	if sf.opt.Debounce <= 0 {
+		dieUsage(watchUsage, "error: --debounce must be positive (got %s)\n", sf.opt.Debounce)
+	}
+	if sf.opt.Rescan < 0 {
+		dieUsage(watchUsage, "error: --rescan must not be negative (got %s)\n", sf.opt.Rescan)
+	}
+	if fs.NArg() != 2 {
+		dieUsage(watchUsage, "error: need SRC and DST\n")
+	}
+	src, dst := filepath.Clean(fs.Arg(0)), filepath.Clean(fs.Arg(1))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := engine.New(sf.opt).Watch(ctx, src, dst); err != nil {
+		dieSync(err, src, dst, watchUsage)
+	}
+}